@@ -0,0 +1,665 @@
+package main
+
+/*
+account.go -- data-subject requests: a JSON archive of a user's personal
+    data, and deleting their account
+
+Deleting an account lets go of the user's seats at conferences that
+aren't over, hands the conferences they organize over to someone else or
+cancels them, deletes what only they had (notifications, saved searches,
+webhooks, avatar) and anonymizes their Profile. Registrations for past
+conferences, invoices and the audit log are kept for the organizers'
+records; in them the user's id is replaced by a pseudonym, and their email
+in audit snapshots too. Invoices keep the buyer details printed on them.
+
+Datastore keys can't be renamed, so the keys of the Profile, of the
+user's Registrations and of the conferences they created still hold the
+user id, as do the entity and conference keys the audit log refers to.
+Nothing looks the user up through them any more: signing in again later
+starts a new, empty Profile with no registrations or conferences.
+
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//How long a signed personal data link stays valid.
+const MY_DATA_EXPORT_TTL = 10 * time.Minute
+
+//Display name left on deleted Profiles.
+const DELETED_DISPLAY_NAME = "Deleted user"
+
+//Registrations of a cancelled conference are let go this many per task.
+const CANCEL_CONFERENCE_BATCH = 50
+
+//Entities deleted or written per datastore call.
+const ACCOUNT_BATCH = 500
+
+type myDataRegistration struct {
+	//myDataRegistration -- a Registration in a personal data archive
+	ConferenceName string `json:"conferenceName"`
+	Registration
+}
+
+type myDataArchive struct {
+	//myDataArchive -- everything exportMyData hands out
+	ExportedAt string `json:"exportedAt"`
+	UserId string `json:"userId"`
+	Profile *ProfileForm `json:"profile"`
+	Registrations []myDataRegistration `json:"registrations"`
+	ConferencesCreated []ConferenceForm `json:"conferencesCreated"`
+	Notifications []NotificationForm `json:"notifications"`
+	SavedSearches []SavedSearchForm `json:"savedSearches"`
+	Webhooks []WebhookForm `json:"webhooks"`
+}
+
+func conferenceOver(conf *Conference, now time.Time) bool {
+	//Return true if conf has ended at now. Whole-day dates end the day
+	//after; without an end date it ends when it starts, and without dates
+	//it never does.
+	end := conf.EndDate
+	if end.IsZero() {
+		end = conf.StartDate
+	}
+	if end.IsZero() {
+		return false
+	}
+	if isAllDay(conf) {
+		end = end.In(conferenceLocation(conf)).AddDate(0, 0, 1)
+	}
+	return !now.Before(end)
+}
+
+func deletedUserId(userId string) string {
+	//Return the pseudonym replacing userId in the records kept after its
+	//account is deleted. It is the same every time, so a retried deletion
+	//carries on with it, and can't be traced back without the signing secret.
+	return "deleted-" + signToken("deletedUser", userId)
+}
+
+func deletedRegistration(regKey *datastore.Key, reg *Registration) bool {
+	//Report whether reg, stored at regKey, was kept from a deleted account.
+	//Its key is still named after the user id, so a new account of the same
+	//user must not take it for its own.
+	return reg.UserId == deletedUserId(regKey.StringID())
+}
+
+func getMyData(r *http.Request, profKey *datastore.Key) (*myDataArchive, error) {
+	//Gather the personal data of the user of profKey.
+	appCtx := appengine.NewContext(r)
+	userId := profKey.StringID()
+	var prof Profile
+	if err := datastore.Get(appCtx, profKey, &prof); err != nil {
+		return nil, err
+	}
+	pf, err := copyProfileToForm(r, &prof)
+	if err != nil {
+		return nil, err
+	}
+	archive := &myDataArchive{
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		UserId: userId,
+		Profile: pf,
+		Registrations: []myDataRegistration{},
+		ConferencesCreated: []ConferenceForm{},
+		Notifications: []NotificationForm{},
+		SavedSearches: []SavedSearchForm{},
+		Webhooks: []WebhookForm{},
+	}
+
+	var regs []Registration
+	if _, err := datastore.NewQuery("Registration").Filter("UserId=", userId).GetAll(appCtx, &regs); err != nil {
+		return nil, err
+	}
+	for v := range regs {
+		reg := myDataRegistration{Registration: regs[v]}
+		var conf Conference
+		if key, err := datastore.DecodeKey(regs[v].ConferenceKey); err == nil && datastore.Get(appCtx, key, &conf) == nil {
+			reg.ConferenceName = conf.Name
+		}
+		archive.Registrations = append(archive.Registrations, reg)
+	}
+
+	var conferences []Conference
+	confKeys, err := datastore.NewQuery("Conference").Filter("OrganizerUserId=", userId).GetAll(appCtx, &conferences)
+	if err != nil {
+		return nil, err
+	}
+	for v := range conferences {
+		cf, _ := copyConferenceToForm(&conferences[v], confKeys[v].Encode(), prof.DisplayName)
+		archive.ConferencesCreated = append(archive.ConferencesCreated, *cf)
+	}
+
+	var notifications []Notification
+	keys, err := datastore.NewQuery("Notification").Ancestor(profKey).GetAll(appCtx, &notifications)
+	if err != nil {
+		return nil, err
+	}
+	for v := range notifications {
+		archive.Notifications = append(archive.Notifications, *copyNotificationToForm(&notifications[v], keys[v].Encode()))
+	}
+
+	var searches []SavedSearch
+	keys, err = datastore.NewQuery("SavedSearch").Ancestor(profKey).GetAll(appCtx, &searches)
+	if err != nil {
+		return nil, err
+	}
+	for v := range searches {
+		if ssf, err := copySavedSearchToForm(&searches[v], keys[v].Encode()); err == nil {
+			archive.SavedSearches = append(archive.SavedSearches, *ssf)
+		}
+	}
+
+	var hooks []Webhook
+	keys, err = datastore.NewQuery("Webhook").Ancestor(profKey).GetAll(appCtx, &hooks)
+	if err != nil {
+		return nil, err
+	}
+	for v := range hooks {
+		archive.Webhooks = append(archive.Webhooks, *copyWebhookToForm(&hooks[v], keys[v].Encode()))
+	}
+	return archive, nil
+}
+
+func (h *ConferenceApi) ExportMyData(r *http.Request) (*StringMessage, error) {
+	//Return a short-lived signed link to a JSON archive of the current
+	//user's personal data.
+	_, profKey, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	userId := profKey.StringID()
+	expires := strconv.FormatInt(time.Now().Add(MY_DATA_EXPORT_TTL).Unix(), 10)
+	v := url.Values{
+		"user": {userId},
+		"expires": {expires},
+		"sig": {signToken("mydata.json", userId, expires)},
+	}
+	return &StringMessage{
+		Data: "https://" + appengine.DefaultVersionHostname(appCtx) + "/export/mydata.json?" + v.Encode(),
+	}, nil
+}
+
+func MyDataHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve a signed link from exportMyData.
+	userId := r.FormValue("user")
+	expires := r.FormValue("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!verifyToken(r.FormValue("sig"), "mydata.json", userId, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired link"))
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	profKey := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	archive, err := getMyData(r, profKey)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "my data %s: %v", userId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	js, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		applog.Errorf(appCtx, "my data %s: %v", userId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="conference-central-data.json"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(js)
+	recordAudit(appCtx, userId, "profile.exportData", profKey, nil, nil, nil)
+}
+
+func transferConference(appCtx context.Context, confKey *datastore.Key, from string, to string) error {
+	//Make to the organizer of a conference organized by from. The key of
+	//the conference keeps naming its creator's Profile as parent.
+	var conf Conference
+	var before, after []byte
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		if conf.OrganizerUserId != from {
+			return nil
+		}
+		before = auditSnapshot(&conf)
+		conf.OrganizerUserId = to
+		after = auditSnapshot(&conf)
+		_, err := datastore.Put(appCtx, confKey, &conf)
+		return err
+	}, nil)
+	if err != nil || after == nil {
+		return err
+	}
+	recordAudit(appCtx, from, "conference.transfer", confKey, confKey, before, after)
+	addNotification(appCtx, to, &Notification{
+		Type: NOTIFICATION_CONFERENCE_TRANSFERRED,
+		Title: "You are now the organizer of " + conf.Name,
+		WebsafeConferenceKey: confKey.Encode(),
+	})
+	fireConferenceEvent(appCtx, EVENT_CONFERENCE_UPDATED, &conf, confKey)
+	return nil
+}
+
+func cancelConference(appCtx context.Context, confKey *datastore.Key, actor string) error {
+	//Cancel a conference: nobody can register any more, and a task lets
+	//its attendees go with a full refund.
+	var conf Conference
+	var before, after []byte
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		if !conf.CancelledAt.IsZero() {
+			return nil
+		}
+		before = auditSnapshot(&conf)
+		conf.CancelledAt = time.Now()
+		after = auditSnapshot(&conf)
+		if _, err := datastore.Put(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		task := taskqueue.NewPOSTTask("/tasks/cancel_conference", url.Values{
+			"conferenceKey": {confKey.Encode()},
+		})
+		_, err := taskqueue.Add(appCtx, task, "")
+		return err
+	}, nil)
+	if err != nil || after == nil {
+		return err
+	}
+	recordAudit(appCtx, actor, "conference.cancel", confKey, confKey, before, after)
+	fireConferenceEvent(appCtx, EVENT_CONFERENCE_CANCELLED, &conf, confKey)
+	return nil
+}
+
+func CancelConferenceHandler(w http.ResponseWriter, r *http.Request) {
+	//Unregister CANCEL_CONFERENCE_BATCH registrations of a cancelled
+	//conference, re-queueing itself with a cursor until all are covered.
+	//Safe to re-run.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	confKey, err := datastore.DecodeKey(r.PostFormValue("conferenceKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var conf Conference
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+		applog.Warningf(appCtx, "cancel conference %v: %v", confKey, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	websafeConferenceKey := confKey.Encode()
+	q := datastore.NewQuery("Registration").Filter("ConferenceKey=", websafeConferenceKey)
+	if c := r.PostFormValue("cursor"); c != "" {
+		cursor, err := datastore.DecodeCursor(c)
+		if err != nil {
+			applog.Errorf(appCtx, "cancel conference %v: bad cursor: %v", confKey, err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q = q.Start(cursor)
+	}
+	it := q.Limit(CANCEL_CONFERENCE_BATCH).Run(appCtx)
+	n := 0
+	for {
+		var reg Registration
+		_, err := it.Next(&reg)
+		if err == datastore.Done {
+			break
+		}
+		if err == nil && (reg.Status == REGISTRATION_REGISTERED || reg.Status == REGISTRATION_HELD) {
+			var changed bool
+			_, changed, err = applyRegistration(appCtx, reg.UserId, &RegistrationRequest{WebsafeConferenceKey: websafeConferenceKey}, REGISTRATION_OP_UNREGISTER, 0)
+			if changed && reg.Status == REGISTRATION_REGISTERED {
+				addNotification(appCtx, reg.UserId, &Notification{
+					Type: NOTIFICATION_CONFERENCE_CANCELLED,
+					Title: conf.Name + " was cancelled",
+					WebsafeConferenceKey: websafeConferenceKey,
+				})
+			}
+		}
+		if err != nil {
+			applog.Errorf(appCtx, "cancel conference %v: %v", confKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n++
+	}
+	if n == CANCEL_CONFERENCE_BATCH {
+		cursor, err := it.Cursor()
+		if err == nil {
+			task := taskqueue.NewPOSTTask("/tasks/cancel_conference", url.Values{
+				"conferenceKey": {websafeConferenceKey},
+				"cursor": {cursor.String()},
+			})
+			_, err = taskqueue.Add(appCtx, task, "")
+		}
+		if err != nil {
+			applog.Errorf(appCtx, "cancel conference %v: %v", confKey, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func deleteDescendants(appCtx context.Context, kind string, ancestor *datastore.Key) error {
+	//Delete every kind entity under ancestor.
+	keys, err := datastore.NewQuery(kind).Ancestor(ancestor).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > ACCOUNT_BATCH {
+			n = ACCOUNT_BATCH
+		}
+		if err := datastore.DeleteMulti(appCtx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func updateEntity(appCtx context.Context, key *datastore.Key, dst interface{}, change func() bool) error {
+	//Get an entity into dst and write it back if change, applied to dst,
+	//returns true; all in one transaction.
+	return datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, key, dst); err != nil {
+			return err
+		}
+		if !change() {
+			return nil
+		}
+		_, err := datastore.Put(appCtx, key, dst)
+		return err
+	}, nil)
+}
+
+func rewriteAuditEvents(appCtx context.Context, q *datastore.Query, change func(ev *AuditEvent)) error {
+	//Apply change to the audit events q finds. The log is append-only, so
+	//nothing else writes them meanwhile.
+	var events []AuditEvent
+	keys, err := q.GetAll(appCtx, &events)
+	if err != nil {
+		return err
+	}
+	for v := range events {
+		change(&events[v])
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > ACCOUNT_BATCH {
+			n = ACCOUNT_BATCH
+		}
+		if _, err := datastore.PutMulti(appCtx, keys[:n], events[:n]); err != nil {
+			return err
+		}
+		keys, events = keys[n:], events[n:]
+	}
+	return nil
+}
+
+func pseudonymizeUser(appCtx context.Context, userId string, email string) error {
+	//Replace userId by its pseudonym in the Registrations, Conferences,
+	//AttendeeMessages, Invoices and audit log kept after the account is
+	//deleted, and email in audit snapshots too.
+	pseudonym := deletedUserId(userId)
+	profKey := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	regKeys, err := datastore.NewQuery("Registration").Filter("UserId=", userId).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+	createdKeys, err := datastore.NewQuery("Conference").Ancestor(profKey).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+	organizedKeys, err := datastore.NewQuery("Conference").Filter("OrganizerUserId=", userId).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+	msgKeys, err := datastore.NewQuery("AttendeeMessage").Filter("OrganizerUserId=", userId).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+	invoiceKeys, err := datastore.NewQuery("Invoice").Filter("UserId=", userId).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return err
+	}
+
+	//the audit log first: the queries above stop finding what is
+	//rewritten below, so a retry would miss the events about it
+	var quoted [][]byte
+	for _, id := range []string{userId, email} {
+		if id != "" {
+			js, _ := json.Marshal(id)
+			quoted = append(quoted, js)
+		}
+	}
+	js, _ := json.Marshal(pseudonym)
+	replace := func(snapshot []byte) []byte {
+		for _, q := range quoted {
+			snapshot = bytes.Replace(snapshot, q, js, -1)
+		}
+		return snapshot
+	}
+	pseudonymize := func(ev *AuditEvent) {
+		ev.Before, ev.After, ev.Diff = replace(ev.Before), replace(ev.After), replace(ev.Diff)
+	}
+	//whoever made them, changes to these may name the user
+	entityKeys := append(append(regKeys, createdKeys...), organizedKeys...)
+	for _, key := range append(entityKeys, msgKeys...) {
+		if err := rewriteAuditEvents(appCtx, datastore.NewQuery("AuditEvent").Filter("EntityKey=", key.Encode()), pseudonymize); err != nil {
+			return err
+		}
+	}
+	//what the user did; snapshots of what was deleted with the account go
+	err = rewriteAuditEvents(appCtx, datastore.NewQuery("AuditEvent").Filter("Actor=", userId), func(ev *AuditEvent) {
+		ev.Actor = pseudonym
+		switch ev.EntityKind {
+		case "Profile", "Notification", "SavedSearch", "Webhook", "WebhookDelivery":
+			ev.Before, ev.After, ev.Diff = nil, nil, nil
+		default:
+			pseudonymize(ev)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	err = rewriteAuditEvents(appCtx, datastore.NewQuery("AuditEvent").Filter("EntityKey=", profKey.Encode()), func(ev *AuditEvent) {
+		ev.Before, ev.After, ev.Diff = nil, nil, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range regKeys {
+		var reg Registration
+		err := updateEntity(appCtx, key, &reg, func() bool {
+			if reg.UserId != userId {
+				return false
+			}
+			reg.UserId = pseudonym
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	//conferences it created and handed over keep their new organizer
+	for _, key := range append(createdKeys, organizedKeys...) {
+		var conf Conference
+		err := updateEntity(appCtx, key, &conf, func() bool {
+			if conf.OrganizerUserId != userId {
+				return false
+			}
+			conf.OrganizerUserId = pseudonym
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range msgKeys {
+		var msg AttendeeMessage
+		err := updateEntity(appCtx, key, &msg, func() bool {
+			if msg.OrganizerUserId != userId {
+				return false
+			}
+			msg.OrganizerUserId = pseudonym
+			msg.OrganizerEmail = ""
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range invoiceKeys {
+		var inv Invoice
+		err := updateEntity(appCtx, key, &inv, func() bool {
+			if inv.UserId != userId {
+				return false
+			}
+			inv.UserId = pseudonym
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *ConferenceApi) DeleteMyAccount(r *http.Request, dr *DeleteAccountRequest) (*DeleteAccountForm, error) {
+	//Delete the current user's account; see the top of account.go. Safe to
+	//retry if it fails half way.
+	prof, profKey, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	userId := profKey.StringID()
+	if err := validateDeleteAccountRequest(dr, prof, userId); err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	newOrganizer := dr.TransferConferencesTo
+	if newOrganizer != "" {
+		var other Profile
+		err := datastore.Get(appCtx, datastore.NewKey(appCtx, "Profile", newOrganizer, 0, nil), &other)
+		if err == datastore.ErrNoSuchEntity || (err == nil && !other.DeletedAt.IsZero()) {
+			return nil, endpoints.NewBadRequestError("%s has no profile to take the conferences over", newOrganizer)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	form := &DeleteAccountForm{}
+	now := time.Now()
+
+	//conferences first, so their attendees are let go while the
+	//organizer still exists; one under way is cancelled too
+	var conferences []Conference
+	confKeys, err := datastore.NewQuery("Conference").Filter("OrganizerUserId=", userId).GetAll(appCtx, &conferences)
+	if err != nil {
+		return nil, err
+	}
+	for v := range conferences {
+		if conferenceOver(&conferences[v], now) || !conferences[v].CancelledAt.IsZero() {
+			continue
+		}
+		if newOrganizer != "" {
+			err = transferConference(appCtx, confKeys[v], userId, newOrganizer)
+			form.Transferred++
+		} else {
+			err = cancelConference(appCtx, confKeys[v], userId)
+			form.Cancelled++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//then the user's own seats at conferences that aren't over
+	var regs []Registration
+	if _, err := datastore.NewQuery("Registration").Filter("UserId=", userId).GetAll(appCtx, &regs); err != nil {
+		return nil, err
+	}
+	for v := range regs {
+		if regs[v].Status != REGISTRATION_REGISTERED && regs[v].Status != REGISTRATION_HELD {
+			continue
+		}
+		confKey, err := datastore.DecodeKey(regs[v].ConferenceKey)
+		if err != nil {
+			continue
+		}
+		var conf Conference
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil || conferenceOver(&conf, now) {
+			continue
+		}
+		_, changed, err := applyRegistration(appCtx, userId, &RegistrationRequest{WebsafeConferenceKey: regs[v].ConferenceKey}, REGISTRATION_OP_UNREGISTER, 0)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			form.Unregistered++
+		}
+	}
+
+	//then what only the user had, the Profile last
+	for _, kind := range []string{"Notification", "SavedSearch", "WebhookDelivery", "Webhook"} {
+		if err := deleteDescendants(appCtx, kind, profKey); err != nil {
+			return nil, err
+		}
+	}
+	var avatar, thumbnail string
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		var prof Profile
+		if err := datastore.Get(appCtx, profKey, &prof); err != nil {
+			return err
+		}
+		avatar, thumbnail = prof.AvatarBlob, prof.AvatarThumbnailBlob
+		prof = Profile{
+			DisplayName: DELETED_DISPLAY_NAME,
+			TeeShirtSize: TeeShirtSizeToStringEnum(NOT_SPECIFIED),
+			EmailOptOuts: emailOptOutsFromForm(&EmailPreferencesForm{}),
+			DeletedAt: now,
+		}
+		_, err := datastore.Put(appCtx, profKey, &prof)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if store, err := getBlobStore(); err == nil {
+		deleteBlobs(appCtx, store, avatar, thumbnail)
+	}
+	if err := pseudonymizeUser(appCtx, userId, prof.MainEmail); err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, deletedUserId(userId), "profile.delete", profKey, nil, nil, nil)
+	return form, nil
+}
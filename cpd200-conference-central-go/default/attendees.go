@@ -0,0 +1,191 @@
+package main
+
+/*
+attendees.go -- the attendee roster of a conference, for its organizer,
+    as paginated API results and as a CSV download
+
+*/
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//getConferenceAttendees page size, default and maximum.
+const (
+	DEFAULT_ATTENDEES_LIMIT = 50
+	MAX_ATTENDEES_LIMIT = 200
+)
+
+//How long a signed attendees CSV link stays valid.
+const ATTENDEES_EXPORT_TTL = 10 * time.Minute
+
+func copyAttendeeToForm(prof *Profile, key *datastore.Key) *AttendeeForm {
+	//Copy the roster fields of an attending Profile to AttendeeForm.
+	email := prof.MainEmail
+	if email == "" {
+		email = key.StringID()
+	}
+	return &AttendeeForm{
+		DisplayName: prof.DisplayName,
+		MainEmail: email,
+		TeeShirtSize: StringEnumToTeeShirtSize(prof.TeeShirtSize),
+	}
+}
+
+func (h *ConferenceApi) GetConferenceAttendees(r *http.Request, aqf *AttendeeQueryForm) (*AttendeeForms, error) {
+	//Return a page of the attendees of a conference; organizer only.
+	_, confKey, _, err := getOrganizedConference(r, aqf.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	limit := aqf.Limit
+	if limit <= 0 {
+		limit = DEFAULT_ATTENDEES_LIMIT
+	}
+	if limit > MAX_ATTENDEES_LIMIT {
+		limit = MAX_ATTENDEES_LIMIT
+	}
+	q := attendeesQuery(confKey).KeysOnly().Limit(limit)
+	if aqf.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(aqf.Cursor)
+		if err != nil {
+			return nil, endpoints.NewBadRequestError("invalid cursor")
+		}
+		q = q.Start(cursor)
+	}
+
+	appCtx := appengine.NewContext(r)
+	regKeys := make([]*datastore.Key, 0, limit)
+	it := q.Run(appCtx)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		regKeys = append(regKeys, key)
+	}
+	profiles, profKeys, err := getRegisteredProfiles(appCtx, regKeys)
+	if err != nil {
+		return nil, err
+	}
+	forms := &AttendeeForms{
+		Items: make([]AttendeeForm, 0, len(profiles)),
+	}
+	for v := range profiles {
+		forms.Items = append(forms.Items, *copyAttendeeToForm(&profiles[v], profKeys[v]))
+	}
+	if len(regKeys) == limit {
+		if cursor, err := it.Cursor(); err == nil {
+			forms.NextCursor = cursor.String()
+		}
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) GetConferenceAttendeesCsvUrl(r *http.Request, cr *ConfRequest) (*StringMessage, error) {
+	//Return a short-lived signed link to the attendees CSV of a conference;
+	//organizer only. The browser can't send the OAuth token on a plain download.
+	_, key, user, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	userId := getUserId(user, "")
+	conf := key.Encode()
+	expires := strconv.FormatInt(time.Now().Add(ATTENDEES_EXPORT_TTL).Unix(), 10)
+	v := url.Values{
+		"conference": {conf},
+		"user": {userId},
+		"expires": {expires},
+		"sig": {signToken("attendees.csv", conf, userId, expires)},
+	}
+	return &StringMessage{
+		Data: "https://" + appengine.DefaultVersionHostname(appCtx) + "/export/attendees.csv?" + v.Encode(),
+	}, nil
+}
+
+func csvCell(s string) string {
+	//Neutralise cells a spreadsheet would otherwise evaluate as a formula.
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+func AttendeesCsvHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve a signed link from getConferenceAttendeesCsvUrl.
+	conf := r.FormValue("conference")
+	userId := r.FormValue("user")
+	expires := r.FormValue("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!verifyToken(r.FormValue("sig"), "attendees.csv", conf, userId, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired link"))
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	key, err := datastore.DecodeKey(conf)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var c Conference
+	if err := datastore.Get(appCtx, key, &c); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	//rejects links issued before the conference was transferred to a new organizer
+	if c.OrganizerUserId != userId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="attendees.csv"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"displayName", "mainEmail", "teeShirtSize"})
+	it := attendeesQuery(key).KeysOnly().Run(appCtx)
+	for done := false; !done; {
+		//profiles are fetched a page of registrations at a time
+		regKeys := make([]*datastore.Key, 0, MAX_ATTENDEES_LIMIT)
+		for len(regKeys) < MAX_ATTENDEES_LIMIT {
+			regKey, err := it.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				//headers are gone; all we can do is cut the file short
+				applog.Errorf(appCtx, "attendees csv %s: %v", conf, err)
+				done = true
+				break
+			}
+			regKeys = append(regKeys, regKey)
+		}
+		profiles, profKeys, err := getRegisteredProfiles(appCtx, regKeys)
+		if err != nil {
+			applog.Errorf(appCtx, "attendees csv %s: %v", conf, err)
+			break
+		}
+		for v := range profiles {
+			a := copyAttendeeToForm(&profiles[v], profKeys[v])
+			cw.Write([]string{csvCell(a.DisplayName), csvCell(a.MainEmail), TeeShirtSizeToStringEnum(a.TeeShirtSize)})
+		}
+	}
+	cw.Flush()
+	recordAudit(appCtx, userId, "conference.exportAttendees", key, key, nil, nil)
+}
@@ -0,0 +1,189 @@
+package main
+
+/*
+audit.go -- append-only log of mutations made through the Conference API
+
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	appuser "google.golang.org/appengine/user"
+)
+
+//getAuditEvents page size, default and maximum.
+const (
+	DEFAULT_AUDIT_LIMIT = 50
+	MAX_AUDIT_LIMIT = 200
+)
+
+func isAdmin(user *appuser.User) bool {
+	//Return true for App Engine admins and the emails listed in ADMIN_EMAILS.
+	if user.Admin {
+		return true
+	}
+	for _, email := range ADMIN_EMAILS {
+		if email == user.Email {
+			return true
+		}
+	}
+	return false
+}
+
+func auditSnapshot(v interface{}) []byte {
+	//Return the JSON state of an entity as recorded in the audit log;
+	//take it before mutating, slices may be changed in place.
+	if v == nil {
+		return nil
+	}
+	js, _ := json.Marshal(v)
+	return js
+}
+
+func auditDiff(before []byte, after []byte) []byte {
+	//Return {"field": {"before": x, "after": y}} for every top-level field that changed.
+	var b, a map[string]interface{}
+	json.Unmarshal(before, &b)
+	json.Unmarshal(after, &a)
+	diff := make(map[string]map[string]interface{})
+	for k, v := range a {
+		if !reflect.DeepEqual(b[k], v) {
+			diff[k] = map[string]interface{}{"before": b[k], "after": v}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			diff[k] = map[string]interface{}{"before": v, "after": nil}
+		}
+	}
+	js, _ := json.Marshal(diff)
+	return js
+}
+
+func recordAudit(appCtx context.Context, actor string, action string, key *datastore.Key, confKey *datastore.Key, before []byte, after []byte) {
+	//Append an AuditEvent for a committed mutation of key by actor;
+	//confKey, when set, is the conference the mutation concerns.
+	ev := &AuditEvent{
+		Actor: actor,
+		Action: action,
+		EntityKind: key.Kind(),
+		EntityKey: key.Encode(),
+		Before: before,
+		After: after,
+		Diff: auditDiff(before, after),
+		Timestamp: time.Now(),
+	}
+	if confKey != nil {
+		ev.ConferenceKey = confKey.Encode()
+	}
+	_, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "AuditEvent", nil), ev)
+	if err != nil {
+		applog.Errorf(appCtx, "audit %s %s by %s: %v", action, key, actor, err)
+	}
+}
+
+func copyAuditEventToForm(ev *AuditEvent, keyStr string) *AuditEventForm {
+	//Copy relevant fields from AuditEvent to AuditEventForm.
+	return &AuditEventForm{
+		Actor: ev.Actor,
+		Action: ev.Action,
+		EntityKind: ev.EntityKind,
+		EntityKey: ev.EntityKey,
+		WebsafeConferenceKey: ev.ConferenceKey,
+		Before: string(ev.Before),
+		After: string(ev.After),
+		Diff: string(ev.Diff),
+		Timestamp: ev.Timestamp.Format(time.RFC3339Nano),
+		WebsafeKey: keyStr,
+	}
+}
+
+func (h *ConferenceApi) GetAuditEvents(r *http.Request, aqf *AuditQueryForm) (*AuditEventForms, error) {
+	//Return audit events, newest first. Admins may query everything;
+	//organizers must filter on a conference they organize.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(user) {
+		if aqf.WebsafeConferenceKey == "" {
+			return nil, endpoints.NewForbiddenError("websafeConferenceKey is required")
+		}
+		if _, _, _, err := getOrganizedConference(r, aqf.WebsafeConferenceKey); err != nil {
+			return nil, err
+		}
+	}
+
+	q := datastore.NewQuery("AuditEvent")
+	if aqf.WebsafeConferenceKey != "" {
+		q = q.Filter("ConferenceKey=", aqf.WebsafeConferenceKey)
+	}
+	if aqf.Actor != "" {
+		q = q.Filter("Actor=", aqf.Actor)
+	}
+	if aqf.Action != "" {
+		q = q.Filter("Action=", aqf.Action)
+	}
+	if aqf.EntityKey != "" {
+		q = q.Filter("EntityKey=", aqf.EntityKey)
+	}
+	if aqf.Since != "" {
+		since, err := time.Parse(time.RFC3339, aqf.Since)
+		if err != nil {
+			return nil, endpoints.NewBadRequestError("since must be an RFC3339 date")
+		}
+		q = q.Filter("Timestamp>=", since)
+	}
+	if aqf.Until != "" {
+		until, err := time.Parse(time.RFC3339, aqf.Until)
+		if err != nil {
+			return nil, endpoints.NewBadRequestError("until must be an RFC3339 date")
+		}
+		q = q.Filter("Timestamp<", until)
+	}
+	limit := aqf.Limit
+	if limit <= 0 {
+		limit = DEFAULT_AUDIT_LIMIT
+	}
+	if limit > MAX_AUDIT_LIMIT {
+		limit = MAX_AUDIT_LIMIT
+	}
+	q = q.Order("-Timestamp").Limit(limit)
+	if aqf.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(aqf.Cursor)
+		if err != nil {
+			return nil, endpoints.NewBadRequestError("invalid cursor")
+		}
+		q = q.Start(cursor)
+	}
+
+	appCtx := appengine.NewContext(r)
+	forms := &AuditEventForms{
+		Items: make([]AuditEventForm, 0, limit),
+	}
+	it := q.Run(appCtx)
+	for {
+		var ev AuditEvent
+		key, err := it.Next(&ev)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		forms.Items = append(forms.Items, *copyAuditEventToForm(&ev, key.Encode()))
+	}
+	if len(forms.Items) == limit {
+		if cursor, err := it.Cursor(); err == nil {
+			forms.NextCursor = cursor.String()
+		}
+	}
+	return forms, nil
+}
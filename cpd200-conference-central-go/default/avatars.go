@@ -0,0 +1,295 @@
+package main
+
+/*
+avatars.go -- profile pictures, uploaded through the API and served from
+    the blob store
+
+An upload is cropped to a square and scaled down twice, to AVATAR_SIZE and
+AVATAR_THUMBNAIL_SIZE. Both are encoded anew, which also drops whatever
+metadata the original carried, such as where a photo was taken.
+
+*/
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Largest avatar upload, in bytes once decoded from base64.
+const MAX_AVATAR_BYTES = 1 << 20
+
+//Largest width or height of an uploaded image, so decoding it fits in memory.
+const MAX_AVATAR_DIMENSION = 3000
+
+//Sides of the stored avatar and of its thumbnail, in pixels.
+const (
+	AVATAR_SIZE = 512
+	AVATAR_THUMBNAIL_SIZE = 128
+)
+
+//Quality of the JPEG avatars photos are stored as.
+const AVATAR_JPEG_QUALITY = 85
+
+//Content types accepted for avatars, by image.DecodeConfig format.
+var avatarFormats = map[string]string{
+	"png": "image/png",
+	"jpeg": "image/jpeg",
+	"gif": "image/gif",
+}
+
+//Blob name prefix of avatars, and the URL path they are served at.
+const AVATAR_BLOB_PREFIX = "avatars"
+
+func decodeAvatarData(v *ValidationError, data string) []byte {
+	//Return the bytes of an avatar upload, base64 encoded on its own or in
+	//a data: URI.
+	if strings.HasPrefix(data, "data:") {
+		comma := strings.Index(data, ",")
+		if comma < 0 || !strings.HasSuffix(data[:comma], ";base64") {
+			v.Add("data", "must be base64 encoded")
+			return nil
+		}
+		data = data[comma + 1:]
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > MAX_AVATAR_BYTES + 2 {
+		v.Add("data", "must be at most %d bytes", MAX_AVATAR_BYTES)
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		v.Add("data", "must be base64 encoded")
+		return nil
+	}
+	if len(b) == 0 {
+		v.Add("data", "is required")
+		return nil
+	}
+	if len(b) > MAX_AVATAR_BYTES {
+		v.Add("data", "must be at most %d bytes", MAX_AVATAR_BYTES)
+		return nil
+	}
+	return b
+}
+
+func validateAvatar(ar *AvatarRequest) (image.Image, string, error) {
+	//Check a setAvatar request; returns the decoded image and its content
+	//type.
+	v := &ValidationError{}
+	b := decodeAvatarData(v, ar.Data)
+	if b == nil {
+		return nil, "", v.Err()
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	contentType, ok := avatarFormats[format]
+	if err != nil || !ok {
+		v.Add("data", "must be a PNG, JPEG or GIF image")
+		return nil, "", v.Err()
+	}
+	if cfg.Width > MAX_AVATAR_DIMENSION || cfg.Height > MAX_AVATAR_DIMENSION {
+		v.Add("data", "must be at most %d x %d pixels", MAX_AVATAR_DIMENSION, MAX_AVATAR_DIMENSION)
+		return nil, "", v.Err()
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		v.Add("data", "is not a valid %s image", strings.ToUpper(format))
+		return nil, "", v.Err()
+	}
+	return img, contentType, nil
+}
+
+func scaleSquare(src image.Image, size int) *image.RGBA {
+	//Crop the middle square of src and scale it down to size x size, or
+	//less if src is smaller; each pixel is the average of those it covers.
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	if side < size {
+		size = side
+	}
+	x0 := b.Min.X + (b.Dx() - side) / 2
+	y0 := b.Min.Y + (b.Dy() - side) / 2
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0, sy1 := y0 + y * side / size, y0 + (y + 1) * side / size
+		for x := 0; x < size; x++ {
+			sx0, sx1 := x0 + x * side / size, x0 + (x + 1) * side / size
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r + uint64(pr), g + uint64(pg), bl + uint64(pb), a + uint64(pa)
+					n++
+				}
+			}
+			//RGBA() is premultiplied 16 bit, like image.RGBA at 8 bits
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i + 1] = uint8(g / n >> 8)
+			dst.Pix[i + 2] = uint8(bl / n >> 8)
+			dst.Pix[i + 3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+func encodeAvatar(img image.Image, contentType string) ([]byte, string, error) {
+	//Encode an avatar uploaded as contentType: photos as JPEG, anything
+	//else as PNG to keep its transparency. Returns the data and its type.
+	var b bytes.Buffer
+	if contentType == "image/jpeg" {
+		err := jpeg.Encode(&b, img, &jpeg.Options{Quality: AVATAR_JPEG_QUALITY})
+		return b.Bytes(), contentType, err
+	}
+	err := png.Encode(&b, img)
+	return b.Bytes(), "image/png", err
+}
+
+func putAvatarBlob(appCtx context.Context, store BlobStore, img image.Image, contentType string) (string, error) {
+	//Store an encoded avatar under a new name.
+	data, contentType, err := encodeAvatar(img, contentType)
+	if err != nil {
+		return "", err
+	}
+	name, err := newBlobName(AVATAR_BLOB_PREFIX, contentType)
+	if err != nil {
+		return "", err
+	}
+	return name, store.Put(appCtx, name, contentType, data)
+}
+
+func deleteBlobs(appCtx context.Context, store BlobStore, names ...string) {
+	//Delete blobs nothing refers to any more; failures only leave garbage.
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := store.Delete(appCtx, name); err != nil {
+			applog.Warningf(appCtx, "delete blob %s: %v", name, err)
+		}
+	}
+}
+
+func avatarUrl(appCtx context.Context, name string) string {
+	//Return the URL an avatar blob is served at; "" if there is none.
+	if name == "" {
+		return ""
+	}
+	return "https://" + appengine.DefaultVersionHostname(appCtx) + "/" + name
+}
+
+func setProfileAvatar(appCtx context.Context, key *datastore.Key, avatar string, thumbnail string) (*Profile, error) {
+	//Point a Profile at new avatar blobs, deleting the ones it had.
+	var prof Profile
+	var before []byte
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, key, &prof); err != nil {
+			return err
+		}
+		before = auditSnapshot(&prof)
+		prof.AvatarBlob, avatar = avatar, prof.AvatarBlob
+		prof.AvatarThumbnailBlob, thumbnail = thumbnail, prof.AvatarThumbnailBlob
+		_, err := datastore.Put(appCtx, key, &prof)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	action := "profile.setAvatar"
+	if prof.AvatarBlob == "" {
+		action = "profile.deleteAvatar"
+	}
+	recordAudit(appCtx, key.StringID(), action, key, nil, before, auditSnapshot(&prof))
+	if store, err := getBlobStore(); err == nil {
+		deleteBlobs(appCtx, store, avatar, thumbnail)
+	}
+	return &prof, nil
+}
+
+func (h *ConferenceApi) SetAvatar(r *http.Request, ar *AvatarRequest) (*ProfileForm, error) {
+	//Replace the current user's avatar with an uploaded image.
+	_, key, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	img, contentType, err := validateAvatar(ar)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	store, err := getBlobStore()
+	if err != nil {
+		return nil, err
+	}
+	avatar := scaleSquare(img, AVATAR_SIZE)
+	avatarName, err := putAvatarBlob(appCtx, store, avatar, contentType)
+	if err != nil {
+		return nil, err
+	}
+	thumbnailName, err := putAvatarBlob(appCtx, store, scaleSquare(avatar, AVATAR_THUMBNAIL_SIZE), contentType)
+	if err != nil {
+		deleteBlobs(appCtx, store, avatarName)
+		return nil, err
+	}
+	prof, err := setProfileAvatar(appCtx, key, avatarName, thumbnailName)
+	if err != nil {
+		deleteBlobs(appCtx, store, avatarName, thumbnailName)
+		return nil, err
+	}
+	return copyProfileToForm(r, prof)
+}
+
+func (h *ConferenceApi) DeleteAvatar(r *http.Request) (*ProfileForm, error) {
+	//Remove the current user's avatar.
+	_, key, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	prof, err := setProfileAvatar(appengine.NewContext(r), key, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return copyProfileToForm(r, prof)
+}
+
+func AvatarHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve an avatar blob. Blob names are never reused, so it can be
+	//cached for good.
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(name, AVATAR_BLOB_PREFIX + "/") || !validBlobName(name) {
+		http.NotFound(w, r)
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	store, err := getBlobStore()
+	if err != nil {
+		applog.Errorf(appCtx, "avatar %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data, contentType, err := store.Get(appCtx, name)
+	if err == ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "avatar %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data)
+}
@@ -0,0 +1,341 @@
+package main
+
+/*
+badges.go -- printable name badges for the attendees of a conference,
+    as a PDF sheet for its organizer
+
+Each badge has the attendee's name, affiliation, QR ticket (see
+checkin.go) and tee-shirt size code, in a grid of Columns x Rows badges
+per page with cut lines around them. The layout travels in the signed
+download link.
+
+*/
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Badges per page across and down, by default and at most.
+const (
+	DEFAULT_BADGE_COLUMNS = 2
+	DEFAULT_BADGE_ROWS = 4
+	MAX_BADGE_COLUMNS = 4
+	MAX_BADGE_ROWS = 8
+)
+
+//Paper badge sheets print on, by name.
+var badgePageSizes = map[string][2]float64{
+	"A4": {PDF_A4_WIDTH, PDF_A4_HEIGHT},
+	"LETTER": {PDF_LETTER_WIDTH, PDF_LETTER_HEIGHT},
+}
+
+//Margin around the grid, and inside each badge, in points.
+const (
+	BADGE_PAGE_MARGIN = 28.0
+	BADGE_PADDING = 12.0
+)
+
+//Rough width of a Helvetica Bold glyph, per point of font size, for
+//fitting names to a badge.
+const BADGE_GLYPH_ADVANCE = 0.58
+
+//How long a signed badges link stays valid.
+const BADGES_EXPORT_TTL = 10 * time.Minute
+
+type badgeLayout struct {
+	//badgeLayout -- how badges are laid out, from BadgesRequest
+	pageSize string
+	columns int
+	rows int
+	qrCode bool
+	affiliation bool
+	teeShirtSize bool
+}
+
+type badge struct {
+	//badge -- what is printed on one attendee's badge
+	name string
+	affiliation string
+	token string
+	size string
+}
+
+//badgesByName sorts badges alphabetically, for handing them out.
+type badgesByName []badge
+
+func (b badgesByName) Len() int { return len(b) }
+func (b badgesByName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b badgesByName) Less(i, j int) bool { return strings.ToLower(b[i].name) < strings.ToLower(b[j].name) }
+
+func (l *badgeLayout) String() string {
+	//Return the layout as it is passed in badge links, e.g. "A4/2/4/qas".
+	parts := []string{l.pageSize, strconv.Itoa(l.columns), strconv.Itoa(l.rows), ""}
+	if l.qrCode {
+		parts[3] += "q"
+	}
+	if l.affiliation {
+		parts[3] += "a"
+	}
+	if l.teeShirtSize {
+		parts[3] += "s"
+	}
+	return strings.Join(parts, "/")
+}
+
+func parseBadgeLayout(s string) (*badgeLayout, bool) {
+	//Parse a layout from badgeLayout.String.
+	parts := strings.Split(s, "/")
+	if len(parts) != 4 {
+		return nil, false
+	}
+	columns, err1 := strconv.Atoi(parts[1])
+	rows, err2 := strconv.Atoi(parts[2])
+	l := &badgeLayout{
+		pageSize: parts[0],
+		columns: columns,
+		rows: rows,
+		qrCode: strings.Contains(parts[3], "q"),
+		affiliation: strings.Contains(parts[3], "a"),
+		teeShirtSize: strings.Contains(parts[3], "s"),
+	}
+	_, ok := badgePageSizes[l.pageSize]
+	return l, ok && err1 == nil && err2 == nil &&
+		columns >= 1 && columns <= MAX_BADGE_COLUMNS && rows >= 1 && rows <= MAX_BADGE_ROWS
+}
+
+func teeShirtSizeCode(size string) string {
+	//Return the short code of a stored tee-shirt size, e.g. "XL-W"; "" if
+	//not specified.
+	if size == "" || size == TeeShirtSizeToStringEnum(NOT_SPECIFIED) {
+		return ""
+	}
+	return strings.Replace(size, "_", "-", 1)
+}
+
+func fitBadgeText(s string, width float64, maxSize float64, minSize float64) (string, float64) {
+	//Return the font size s fits width at, between minSize and maxSize,
+	//cutting s if it doesn't fit even at minSize.
+	n := float64(utf8.RuneCountInString(s))
+	if n == 0 {
+		return s, maxSize
+	}
+	size := math.Min(maxSize, width / (n * BADGE_GLYPH_ADVANCE))
+	if size >= minSize {
+		return s, size
+	}
+	return truncateRunes(s, int(width / (minSize * BADGE_GLYPH_ADVANCE))), minSize
+}
+
+func drawQR(d *pdfDocument, q *qrCode, x float64, y float64, side float64) {
+	//Draw a QR code as a side x side square whose top left corner is at
+	//x, y; the quiet zone around it is left to the caller.
+	module := side / float64(q.size)
+	for row := 0; row < q.size; row++ {
+		for col := 0; col < q.size; {
+			if !q.modules[row][col] {
+				col++
+				continue
+			}
+			//one box per run of dark modules
+			start := col
+			for col < q.size && q.modules[row][col] {
+				col++
+			}
+			d.fillRect(x + float64(start) * module, y + float64(row) * module, float64(col - start) * module, module)
+		}
+	}
+}
+
+func renderBadgesPDF(conf *Conference, badges []badge, l *badgeLayout) []byte {
+	//Lay badges out in a grid, as many pages as needed.
+	page := badgePageSizes[l.pageSize]
+	d := newPDFDocument(page[0], page[1])
+	w := (page[0] - 2 * BADGE_PAGE_MARGIN) / float64(l.columns)
+	h := (page[1] - 2 * BADGE_PAGE_MARGIN) / float64(l.rows)
+	inner := w - 2 * BADGE_PADDING
+	for i, b := range badges {
+		cell := i % (l.columns * l.rows)
+		if i > 0 && cell == 0 {
+			d.addPage()
+		}
+		x := BADGE_PAGE_MARGIN + float64(cell % l.columns) * w
+		y := BADGE_PAGE_MARGIN + float64(cell / l.columns) * h
+		d.rect(x, y, w, h, 0.25)
+
+		//QR ticket at the bottom right, text in the room left of it
+		bottom := y + h - BADGE_PADDING
+		text := inner
+		if l.qrCode && b.token != "" {
+			if q, err := encodeQR(b.token); err == nil {
+				side := math.Min(h * 0.6, inner * 0.4)
+				drawQR(d, q, x + w - BADGE_PADDING - side, bottom - side, side)
+				text = inner - side - BADGE_PADDING
+			}
+		}
+		title, size := fitBadgeText(conf.Name, inner, 9, 6)
+		d.text(x + BADGE_PADDING, y + BADGE_PADDING + size, size, PDF_FONT_REGULAR, title)
+		name, nameSize := fitBadgeText(b.name, text, 26, 10)
+		nameY := y + h * 0.45
+		d.text(x + BADGE_PADDING, nameY, nameSize, PDF_FONT_BOLD, name)
+		if l.affiliation && b.affiliation != "" {
+			affiliation, size := fitBadgeText(b.affiliation, text, 14, 7)
+			d.text(x + BADGE_PADDING, nameY + size + 4, size, PDF_FONT_REGULAR, affiliation)
+		}
+
+		//size code boxed at the bottom left
+		if l.teeShirtSize && b.size != "" {
+			size := math.Min(16, h * 0.12)
+			boxW := float64(utf8.RuneCountInString(b.size)) * size * BADGE_GLYPH_ADVANCE + 8
+			boxH := size + 6
+			d.rect(x + BADGE_PADDING, bottom - boxH, boxW, boxH, 1)
+			d.text(x + BADGE_PADDING + 4, bottom - 5, size, PDF_FONT_BOLD, b.size)
+		}
+	}
+	return d.bytes()
+}
+
+func (h *ConferenceApi) GetBadgesPdfUrl(r *http.Request, br *BadgesRequest) (*StringMessage, error) {
+	//Return a short-lived signed link to a PDF of badges for all attendees
+	//of a conference; organizer only.
+	_, key, user, err := getOrganizedConference(r, br.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	l := &badgeLayout{
+		pageSize: strings.ToUpper(br.PageSize),
+		columns: br.Columns,
+		rows: br.Rows,
+		qrCode: !br.HideQrCode,
+		affiliation: !br.HideAffiliation,
+		teeShirtSize: !br.HideTeeShirtSize,
+	}
+	if l.pageSize == "" {
+		l.pageSize = "A4"
+	}
+	if l.columns == 0 {
+		l.columns = DEFAULT_BADGE_COLUMNS
+	}
+	if l.rows == 0 {
+		l.rows = DEFAULT_BADGE_ROWS
+	}
+	if err := validateBadgeLayout(l); err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	userId := getUserId(user, "")
+	conf := key.Encode()
+	layout := l.String()
+	expires := strconv.FormatInt(time.Now().Add(BADGES_EXPORT_TTL).Unix(), 10)
+	v := url.Values{
+		"conference": {conf},
+		"user": {userId},
+		"layout": {layout},
+		"expires": {expires},
+		"sig": {signToken("badges.pdf", conf, userId, layout, expires)},
+	}
+	return &StringMessage{
+		Data: "https://" + appengine.DefaultVersionHostname(appCtx) + "/export/badges.pdf?" + v.Encode(),
+	}, nil
+}
+
+func BadgesPdfHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve a signed link from getBadgesPdfUrl.
+	conf := r.FormValue("conference")
+	userId := r.FormValue("user")
+	layout := r.FormValue("layout")
+	expires := r.FormValue("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!verifyToken(r.FormValue("sig"), "badges.pdf", conf, userId, layout, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired link"))
+		return
+	}
+	l, ok := parseBadgeLayout(layout)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	key, err := datastore.DecodeKey(conf)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var c Conference
+	if err := datastore.Get(appCtx, key, &c); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if c.OrganizerUserId != userId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	//profiles are fetched a page of registrations at a time
+	var badges []badge
+	it := attendeesQuery(key).Run(appCtx)
+	for done := false; !done; {
+		regs := make([]Registration, 0, MAX_ATTENDEES_LIMIT)
+		regKeys := make([]*datastore.Key, 0, MAX_ATTENDEES_LIMIT)
+		for len(regKeys) < MAX_ATTENDEES_LIMIT {
+			var reg Registration
+			regKey, err := it.Next(&reg)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				applog.Errorf(appCtx, "badges %s: %v", conf, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			regs = append(regs, reg)
+			regKeys = append(regKeys, regKey)
+		}
+		profiles, profKeys, err := getRegisteredProfiles(appCtx, regKeys)
+		if err != nil {
+			applog.Errorf(appCtx, "badges %s: %v", conf, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for v := range profiles {
+			b := badge{
+				name: profiles[v].DisplayName,
+				affiliation: profiles[v].Affiliation,
+				size: teeShirtSizeCode(profiles[v].TeeShirtSize),
+			}
+			if b.name == "" {
+				b.name = profKeys[v].StringID()
+			}
+			reg := &regs[v]
+			if reg.TicketId == "" {
+				//registered before tickets existed
+				if reg, err = issueTicket(appCtx, regKeys[v]); err != nil {
+					applog.Warningf(appCtx, "badge ticket %v: %v", regKeys[v], err)
+				}
+			}
+			if reg != nil {
+				b.token = ticketToken(reg)
+			}
+			badges = append(badges, b)
+		}
+	}
+	sort.Sort(badgesByName(badges))
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="badges.pdf"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(renderBadgesPDF(&c, badges, l))
+	recordAudit(appCtx, userId, "conference.exportBadges", key, key, nil, nil)
+}
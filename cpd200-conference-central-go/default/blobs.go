@@ -0,0 +1,89 @@
+package main
+
+/*
+blobs.go -- storage for uploaded files, behind a BlobStore so the storage
+    service can be swapped
+
+Blobs are written once under a new random name and never changed, so
+whatever serves them can be cached forever; replacing a file means writing
+a new blob and deleting the old one.
+
+*/
+
+import (
+	"errors"
+	"mime"
+	"path"
+	"strings"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+//Returned by BlobStore.Get for a blob that doesn't exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+//Longest blob name accepted.
+const MAX_BLOB_NAME_LENGTH = 200
+
+type BlobStore interface {
+	//BlobStore -- a blob storage service; deleting a missing blob isn't
+	//an error.
+	Put(appCtx context.Context, name string, contentType string, data []byte) error
+	Get(appCtx context.Context, name string) ([]byte, string, error)
+	Delete(appCtx context.Context, name string) error
+}
+
+//Blob stores by name; BLOB_STORE picks the one the app uses, and
+//DEV_BLOB_STORE the one on the development server.
+var blobStores = map[string]BlobStore{}
+
+func getBlobStore() (BlobStore, error) {
+	//Return the blob store of BLOB_STORE, or DEV_BLOB_STORE on the
+	//development server.
+	name := BLOB_STORE
+	if appengine.IsDevAppServer() {
+		name = DEV_BLOB_STORE
+	}
+	store, ok := blobStores[name]
+	if !ok {
+		return nil, endpoints.NewInternalServerError("unknown blob store %q", name)
+	}
+	return store, nil
+}
+
+func newBlobName(prefix string, contentType string) (string, error) {
+	//Return a new unguessable blob name, e.g. "avatars/<random>.png".
+	id, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	ext := ""
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		ext = exts[0]
+	}
+	//mime lists ".jpe" and ".jfif" before ".jpg" on some systems
+	if contentType == "image/jpeg" {
+		ext = ".jpg"
+	}
+	return prefix + "/" + id + ext, nil
+}
+
+func validBlobName(name string) bool {
+	//Return true if name is safe to use as a path: slash separated parts of
+	//letters, digits and "-_.", none of them empty or dots only.
+	if name == "" || len(name) > MAX_BLOB_NAME_LENGTH || path.Clean(name) != name {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.Trim(part, ".") == "" {
+			return false
+		}
+		for _, c := range part {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,284 @@
+package main
+
+/*
+broadcast.go -- organizer messages to every attendee of a conference,
+    fanned out through the task queue
+
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//At most this many broadcasts per conference in any 24 hours.
+const MAX_ATTENDEE_MESSAGES_PER_DAY = 3
+
+//Attendees are fanned out this many per task.
+const ATTENDEE_FANOUT_BATCH = 100
+
+func copyAttendeeMessageToForm(msg *AttendeeMessage, keyStr string) *AttendeeMessageForm {
+	//Copy relevant fields from AttendeeMessage to AttendeeMessageForm.
+	amf := &AttendeeMessageForm{
+		Subject: msg.Subject,
+		Body: msg.Body,
+		Recipients: msg.Recipients,
+		WebsafeKey: keyStr,
+	}
+	if !msg.SentAt.IsZero() {
+		amf.SentAt = msg.SentAt.Format(time.RFC3339)
+	}
+	return amf
+}
+
+func (h *ConferenceApi) SendAttendeeMessage(r *http.Request, req *AttendeeMessageRequest) (*AttendeeMessageForm, error) {
+	//Email every attendee of a conference; organizer only.
+	//With preview set nothing is sent or stored, the message is only rendered.
+	conf, confKey, user, err := getOrganizedConference(r, req.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	req.Subject = strings.TrimSpace(req.Subject)
+	if req.Subject == "" || strings.TrimSpace(req.Body) == "" {
+		return nil, endpoints.NewBadRequestError("subject and body are required")
+	}
+
+	appCtx := appengine.NewContext(r)
+	recipients, err := attendeesQuery(confKey).KeysOnly().Count(appCtx)
+	if err != nil {
+		return nil, err
+	}
+	msg := &AttendeeMessage{
+		Subject: "[" + conf.Name + "] " + req.Subject,
+		Body: req.Body,
+		OrganizerUserId: conf.OrganizerUserId,
+		OrganizerEmail: user.Email,
+		Recipients: recipients,
+	}
+	if req.Preview {
+		amf := copyAttendeeMessageToForm(msg, "")
+		amf.Preview = true
+		return amf, nil
+	}
+
+	//rate limit, store the broadcast and start the fan-out in one transaction
+	//on the conference group, so concurrent sends can't exceed the limit
+	var msgKey *datastore.Key
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		since := time.Now().Add(-24 * time.Hour)
+		sent, err := datastore.NewQuery("AttendeeMessage").Ancestor(confKey).
+			Filter("SentAt>", since).KeysOnly().Count(appCtx)
+		if err != nil {
+			return err
+		}
+		if sent >= MAX_ATTENDEE_MESSAGES_PER_DAY {
+			return endpoints.NewForbiddenError("At most %d messages per conference can be sent in 24 hours",
+				MAX_ATTENDEE_MESSAGES_PER_DAY)
+		}
+		msg.SentAt = time.Now()
+		msgKey, err = datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "AttendeeMessage", confKey), msg)
+		if err != nil {
+			return err
+		}
+		task := taskqueue.NewPOSTTask("/tasks/fanout_attendee_message", url.Values{
+			"messageKey": {msgKey.Encode()},
+		})
+		_, err = taskqueue.Add(appCtx, task, "")
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "attendeeMessage.create", msgKey, confKey, nil, auditSnapshot(msg))
+	return copyAttendeeMessageToForm(msg, msgKey.Encode()), nil
+}
+
+func (h *ConferenceApi) GetAttendeeMessages(r *http.Request, cr *ConfRequest) (*AttendeeMessageForms, error) {
+	//Return the broadcasts sent for a conference, newest first; organizer only.
+	_, confKey, _, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var msgs []AttendeeMessage
+	keys, err := datastore.NewQuery("AttendeeMessage").Ancestor(confKey).Order("-SentAt").GetAll(appCtx, &msgs)
+	if err != nil {
+		return nil, err
+	}
+	forms := &AttendeeMessageForms{
+		Items: make([]AttendeeMessageForm, 0, len(msgs)),
+	}
+	for v := range msgs {
+		forms.Items = append(forms.Items, *copyAttendeeMessageToForm(&msgs[v], keys[v].Encode()))
+	}
+	return forms, nil
+}
+
+func FanoutAttendeeMessageHandler(w http.ResponseWriter, r *http.Request) {
+	//Queue one email task per attendee, ATTENDEE_FANOUT_BATCH at a time,
+	//re-queueing itself with a cursor until all attendees are covered.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	msgKey, err := datastore.DecodeKey(r.PostFormValue("messageKey"))
+	if err != nil {
+		applog.Errorf(appCtx, "fanout: bad message key: %v", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	confKey := msgKey.Parent()
+
+	q := attendeesQuery(confKey).KeysOnly()
+	if c := r.PostFormValue("cursor"); c != "" {
+		cursor, err := datastore.DecodeCursor(c)
+		if err != nil {
+			applog.Errorf(appCtx, "fanout: bad cursor: %v", err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q = q.Start(cursor)
+	}
+	regKeys := make([]*datastore.Key, 0, ATTENDEE_FANOUT_BATCH)
+	it := q.Limit(ATTENDEE_FANOUT_BATCH).Run(appCtx)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			applog.Errorf(appCtx, "fanout: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		regKeys = append(regKeys, key)
+	}
+	profiles, profKeys, err := getRegisteredProfiles(appCtx, regKeys)
+	if err != nil {
+		applog.Errorf(appCtx, "fanout: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tasks := make([]*taskqueue.Task, 0, ATTENDEE_FANOUT_BATCH + 1)
+	for v := range profiles {
+		//named per message and attendee, so a retried fan-out doesn't mail twice
+		task := taskqueue.NewPOSTTask("/tasks/send_attendee_message", url.Values{
+			"messageKey": {msgKey.Encode()},
+			"userId": {profKeys[v].StringID()},
+			"email": {profiles[v].MainEmail},
+		})
+		task.Name = attendeeMessageTaskName(msgKey, profKeys[v].StringID())
+		tasks = append(tasks, task)
+	}
+	if len(regKeys) == ATTENDEE_FANOUT_BATCH {
+		cursor, err := it.Cursor()
+		if err != nil {
+			applog.Errorf(appCtx, "fanout: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		//named too, so a retried batch doesn't start a second chain
+		task := taskqueue.NewPOSTTask("/tasks/fanout_attendee_message", url.Values{
+			"messageKey": {msgKey.Encode()},
+			"cursor": {cursor.String()},
+		})
+		task.Name = attendeeFanoutTaskName(msgKey, cursor.String())
+		tasks = append(tasks, task)
+	}
+	if len(tasks) > 0 {
+		if err := addTasksOnce(appCtx, tasks); err != nil {
+			applog.Errorf(appCtx, "fanout: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func attendeeMessageTaskName(msgKey *datastore.Key, userId string) string {
+	//Return the task name of sending a broadcast to one attendee; user ids
+	//are hashed since task names only take letters, digits, "-" and "_".
+	sum := sha256.Sum256([]byte(userId))
+	return "attendee-message-" + msgKey.Encode() + "-" + hex.EncodeToString(sum[:16])
+}
+
+func attendeeFanoutTaskName(msgKey *datastore.Key, cursor string) string {
+	//Return the task name of fanning a broadcast out from cursor on;
+	//cursors are hashed like user ids in attendeeMessageTaskName.
+	sum := sha256.Sum256([]byte(cursor))
+	return "attendee-fanout-" + msgKey.Encode() + "-" + hex.EncodeToString(sum[:16])
+}
+
+func addTasksOnce(appCtx context.Context, tasks []*taskqueue.Task) error {
+	//Add tasks, taking named tasks that were already added as success.
+	_, err := taskqueue.AddMulti(appCtx, tasks, "")
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e != nil && e != taskqueue.ErrTaskAlreadyAdded {
+				return err
+			}
+		}
+		return nil
+	}
+	return err
+}
+
+func SendAttendeeMessageHandler(w http.ResponseWriter, r *http.Request) {
+	//Send one organizer broadcast to one attendee.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	msgKey, err := datastore.DecodeKey(r.PostFormValue("messageKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var am AttendeeMessage
+	if err := datastore.Get(appCtx, msgKey, &am); err != nil {
+		applog.Errorf(appCtx, "send attendee message: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	userId := r.PostFormValue("userId")
+	if r.Header.Get("X-AppEngine-TaskRetryCount") == "0" {
+		addNotification(appCtx, userId, &Notification{
+			Type: NOTIFICATION_ORGANIZER_MESSAGE,
+			Title: am.Subject,
+			Body: am.Body,
+			WebsafeConferenceKey: msgKey.Parent().Encode(),
+		})
+	}
+	err = sendAttendeeEmail(appCtx, &am, userId, r.PostFormValue("email"))
+	if err != nil {
+		applog.Errorf(appCtx, "send attendee message: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendAttendeeEmail(appCtx context.Context, am *AttendeeMessage, userId string, email string) error {
+	//Email a broadcast to one attendee, replying to the organizer.
+	if email == "" {
+		email = userId
+	}
+	msg := &mail.Message{
+		ReplyTo: am.OrganizerEmail,
+		To: []string{email},
+		Subject: am.Subject,
+		Body: am.Body,
+	}
+	return sendEmail(appCtx, userId, EMAIL_ANNOUNCEMENTS, msg)
+}
@@ -0,0 +1,300 @@
+package main
+
+/*
+calendar.go -- iCalendar (RFC 5545) export of conferences and a
+    secret per-profile feed of the conferences a user will attend
+
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Calendar clients are asked to refresh subscribed feeds this often.
+const CALENDAR_REFRESH_INTERVAL = "PT1H"
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+func icalLine(b *bytes.Buffer, line string) {
+	//Write one content line, folded at 75 octets without splitting UTF-8
+	//sequences; continuation lines start with a space, so they carry 74.
+	limit := 75
+	for len(line) > limit {
+		n := limit
+		for n > 0 && line[n] >= 0x80 && line[n] < 0xC0 {
+			n--
+		}
+		b.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func isAllDay(conf *Conference) bool {
+	//Return true if the conference dates are whole days in its time zone.
+	loc := conferenceLocation(conf)
+	midnight := func(t time.Time) bool {
+		t = t.In(loc)
+		return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0
+	}
+	return midnight(conf.StartDate) && (conf.EndDate.IsZero() || midnight(conf.EndDate))
+}
+
+func writeConferenceEvent(appCtx context.Context, b *bytes.Buffer, conf *Conference, key *datastore.Key, stamp time.Time) {
+	//Write conf as a VEVENT; conferences without a start date are skipped.
+	//A cancelled conference is marked so, with a new SEQUENCE so calendars
+	//take the change over the copy they have.
+	if conf.StartDate.IsZero() {
+		return
+	}
+	host := appengine.DefaultVersionHostname(appCtx)
+	icalLine(b, "BEGIN:VEVENT")
+	icalLine(b, "UID:" + key.Encode() + "@" + host)
+	icalLine(b, "DTSTAMP:" + stamp.UTC().Format("20060102T150405Z"))
+	if !conf.CancelledAt.IsZero() {
+		icalLine(b, "STATUS:CANCELLED")
+		icalLine(b, "SEQUENCE:1")
+	}
+	if isAllDay(conf) {
+		//DTEND of an all-day event is the day after the last one
+		loc := conferenceLocation(conf)
+		end := conf.EndDate
+		if end.IsZero() {
+			end = conf.StartDate
+		}
+		icalLine(b, "DTSTART;VALUE=DATE:" + conf.StartDate.In(loc).Format("20060102"))
+		icalLine(b, "DTEND;VALUE=DATE:" + end.In(loc).AddDate(0, 0, 1).Format("20060102"))
+	} else {
+		icalLine(b, "DTSTART:" + conf.StartDate.UTC().Format("20060102T150405Z"))
+		if !conf.EndDate.IsZero() {
+			icalLine(b, "DTEND:" + conf.EndDate.UTC().Format("20060102T150405Z"))
+		}
+	}
+	icalLine(b, "SUMMARY:" + icalEscaper.Replace(conf.Name))
+	if conf.Description != "" {
+		icalLine(b, "DESCRIPTION:" + icalEscaper.Replace(conf.Description))
+	}
+	if conf.City != "" {
+		icalLine(b, "LOCATION:" + icalEscaper.Replace(conf.City))
+	}
+	if len(conf.Topics) > 0 {
+		topics := make([]string, len(conf.Topics))
+		for v := range conf.Topics {
+			topics[v] = icalEscaper.Replace(conf.Topics[v])
+		}
+		icalLine(b, "CATEGORIES:" + strings.Join(topics, ","))
+	}
+	icalLine(b, "URL:https://" + host + "/#/conference/detail/" + key.Encode())
+	icalLine(b, "END:VEVENT")
+}
+
+func writeCalendar(appCtx context.Context, w http.ResponseWriter, name string, conferences []Conference, keys []*datastore.Key, filename string) {
+	//Send conferences as a text/calendar VCALENDAR named name.
+	var b bytes.Buffer
+	icalLine(&b, "BEGIN:VCALENDAR")
+	icalLine(&b, "VERSION:2.0")
+	icalLine(&b, "PRODID:-//Conference Central//" + appengine.AppID(appCtx) + "//EN")
+	icalLine(&b, "CALSCALE:GREGORIAN")
+	icalLine(&b, "METHOD:PUBLISH")
+	icalLine(&b, "X-WR-CALNAME:" + icalEscaper.Replace(name))
+	icalLine(&b, "REFRESH-INTERVAL;VALUE=DURATION:" + CALENDAR_REFRESH_INTERVAL)
+	icalLine(&b, "X-PUBLISHED-TTL:" + CALENDAR_REFRESH_INTERVAL)
+	now := time.Now()
+	for v := range conferences {
+		writeConferenceEvent(appCtx, &b, &conferences[v], keys[v], now)
+	}
+	icalLine(&b, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="` + filename + `"`)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(b.Bytes())
+}
+
+func getCancelledConferencesAttended(appCtx context.Context, userId string) ([]Conference, []*datastore.Key, error) {
+	//Return the cancelled conferences userId was still registered for when
+	//they were cancelled, with their keys; their registrations were
+	//cancelled with them, see CancelConferenceHandler.
+	var regs []Registration
+	_, err := datastore.NewQuery("Registration").
+		Filter("UserId=", userId).
+		Filter("Status=", REGISTRATION_CANCELLED).
+		GetAll(appCtx, &regs)
+	if err != nil {
+		return nil, nil, err
+	}
+	confKeys := make([]*datastore.Key, len(regs))
+	for v := range regs {
+		if confKeys[v], err = datastore.DecodeKey(regs[v].ConferenceKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	all := make([]Conference, len(confKeys))
+	if err := datastore.GetMulti(appCtx, confKeys, all); err != nil {
+		return nil, nil, err
+	}
+	var conferences []Conference
+	var keys []*datastore.Key
+	for v := range all {
+		if !all[v].CancelledAt.IsZero() && !regs[v].CancelledAt.Before(all[v].CancelledAt) {
+			conferences = append(conferences, all[v])
+			keys = append(keys, confKeys[v])
+		}
+	}
+	return conferences, keys, nil
+}
+
+func calendarFeedURL(appCtx context.Context, token string) string {
+	//Return the subscription URL of a Profile's calendar feed.
+	return "https://" + appengine.DefaultVersionHostname(appCtx) + "/calendar/feed/" + token + ".ics"
+}
+
+func copyCalendarFeedToForm(appCtx context.Context, token string) *CalendarFeedForm {
+	//Return the outbound form for a calendar feed token.
+	feedURL := calendarFeedURL(appCtx, token)
+	return &CalendarFeedForm{
+		Url: feedURL,
+		WebcalUrl: "webcal://" + strings.TrimPrefix(feedURL, "https://"),
+	}
+}
+
+func setCalendarToken(appCtx context.Context, key *datastore.Key, reset bool) (string, error) {
+	//Return the Profile's calendar feed token, creating one if there is none
+	//or replacing the current one if reset is set.
+	var token string
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		var prof Profile
+		if err := datastore.Get(appCtx, key, &prof); err != nil {
+			return err
+		}
+		if prof.CalendarToken != "" && !reset {
+			token = prof.CalendarToken
+			return nil
+		}
+		var err error
+		if token, err = newSecret(); err != nil {
+			return err
+		}
+		prof.CalendarToken = token
+		_, err = datastore.Put(appCtx, key, &prof)
+		return err
+	}, nil)
+	return token, err
+}
+
+func (h *ConferenceApi) GetCalendarFeed(r *http.Request) (*CalendarFeedForm, error) {
+	//Return the secret URL calendar clients can subscribe to for the
+	//conferences the user will attend.
+	_, key, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	token, err := setCalendarToken(appCtx, key, false)
+	if err != nil {
+		return nil, err
+	}
+	return copyCalendarFeedToForm(appCtx, token), nil
+}
+
+func (h *ConferenceApi) ResetCalendarFeed(r *http.Request) (*CalendarFeedForm, error) {
+	//Replace the user's calendar feed URL; the previous one stops working.
+	_, key, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	token, err := setCalendarToken(appCtx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, key.StringID(), "profile.resetCalendarFeed", key, nil, nil, nil)
+	return copyCalendarFeedToForm(appCtx, token), nil
+}
+
+func ConferenceCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve /calendar/conference/{websafeConferenceKey}.ics; no login required,
+	//conferences are public.
+	websafeKey := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/conference/"), ".ics")
+	key, err := datastore.DecodeKey(websafeKey)
+	if err != nil || key.Kind() != "Conference" {
+		http.NotFound(w, r)
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	var conf Conference
+	err = datastore.Get(appCtx, key, &conf)
+	if err == datastore.ErrNoSuchEntity || (err == nil && conf.StartDate.IsZero()) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "conference calendar %s: %v", websafeKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(appCtx, w, conf.Name, []Conference{conf}, []*datastore.Key{key}, "conference.ics")
+}
+
+func CalendarFeedHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve /calendar/feed/{token}.ics, the conferences the Profile holding
+	//token will attend, and those it would have attended but were
+	//cancelled. The token stands in for OAuth, which calendar clients
+	//can't do.
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/calendar/feed/"), ".ics")
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	keys, err := datastore.NewQuery("Profile").Filter("CalendarToken=", token).KeysOnly().Limit(1).GetAll(appCtx, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "calendar feed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	var prof Profile
+	if err := datastore.Get(appCtx, keys[0], &prof); err != nil {
+		applog.Errorf(appCtx, "calendar feed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	//the query is eventually consistent; don't serve a token just reset
+	if prof.CalendarToken != token {
+		http.NotFound(w, r)
+		return
+	}
+	if len(prof.ConferenceKeysToAttend) > 0 {
+		err = migrateProfileRegistrations(appCtx, keys[0])
+	}
+	var conferences []Conference
+	var confKeys []*datastore.Key
+	if err == nil {
+		conferences, confKeys, err = getConferencesAttended(appCtx, keys[0].StringID())
+	}
+	if err == nil {
+		var cancelled []Conference
+		var cancelledKeys []*datastore.Key
+		cancelled, cancelledKeys, err = getCancelledConferencesAttended(appCtx, keys[0].StringID())
+		conferences = append(conferences, cancelled...)
+		confKeys = append(confKeys, cancelledKeys...)
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "calendar feed %s: %v", keys[0].StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(appCtx, w, "Conference Central", conferences, confKeys, "conferences.ics")
+}
@@ -0,0 +1,269 @@
+package main
+
+/*
+checkin.go -- signed ticket tokens, shown to attendees as QR codes, and
+    checking attendees in at the door
+
+A token is TICKET_TOKEN_PREFIX, the registration's random TicketId and a
+signature of it, joined by dots. The TicketId is set when a registration
+becomes REGISTERED and cleared when its seats are taken again, so tokens
+of cancelled registrations stop working. One token admits all the seats
+of its registration, once. The organizer and the staff they name can
+check attendees in.
+
+*/
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	appuser "google.golang.org/appengine/user"
+)
+
+//First part of ticket tokens, versioning their format.
+const TICKET_TOKEN_PREFIX = "CCT1"
+
+//Check-in staff per conference.
+const MAX_CHECK_IN_STAFF = 50
+
+//Pixels per QR code module in ticket images.
+const TICKET_QR_SCALE = 6
+
+func newTicketId() (string, error) {
+	//Return a new unguessable TicketId.
+	return newSecret()
+}
+
+func ticketToken(reg *Registration) string {
+	//Return the ticket token of a registration with a TicketId.
+	return TICKET_TOKEN_PREFIX + "." + reg.TicketId + "." + signToken("ticket", reg.TicketId)
+}
+
+func parseTicketToken(token string) (string, bool) {
+	//Return the TicketId of a well-signed ticket token.
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != TICKET_TOKEN_PREFIX || parts[1] == "" ||
+		!verifyToken(parts[2], "ticket", parts[1]) {
+		return "", false
+	}
+	return parts[1], true
+}
+
+func ticketQrCode(token string) (string, error) {
+	//Return a PNG data URI of the QR code of a ticket token.
+	q, err := encodeQR(token)
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(q.png(TICKET_QR_SCALE)), nil
+}
+
+func issueTicket(appCtx context.Context, regKey *datastore.Key) (*Registration, error) {
+	//Return a REGISTERED Registration, giving it a TicketId if it was
+	//registered before tickets existed.
+	var reg Registration
+	err := datastore.Get(appCtx, regKey, &reg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if reg.Status != REGISTRATION_REGISTERED || deletedRegistration(regKey, &reg) {
+		return nil, endpoints.NewNotFoundError("You are not registered for this conference")
+	}
+	if reg.TicketId != "" {
+		return &reg, nil
+	}
+	ticketId, err := newTicketId()
+	if err != nil {
+		return nil, err
+	}
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, regKey, &reg); err != nil {
+			return err
+		}
+		if reg.Status != REGISTRATION_REGISTERED || reg.TicketId != "" {
+			return nil
+		}
+		reg.TicketId = ticketId
+		_, err := datastore.Put(appCtx, regKey, &reg)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if reg.Status != REGISTRATION_REGISTERED {
+		return nil, endpoints.NewNotFoundError("You are not registered for this conference")
+	}
+	return &reg, nil
+}
+
+func isCheckInStaff(conf *Conference, user *appuser.User) bool {
+	//Return true if user may check attendees of conf in.
+	userId := getUserId(user, "")
+	if conf.OrganizerUserId == userId {
+		return true
+	}
+	for _, staff := range conf.CheckInStaff {
+		if strings.EqualFold(staff, userId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *ConferenceApi) GetTicket(r *http.Request, cr *ConfRequest) (*TicketForm, error) {
+	//Return the current user's ticket for a conference they registered for.
+	_, profKey, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	confKey, err := datastore.DecodeKey(cr.WebsafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	conf, err := ensureSeatShards(appCtx, confKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	reg, err := issueTicket(appCtx, registrationKey(appCtx, confKey, conf.SeatShards, profKey.StringID()))
+	if err != nil {
+		return nil, err
+	}
+	token := ticketToken(reg)
+	qrCode, err := ticketQrCode(token)
+	if err != nil {
+		return nil, err
+	}
+	return &TicketForm{
+		Token: token,
+		QrCode: qrCode,
+		Quantity: registrationSeats(reg),
+		CheckedInAt: formatConferenceTime(conf, reg.CheckedInAt),
+	}, nil
+}
+
+func (h *ConferenceApi) CheckIn(r *http.Request, cr *CheckInRequest) (*CheckInForm, error) {
+	//Let the holder of a ticket in; organizer and check-in staff only.
+	//A ticket can only be used once.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	confKey, err := datastore.DecodeKey(cr.WebsafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	var conf Conference
+	err = datastore.Get(appCtx, confKey, &conf)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isCheckInStaff(&conf, user) {
+		return nil, endpoints.NewForbiddenError("Only the organizer and check-in staff can do this")
+	}
+	ticketId, ok := parseTicketToken(cr.Token)
+	if !ok {
+		return nil, endpoints.NewBadRequestError("This is not a valid ticket")
+	}
+
+	//the query is eventually consistent, the transaction below isn't
+	regKeys, err := datastore.NewQuery("Registration").Filter("TicketId=", ticketId).KeysOnly().Limit(1).GetAll(appCtx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(regKeys) == 0 {
+		return nil, endpoints.NewNotFoundError("No registration has this ticket")
+	}
+	regKey := regKeys[0]
+	staffId := getUserId(user, "")
+	var reg Registration
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, regKey, &reg); err != nil {
+			return err
+		}
+		if reg.TicketId != ticketId || reg.Status != REGISTRATION_REGISTERED {
+			return endpoints.NewConflictError("This ticket was cancelled")
+		}
+		if reg.ConferenceKey != confKey.Encode() {
+			return endpoints.NewConflictError("This ticket is for another conference")
+		}
+		if !reg.CheckedInAt.IsZero() {
+			return endpoints.NewConflictError("This ticket was already used at %s", formatConferenceTime(&conf, reg.CheckedInAt))
+		}
+		before = auditSnapshot(&reg)
+		now := time.Now()
+		reg.CheckedInAt = now
+		reg.CheckedInBy = staffId
+		reg.UpdatedAt = now
+		after = auditSnapshot(&reg)
+		_, err := datastore.Put(appCtx, regKey, &reg)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, staffId, "registration.checkIn", regKey, confKey, before, after)
+
+	form := &CheckInForm{
+		MainEmail: reg.UserId,
+		Quantity: registrationSeats(&reg),
+		CheckedInAt: formatConferenceTime(&conf, reg.CheckedInAt),
+	}
+	var prof Profile
+	if err := datastore.Get(appCtx, datastore.NewKey(appCtx, "Profile", reg.UserId, 0, nil), &prof); err == nil {
+		form.DisplayName = prof.DisplayName
+		if prof.MainEmail != "" {
+			form.MainEmail = prof.MainEmail
+		}
+	}
+	if reg.TicketTypeKey != "" {
+		if tt, _, err := getConferenceTicketType(appCtx, confKey, reg.TicketTypeKey); err == nil {
+			form.TicketTypeName = tt.Name
+		}
+	}
+	return form, nil
+}
+
+func (h *ConferenceApi) SetCheckInStaff(r *http.Request, sr *CheckInStaffRequest) (*CheckInStaffForm, error) {
+	//Replace the users, by email, who may check attendees in besides the
+	//organizer; organizer only.
+	_, confKey, user, err := getOrganizedConference(r, sr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCheckInStaffRequest(sr); err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var conf Conference
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		before = auditSnapshot(&CheckInStaffForm{Emails: conf.CheckInStaff})
+		conf.CheckInStaff = sr.Emails
+		after = auditSnapshot(&CheckInStaffForm{Emails: conf.CheckInStaff})
+		_, err := datastore.Put(appCtx, confKey, &conf)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "conference.setCheckInStaff", confKey, confKey, before, after)
+	fireConferenceEvent(appCtx, EVENT_CONFERENCE_UPDATED, &conf, confKey)
+	return &CheckInStaffForm{Emails: conf.CheckInStaff}, nil
+}
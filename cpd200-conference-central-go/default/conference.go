@@ -9,64 +9,522 @@ conference.go -- server-side Go App Engine API;
 
 import (
 	"log"
+	applog "google.golang.org/appengine/log"
 	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
 	"net/http"
+	"google.golang.org/appengine"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"time"
+	"html"
+	"strconv"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
+	"net/url"
+	"encoding/json"
+	"fmt"
+	"strings"
+	appuser "google.golang.org/appengine/user"
 )
 
 type ConferenceApi struct {
 }
 
+var MEMCACHE_ANNOUNCEMENTS_KEY = "RECENT_ANNOUNCEMENTS"
+
+type Object struct {
+	Value interface{}
+}
+
+var DEFAULTS = map[string]Object{
+	"city": Object{Value:"Default City"},
+	"timeZone": Object{Value:"UTC"},
+	"maxAttendees": Object{Value:0},
+	"seatsAvailable": Object{Value:0},
+	"topics": Object{Value:[]string{"Default", "Topic"}},
+}
+
+var OPERATORS = map[string]string{
+	"EQ": "=",
+	"GT": ">",
+	"GTEQ": ">=",
+	"LT": "<",
+	"LTEQ": "<=",
+	"NE": "!=",
+}
+
+var FIELDS = map[string]string{
+	"CITY": "City",
+	"TOPIC": "Topics",
+	"MONTH": "Month",
+	"MAX_ATTENDEES": "MaxAttendees",
+}
+
+func conferenceLocation(conf *Conference) *time.Location {
+	//Return the time zone of a conference; UTC if unset or unknown.
+	loc, err := time.LoadLocation(conf.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func formatConferenceTime(conf *Conference, t time.Time) string {
+	//Format t as RFC3339 in the conference's time zone; "" for zero time.
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(conferenceLocation(conf)).Format(time.RFC3339)
+}
+
+func copyConferenceToForm(conf *Conference, keyStr string, displayName string) (*ConferenceForm, error) {
+	//Copy relevant fields from Conference to ConferenceForm.
+	cf := &ConferenceForm{
+		Name: conf.Name,
+		Description: conf.Description,
+		OrganizerUserId: conf.OrganizerUserId,
+		Topics: conf.Topics,
+		City: conf.City,
+		TimeZone: conferenceLocation(conf).String(),
+		StartDate: formatConferenceTime(conf, conf.StartDate),
+		Month: conf.Month,
+		MaxAttendees: conf.MaxAttendees,
+		SeatsAvailable: conf.SeatsAvailable,
+		EndDate: formatConferenceTime(conf, conf.EndDate),
+		WebsafeKey: html.EscapeString(keyStr),
+		CancellationPolicy: copyCancellationPolicyToForm(conf),
+		Cancelled: !conf.CancelledAt.IsZero(),
+	}
+	if displayName != "" {
+		cf.OrganizerDisplayName = displayName
+	}
+	return cf, nil
+}
+
+func createConferenceObject(r *http.Request, cf *ConferenceForm) (*ConferenceForm, error) {
+	//Create or update Conference object, returning ConferenceForm.
+	//preload necessary data items
+	c := endpoints.NewContext(r)
+	user, err := endpoints.CurrentUser(c, []string{endpoints.EmailScope},
+		[]string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID}, []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, endpoints.UnauthorizedError
+	}
+	userId := getUserId(user, "")
+	
+	startDate, endDate, err := validateConferenceForm(cf)
+	if err != nil {
+		return nil, err
+	}
+	
+	cf.WebsafeKey = ""
+	cf.OrganizerDisplayName = ""
+
+	//add default values for those missing
+	if cf.City == "" {
+		cf.City = DEFAULTS["city"].Value.(string)
+	}
+	if cf.TimeZone == "" {
+		cf.TimeZone = DEFAULTS["timeZone"].Value.(string)
+	}
+	if cf.MaxAttendees == 0 {
+		cf.MaxAttendees = DEFAULTS["maxAttendees"].Value.(int)
+	}
+	if cf.SeatsAvailable == 0 {
+		cf.SeatsAvailable = DEFAULTS["seatsAvailable"].Value.(int)
+	}
+	if cf.Topics == nil {
+		cf.Topics = DEFAULTS["topics"].Value.([]string)
+	}
+
+	//set month based on start_date, in the conference's own time zone
+	if !startDate.IsZero() {
+		cf.Month = int(startDate.Month())
+		cf.StartDate = startDate.Format(time.RFC3339)
+		if !endDate.IsZero() {
+			cf.EndDate = endDate.Format(time.RFC3339)
+		}
+	} else {
+		cf.Month = 0
+	}
+
+	//set seatsAvailable to be same as maxAttendees on creation
+	//both for data model & outbound Message
+	if cf.MaxAttendees > 0 {
+		cf.SeatsAvailable = cf.MaxAttendees
+	}
+
+	//make Profile Key from user ID
+	appCtx := appengine.NewContext(r)
+	parentKey := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	//allocate new Conference ID with Profile key as parent
+	_, high, err := datastore.AllocateIDs(appCtx, "Conference", parentKey, 1)
+	if err != nil {
+		return nil, err
+	}
+	//make Conference key from ID
+	confKey := datastore.NewKey(appCtx, "Conference", "", high, parentKey)
+	cf.OrganizerUserId = userId
+
+	//create Conference, send email to organizer confirming
+	//creation of Conference & return (modified) ConferenceForm
+	conf := &Conference{
+		Name: cf.Name,
+		Description: cf.Description,
+		OrganizerUserId: cf.OrganizerUserId,
+		Topics: cf.Topics,
+		City: cf.City,
+		TimeZone: cf.TimeZone,
+		StartDate: startDate,
+		Month: cf.Month,
+		EndDate: endDate,
+		MaxAttendees: cf.MaxAttendees,
+		SeatsAvailable: cf.SeatsAvailable,
+		CreatedAt: time.Now(),
+	}
+	_, err = datastore.Put(appCtx, confKey, conf)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, userId, "conference.create", confKey, confKey, nil, auditSnapshot(conf))
+	//shards are otherwise created by the first registration
+	if _, err := ensureSeatShards(appCtx, confKey); err != nil {
+		applog.Warningf(appCtx, "seat shards for %s: %v", confKey, err)
+	}
+	js, _ := json.Marshal(cf);
+	task := taskqueue.NewPOSTTask("/tasks/send_confirmation_email", url.Values{
+	    "email": {user.Email},
+	    "userId": {userId},
+	    "conferenceInfo": {string(js)},
+	})
+	taskqueue.Add(appCtx, task, "")
+	created, _ := copyConferenceToForm(conf, confKey.Encode(), "")
+	fireWebhookEvent(appCtx, userId, EVENT_CONFERENCE_CREATED, created)
+
+	return cf, nil
+}
+
+func getQuery(appCtx context.Context, cqf *ConferenceQueryForms) (*datastore.Query, error) {
+	//Return formatted query from the submitted filters.
+	q := datastore.NewQuery("Conference")
+	inequalityFilter, filters, err := formatFilters(cqf.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	//If exists, sort on inequality filter first
+	if inequalityFilter == "" {
+		q = q.Order("Name")
+	} else {
+		q = q.Order(inequalityFilter)
+		q = q.Order("Name")
+	}
+	
+	for v := range filters {
+		filtr := filters[v]
+		
+		if filtr.Field == "Month" || filtr.Field == "MaxAttendees" {
+			val, err := strconv.Atoi(filtr.Value)
+			if err != nil {
+				return nil, err
+			}
+			q = q.Filter(filtr.Field + filtr.Operator, val)
+		} else {
+			q = q.Filter(filtr.Field + filtr.Operator, filtr.Value)
+		}
+	}
+	
+	return q, nil
+}
+
+func formatFilters(filters []ConferenceQueryForm) (string, []ConferenceQueryForm, error) {
+	//Parse, check validity and format user supplied filters.
+	formattedFilters := make([]ConferenceQueryForm, 0, len(filters))
+	inequalityField := ""
+	verr := &ValidationError{}
+	
+	for v := range filters {
+		filtr := filters[v]
+		validateQueryFilter(verr, v, &filtr)
+		if len(verr.FieldErrors) > 0 {
+			continue
+		}
+		filtr.Field = FIELDS[filtr.Field]
+		filtr.Operator = OPERATORS[filtr.Operator]
+		
+		//Every operation except "=" is an inequality
+		if filtr.Operator != "=" {
+			//check if inequality operation has been used in previous filters
+			//disallow the filter if inequality was performed on a different field before
+			//track the field on which the inequality operation is performed
+			if inequalityField != "" && inequalityField != filtr.Field {
+				verr.Add(fmt.Sprintf("filters[%d].operator", v),
+					"inequality filters are only allowed on one field, already used on %s", inequalityField)
+			} else {
+				inequalityField = filtr.Field
+			}
+		}
+		
+		formattedFilters = append(formattedFilters, filtr)
+	}
+	if err := verr.Err(); err != nil {
+		return "", nil, err
+	}
+
+	return inequalityField, formattedFilters, nil
+}
+
+func (h *ConferenceApi) QueryConferences(r *http.Request, cqf *ConferenceQueryForms) (*ConferenceForms, error) {
+	//Query for conferences.
+	appCtx := appengine.NewContext(r)
+	q, err := getQuery(appCtx, cqf)
+	if err != nil {
+		return nil, err
+	}
+	var conferences []Conference
+	keys, err := q.GetAll(appCtx, &conferences)
+	if err != nil {
+		return nil, err
+	}
+	if err := aggregateSeatsAvailable(appCtx, conferences, keys); err != nil {
+		return nil, err
+	}
+
+	//return individual ConferenceForm object per Conference
+	forms := &ConferenceForms{
+		Items: make([]ConferenceForm, 0, len(conferences)),
+	}
+	for v := range conferences {
+		cf, _ := copyConferenceToForm(&conferences[v], keys[v].Encode(), "")
+		forms.Items = append(forms.Items, *cf)
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) GetConferencesCreated(r *http.Request) (*ConferenceForms, error) {
+	//Return conferences created by user.
+	//make sure user is authed
+	c := endpoints.NewContext(r)
+	user, err := endpoints.CurrentUser(c, []string{endpoints.EmailScope},
+		[]string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID}, []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, endpoints.UnauthorizedError
+	}
+
+	//make profile key
+	userId := getUserId(user, "")
+	appCtx := appengine.NewContext(r)
+	parentKey := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	//create ancestor query for this user
+	q := datastore.NewQuery("Conference").Ancestor(parentKey)
+	var created []Conference
+	createdKeys, err := q.GetAll(appCtx, &created)
+	if err != nil {
+		return nil, err
+	}
+	//less those the user handed over, plus those handed over to them;
+	//see transferConference
+	conferences := make([]Conference, 0, len(created))
+	keys := make([]*datastore.Key, 0, len(created))
+	for v := range created {
+		if created[v].OrganizerUserId == userId {
+			conferences = append(conferences, created[v])
+			keys = append(keys, createdKeys[v])
+		}
+	}
+	var received []Conference
+	receivedKeys, err := datastore.NewQuery("Conference").Filter("OrganizerUserId=", userId).GetAll(appCtx, &received)
+	if err != nil {
+		return nil, err
+	}
+	for v := range received {
+		if !receivedKeys[v].Parent().Equal(parentKey) {
+			conferences = append(conferences, received[v])
+			keys = append(keys, receivedKeys[v])
+		}
+	}
+	if err := aggregateSeatsAvailable(appCtx, conferences, keys); err != nil {
+		return nil, err
+	}
+	//get the user profile and display name
+	var profile Profile
+	err = datastore.Get(appCtx, parentKey, &profile)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	displayName := profile.DisplayName
+	//return set of ConferenceForm objects per Conference
+	forms := &ConferenceForms{
+		Items: make([]ConferenceForm, 0, len(conferences)),
+	}
+	for v := range conferences {
+		cf, _ := copyConferenceToForm(&conferences[v], keys[v].Encode(), displayName)
+		forms.Items = append(forms.Items, *cf)
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) CreateConference(r *http.Request, cf *ConferenceForm) (*ConferenceForm, error) {
+	//Create new conference.
+	return createConferenceObject(r, cf)
+}
+
 func copyProfileToForm(r *http.Request, prof *Profile) (*ProfileForm, error) {
 	//Copy relevant fields from Profile to ProfileForm.
 	pf := &ProfileForm{
 			DisplayName: prof.DisplayName,
 			MainEmail: prof.MainEmail,
 			TeeShirtSize: StringEnumToTeeShirtSize(prof.TeeShirtSize),
+			Affiliation: prof.Affiliation,
+			JobTitle: prof.JobTitle,
+			Location: prof.Location,
+			Bio: prof.Bio,
+			Links: prof.Links,
+			EmailPreferences: copyEmailPreferencesToForm(prof),
 	}
+	appCtx := appengine.NewContext(r)
+	pf.AvatarUrl = avatarUrl(appCtx, prof.AvatarBlob)
+	pf.AvatarThumbnailUrl = avatarUrl(appCtx, prof.AvatarThumbnailBlob)
+	applog.Debugf(appCtx, "Did run copyProfileToForm()")
 	return pf, nil
 }
 
-func getProfileFromUser(r *http.Request) (*Profile, error) {
+func getProfileFromUser(r *http.Request) (*Profile, *datastore.Key, error) {
 	//Return user Profile from datastore, creating new one if non-existent.
 	//TODO
 	//make sure user is authed
-	//c := endpoints.NewContext(r)
-	//user, err := endpoints.CurrentUser(c, []string{endpoints.EmailScope},
-	//	[]string{WEB_CLIENT_ID, endpoints.APIExplorerClientID}, []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID})
-	//if err != nil {
-	//	return nil, err
-	//}
-	//if user == nil {
-	//	return nil, endpoints.UnauthorizedError
-	//}
-	var profile *Profile
-	if profile == nil {
-		profile = &Profile{
-			DisplayName: "Test",
-			MainEmail: "",
-			TeeShirtSize: TeeShirtSizeToStringEnum(NOT_SPECIFIED),
-		}
-		//TODO
-	}
-	return profile, nil
+	c := endpoints.NewContext(r)
+	user, err := endpoints.CurrentUser(c, []string{endpoints.EmailScope},
+		[]string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID}, []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID})
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, endpoints.UnauthorizedError
+	}
+	//get Profile from datastore
+	userId := getUserId(user, "")
+	appCtx := appengine.NewContext(r)
+	key := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	var profile Profile
+	err = datastore.Get(appCtx, key, &profile)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, nil, err
+	}
+	//a deleted account starts over as a new one; see deleteMyAccount
+	if err == datastore.ErrNoSuchEntity || !profile.DeletedAt.IsZero() {
+		//create in a transaction so concurrent first requests don't
+		//overwrite each other
+		created := false
+		err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			err := datastore.Get(appCtx, key, &profile)
+			if err == nil && !profile.DeletedAt.IsZero() {
+				err = datastore.ErrNoSuchEntity
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			profile = Profile{
+				DisplayName: user.String(),
+				MainEmail: user.Email,
+				TeeShirtSize: TeeShirtSizeToStringEnum(NOT_SPECIFIED),
+			}
+			_, err = datastore.Put(appCtx, key, &profile)
+			created = err == nil
+			return err
+		}, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if created {
+			recordAudit(appCtx, userId, "profile.create", key, nil, nil, auditSnapshot(&profile))
+		}
+	}
+	//move registrations made before Registration existed; see MigrateRegistrations
+	if len(profile.ConferenceKeysToAttend) > 0 {
+		if err := migrateProfileRegistrations(appCtx, key); err != nil {
+			return nil, nil, err
+		}
+		profile.ConferenceKeysToAttend = nil
+	}
+	return &profile, key, nil
 }
 
 func doProfile(r *http.Request, saveRequest *ProfileMiniForm) (*ProfileForm, error) {
 	//Get user Profile and return to user, possibly updating it first.
 	//get user Profile
-	prof, err := getProfileFromUser(r)
+	prof, key, err := getProfileFromUser(r)
 	if err != nil {
 		return nil, err
 	}
 	
 	//if saveProfile(), process user-modifyable fields
 	if saveRequest != nil {
-		prof.TeeShirtSize = TeeShirtSizeToStringEnum(saveRequest.TeeShirtSize)
-		prof.DisplayName = saveRequest.DisplayName
+		//re-read in the transaction, so fields changed elsewhere since,
+		//e.g. by an unsubscribe link or the account's deletion, are kept
+		appCtx := appengine.NewContext(r)
+		var before []byte
+		err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			*prof = Profile{}
+			if err := datastore.Get(appCtx, key, prof); err != nil {
+				return err
+			}
+			if !prof.DeletedAt.IsZero() {
+				return endpoints.NewConflictError("This account was deleted")
+			}
+			before = auditSnapshot(prof)
+			prof.TeeShirtSize = TeeShirtSizeToStringEnum(saveRequest.TeeShirtSize)
+			prof.DisplayName = saveRequest.DisplayName
+			if saveRequest.Affiliation != nil {
+				prof.Affiliation = strings.TrimSpace(*saveRequest.Affiliation)
+			}
+			if saveRequest.JobTitle != nil {
+				prof.JobTitle = strings.TrimSpace(*saveRequest.JobTitle)
+			}
+			if saveRequest.Location != nil {
+				prof.Location = strings.TrimSpace(*saveRequest.Location)
+			}
+			if saveRequest.Bio != nil {
+				prof.Bio = strings.TrimSpace(*saveRequest.Bio)
+			}
+			if saveRequest.Links != nil {
+				prof.Links = make([]string, len(saveRequest.Links))
+				for v := range saveRequest.Links {
+					prof.Links[v] = strings.TrimSpace(saveRequest.Links[v])
+				}
+			}
+			if saveRequest.EmailPreferences != nil {
+				prof.EmailOptOuts = emailOptOutsFromForm(saveRequest.EmailPreferences)
+			}
+			_, err := datastore.Put(appCtx, key, prof)
+			return err
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		recordAudit(appCtx, key.StringID(), "profile.update", key, nil, before, auditSnapshot(prof))
 	}
 	
 	//return ProfileForm
-	return copyProfileToForm(r, prof)
+	pf, err := copyProfileToForm(r, prof)
+	if err != nil {
+		return nil, err
+	}
+	confKeys, err := getRegisteredConferenceKeys(appengine.NewContext(r), key.StringID())
+	if err != nil {
+		return nil, err
+	}
+	pf.ConferenceKeysToAttend = make([]string, len(confKeys))
+	for v := range confKeys {
+		pf.ConferenceKeysToAttend[v] = confKeys[v].Encode()
+	}
+	return pf, nil
 }
 
 func (h *ConferenceApi) GetProfile(r *http.Request) (*ProfileForm, error) {
@@ -74,9 +532,671 @@ func (h *ConferenceApi) GetProfile(r *http.Request) (*ProfileForm, error) {
 	return doProfile(r, nil)
 }
 
-func (h *ConferenceApi) SaveProfile(r *http.Request) (*ProfileForm, error) {
+func (h *ConferenceApi) SaveProfile(r *http.Request, pf *ProfileMiniForm) (*ProfileForm, error) {
 	//Update & return user profile.
-	return doProfile(r, nil)
+	if err := validateProfileMiniForm(pf); err != nil {
+		return nil, err
+	}
+	return doProfile(r, pf)
+}
+
+func cacheAnnouncement(r *http.Request) (string, error) {
+	//Create Announcement & assign to memcache; used by memcache cron job & putAnnouncement().
+	appCtx := appengine.NewContext(r)
+	q := datastore.NewQuery("Conference").
+		Filter("SeatsAvailable<=", 5).
+		Filter("SeatsAvailable>", 0).
+		Project("Name")
+	var confs []Conference
+	_, err := q.GetAll(appCtx, &confs)
+	if err != nil {
+		return "", err
+	}
+	
+	var announcement string
+	if len(confs) > 0 {
+		//If there are almost sold out conferences,
+		//format announcement and set it in memcache
+		announcement = "Last chance to attend! The following conferences are nearly sold out: "
+		for v := range confs {
+			announcement += confs[v].Name + ", "
+		}
+		item := &memcache.Item{
+		    Key:   MEMCACHE_ANNOUNCEMENTS_KEY,
+		    Value: []byte(announcement),
+		}
+		memcache.Set(appCtx, item)
+	} else {
+		//If there are no sold out conferences,
+		//delete the memcache announcements entry
+		announcement = ""
+		memcache.Delete(appCtx, MEMCACHE_ANNOUNCEMENTS_KEY)
+	}
+	
+	return announcement, nil
+}
+
+func (h *ConferenceApi) GetAnnouncement(r *http.Request) (*StringMessage, error) {
+	//Return Announcement from memcache.
+	appCtx := appengine.NewContext(r)
+	found, err := memcache.Get(appCtx, MEMCACHE_ANNOUNCEMENTS_KEY)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+	var data string
+	if err == memcache.ErrCacheMiss {
+		data = ""
+	} else {
+		data = string(found.Value)
+	}
+	return &StringMessage{Data: data}, nil
+}
+
+func conferenceRegistration(rr *RegistrationRequest, r *http.Request, reg bool) (*BooleanMessage, error) {
+	//Register or unregister user for selected conference.
+	op := REGISTRATION_OP_REGISTER
+	if !reg {
+		op = REGISTRATION_OP_UNREGISTER
+	}
+	_, changed, err := changeRegistration(r, rr, op, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanMessage{Data:changed}, nil
+}
+
+func changeRegistration(r *http.Request, rr *RegistrationRequest, op registrationOp, holdFor time.Duration) (*Registration, bool, error) {
+	//Apply op to the current user's Registration for selected conference.
+	_, profKey, err := getProfileFromUser(r) //get user Profile
+	if err != nil {
+		return nil, false, err
+	}
+	return applyRegistration(appengine.NewContext(r), profKey.StringID(), rr, op, holdFor)
+}
+
+func applyRegistration(appCtx context.Context, userId string, rr *RegistrationRequest, op registrationOp, holdFor time.Duration) (*Registration, bool, error) {
+	//Apply op to userId's Registration for selected conference, returning
+	//it and whether anything changed. A held seat counts as Taken until the
+	//hold is confirmed, released or swept by ReleaseExpiredHoldsHandler.
+	//Paid tickets are only registered once their payment succeeded.
+	websafeConferenceKey := rr.WebsafeConferenceKey
+
+	//check if conf exists given websafeConfKey
+	confKey, err := datastore.DecodeKey(websafeConferenceKey)
+	if err != nil {
+		return nil, false, err
+	}
+	conf, err := ensureSeatShards(appCtx, confKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, false, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	regKey := registrationKey(appCtx, confKey, conf.SeatShards, userId)
+	shardKey := regKey.Parent()
+
+	//an active registration keeps its ticket type; a new one picks one
+	//if the conference has any
+	var current Registration
+	if err := datastore.Get(appCtx, regKey, &current); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, false, err
+	}
+	active := current.Status == REGISTRATION_REGISTERED || current.Status == REGISTRATION_HELD
+	taking := !active && (op == REGISTRATION_OP_REGISTER || op == REGISTRATION_OP_HOLD)
+	if !conf.CancelledAt.IsZero() && (taking || op == REGISTRATION_OP_CONFIRM_HOLD) {
+		return nil, false, endpoints.NewConflictError("This conference was cancelled")
+	}
+	websafeTicketTypeKey := rr.WebsafeTicketTypeKey
+	quantity := rr.Quantity
+	promoCode := normalizePromoCode(rr.PromoCode)
+	if active {
+		websafeTicketTypeKey = current.TicketTypeKey
+		quantity = registrationSeats(&current)
+		promoCode = current.PromoCode
+	} else if !taking {
+		promoCode = ""
+	} else {
+		if websafeTicketTypeKey == "" && conf.TicketTypes > 0 {
+			return nil, false, endpoints.NewBadRequestError("websafeTicketTypeKey is required for this conference")
+		}
+		if quantity == 0 {
+			quantity = 1
+		}
+		if quantity < 0 {
+			return nil, false, endpoints.NewBadRequestError("quantity must be positive")
+		}
+	}
+	var ticketType *TicketType
+	var typeKey, typeShardKey *datastore.Key
+	if websafeTicketTypeKey != "" {
+		ticketType, typeKey, err = getConferenceTicketType(appCtx, confKey, websafeTicketTypeKey)
+		if err != nil {
+			return nil, false, err
+		}
+		typeShardKey = ticketSeatShardKey(appCtx, typeKey, ticketType, userId)
+		if taking {
+			if !ticketTypeOnSale(ticketType, time.Now()) {
+				return nil, false, endpoints.NewConflictError("%s tickets are not on sale", ticketType.Name)
+			}
+			if quantity > maxTicketsPerUser(ticketType) {
+				return nil, false, endpoints.NewBadRequestError("quantity must be at most %d", maxTicketsPerUser(ticketType))
+			}
+		}
+	} else if taking && quantity > 1 {
+		return nil, false, endpoints.NewBadRequestError("quantity must be 1 without a ticket type")
+	}
+
+	//a promo code is checked now; its use is counted with the seats
+	var promo *PromoCode
+	var promoKey *datastore.Key
+	if promoCode != "" {
+		promoKey = promoCodeKey(appCtx, confKey, promoCode)
+		if taking {
+			if ticketType == nil {
+				return nil, false, endpoints.NewBadRequestError("Promo codes only apply to ticket types")
+			}
+			promo = &PromoCode{}
+			err := datastore.Get(appCtx, promoKey, promo)
+			if err == datastore.ErrNoSuchEntity {
+				return nil, false, endpoints.NewNotFoundError("No such promo code")
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			if err := checkPromoCode(promo, websafeTicketTypeKey, time.Now()); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	amount, discount := priceRegistration(ticketType, promo, quantity)
+	if taking && op == REGISTRATION_OP_REGISTER && amount > 0 {
+		return nil, false, endpoints.NewConflictError("Payment required: hold a seat and pay for it to register")
+	}
+
+	//a registration gets its ticket when it becomes REGISTERED
+	ticketId, err := newTicketId()
+	if err != nil {
+		return nil, false, err
+	}
+
+	//the Registration is a child of the user's seat shard, so the seat
+	//and the registration change together in one entity group; a ticket
+	//type's seat and the promo code are changed in the same transaction
+	var retval bool
+	var previous string
+	var registration Registration
+	var regBefore, regAfter, shardBefore, shardAfter, typeShardBefore, typeShardAfter []byte
+	for attempt := 0; ; attempt++ {
+		err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			keys := []*datastore.Key{regKey, shardKey}
+			//typeShard is only read and written with a ticket type,
+			//promoUse with a promo code
+			var shard, typeShard SeatShard
+			var promoUse PromoCode
+			if err := datastore.Get(appCtx, shardKey, &shard); err != nil {
+				return err
+			}
+			entities := []interface{}{&registration, &shard}
+			if typeShardKey != nil {
+				if err := datastore.Get(appCtx, typeShardKey, &typeShard); err != nil {
+					return err
+				}
+				keys = append(keys, typeShardKey)
+				entities = append(entities, &typeShard)
+			}
+			if promoKey != nil {
+				if err := datastore.Get(appCtx, promoKey, &promoUse); err != nil {
+					return err
+				}
+				keys = append(keys, promoKey)
+				entities = append(entities, &promoUse)
+			}
+			registration = Registration{}
+			err := datastore.Get(appCtx, regKey, &registration)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			previous = registration.Status
+			if (previous == REGISTRATION_REGISTERED || previous == REGISTRATION_HELD) != active ||
+				(active && registration.TicketTypeKey != websafeTicketTypeKey) {
+				//changed since it was read above
+				return endpoints.NewConflictError("Your registration changed, please try again")
+			}
+			regBefore, shardBefore, typeShardBefore = nil, auditSnapshot(&shard), nil
+			if err == nil {
+				regBefore = auditSnapshot(&registration)
+			}
+			if typeShardKey != nil {
+				typeShardBefore = auditSnapshot(&typeShard)
+			}
+			now := time.Now()
+			retval = true
+
+			switch op {
+			case REGISTRATION_OP_REGISTER, REGISTRATION_OP_HOLD:
+				//check if user already registered otherwise add
+				if previous == REGISTRATION_REGISTERED {
+					return endpoints.NewConflictError("You have already registered for this conference")
+				}
+				if previous == REGISTRATION_HELD {
+					if op == REGISTRATION_OP_HOLD {
+						//keep the hold as it is; holds can't be extended
+						retval = false
+						return nil
+					}
+					if registration.Amount > 0 && registration.PaymentStatus != PAYMENT_SUCCEEDED {
+						return endpoints.NewConflictError("Payment required: pay for your held seat to register")
+					}
+					//the held seats are still Taken, even if the hold expired
+					registration.Status = REGISTRATION_REGISTERED
+					registration.RegisteredAt = now
+					break
+				}
+				//the refund task reads the refund from this Registration,
+				//so it isn't reused until the refund went through
+				if registration.RefundStatus == REFUND_PENDING {
+					return endpoints.NewConflictError("Your refund is still being processed, please try again later")
+				}
+				
+				//check if seats avail on this shard, and of the ticket type
+				if shard.Allocated - shard.Taken < quantity {
+					return &shardFullError{poolKey: confKey, shards: conf.SeatShards, index: seatShardIndex(userId, conf.SeatShards)}
+				}
+				if typeShardKey != nil && typeShard.Allocated - typeShard.Taken < quantity {
+					return &shardFullError{poolKey: typeKey, shards: ticketType.SeatShards, index: seatShardIndex(userId, ticketType.SeatShards)}
+				}
+				if promoUse.MaxUses > 0 && promoUse.Used >= promoUse.MaxUses {
+					return endpoints.NewConflictError("This promo code has been used up")
+				}
+				
+				//register user, take away the seats
+				registration.UserId = userId
+				registration.ConferenceKey = websafeConferenceKey
+				registration.TicketTypeKey = websafeTicketTypeKey
+				registration.Quantity = quantity
+				registration.PromoCode = promoCode
+				registration.Amount = amount
+				registration.Discount = discount
+				registration.Currency = ""
+				if ticketType != nil {
+					registration.Currency = ticketType.Currency
+				}
+				registration.PaymentProvider = ""
+				registration.PaymentIntentId = ""
+				registration.PaymentStatus = ""
+				registration.PaidAt = time.Time{}
+				registration.RefundAmount = 0
+				registration.RefundStatus = ""
+				registration.RefundId = ""
+				registration.RefundedAt = time.Time{}
+				registration.TicketId = ""
+				registration.CheckedInAt = time.Time{}
+				registration.CheckedInBy = ""
+				registration.CancelledAt = time.Time{}
+				if op == REGISTRATION_OP_HOLD {
+					registration.Status = REGISTRATION_HELD
+					registration.HeldAt = now
+					registration.HoldExpiresAt = now.Add(holdFor)
+				} else {
+					registration.Status = REGISTRATION_REGISTERED
+					registration.RegisteredAt = now
+				}
+				shard.Taken += quantity
+				typeShard.Taken += quantity
+				promoUse.Used += 1
+			case REGISTRATION_OP_CONFIRM_HOLD:
+				if previous == REGISTRATION_REGISTERED {
+					return endpoints.NewConflictError("You have already registered for this conference")
+				}
+				if previous != REGISTRATION_HELD {
+					return endpoints.NewNotFoundError("You have no seat held for this conference")
+				}
+				//a paid hold is kept past its expiry, until it is confirmed
+				if registration.PaymentStatus != PAYMENT_SUCCEEDED && now.After(registration.HoldExpiresAt) {
+					//give the seats back now rather than wait for the sweeper
+					registration.Status = REGISTRATION_RELEASED
+					registration.CancelledAt = now
+					shard.Taken -= quantity
+					typeShard.Taken -= quantity
+					promoUse.Used -= 1
+					retval = false
+					break
+				}
+				if registration.Amount > 0 && registration.PaymentStatus != PAYMENT_SUCCEEDED {
+					return endpoints.NewConflictError("Payment required: pay for your held seat to register")
+				}
+				registration.Status = REGISTRATION_REGISTERED
+				registration.RegisteredAt = now
+			case REGISTRATION_OP_UNREGISTER:
+				//check if user already registered or holding a seat
+				if !active {
+					retval = false
+					return nil
+				}
+				//unregister user, add back the seats
+				registration.Status = REGISTRATION_CANCELLED
+				if previous == REGISTRATION_HELD {
+					registration.Status = REGISTRATION_RELEASED
+				}
+				registration.CancelledAt = now
+				shard.Taken -= quantity
+				typeShard.Taken -= quantity
+				promoUse.Used -= 1
+				//a released hold was never used, so its payment comes back
+				//in full; a registration follows the cancellation policy
+				refund := cancellationRefund(conf, &registration, now)
+				if previous == REGISTRATION_HELD && registration.PaymentStatus == PAYMENT_SUCCEEDED {
+					refund = registration.Amount
+				}
+				if refund > 0 {
+					registration.RefundAmount = refund
+					registration.RefundStatus = REFUND_PENDING
+					if err := queueRefund(appCtx, regKey); err != nil {
+						return err
+					}
+				}
+			}
+			if registration.Status == REGISTRATION_REGISTERED && registration.TicketId == "" {
+				registration.TicketId = ticketId
+			}
+			registration.UpdatedAt = now
+			
+			//write things back to the datastore & return
+			_, err = datastore.PutMulti(appCtx, keys, entities)
+			if err != nil {
+				return err
+			}
+			regAfter, shardAfter = auditSnapshot(&registration), auditSnapshot(&shard)
+			if typeShardKey != nil {
+				typeShardAfter = auditSnapshot(&typeShard)
+			}
+			return nil
+		}, &datastore.TransactionOptions{XG: typeShardKey != nil || promoKey != nil, Attempts: REGISTRATION_TRANSACTION_ATTEMPTS})
+		full, ok := err.(*shardFullError)
+		if !ok || attempt >= SEAT_REBALANCE_ATTEMPTS {
+			break
+		}
+		//borrow seats from another shard of the full pool, then try again
+		moved, err := rebalanceSeats(appCtx, full.poolKey, full.shards, full.index, quantity)
+		if err != nil && err != datastore.ErrConcurrentTransaction {
+			return nil, false, err
+		}
+		if !moved && err == nil {
+			if full.poolKey.Equal(confKey) {
+				return nil, false, endpoints.NewConflictError("There are no seats available.")
+			}
+			return nil, false, endpoints.NewConflictError("There are not enough %s tickets left.", ticketType.Name)
+		}
+	}
+	if _, ok := err.(*shardFullError); ok || err == datastore.ErrConcurrentTransaction {
+		return nil, false, endpoints.NewConflictError("This conference is busy, please try again")
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if op == REGISTRATION_OP_CONFIRM_HOLD && registration.Status == REGISTRATION_RELEASED {
+		recordAudit(appCtx, userId, "registration.expire", regKey, confKey, regBefore, regAfter)
+		recordAudit(appCtx, userId, "registration.expire", shardKey, confKey, shardBefore, shardAfter)
+		if typeKey != nil {
+			recordAudit(appCtx, userId, "registration.expire", typeShardKey, confKey, typeShardBefore, typeShardAfter)
+			forgetTicketSeats(appCtx, typeKey)
+		}
+		publishSeatsChanged(appCtx, websafeConferenceKey)
+		return nil, false, endpoints.NewConflictError("Your hold has expired")
+	}
+	if !retval {
+		return &registration, false, nil
+	}
+
+	//leave a note in the user's inbox, let live viewers
+	//and the organizer's webhooks know
+	publishSeatsChanged(appCtx, websafeConferenceKey)
+	var n *Notification
+	var event string
+	action := "registration.create"
+	switch {
+	case registration.Status == REGISTRATION_HELD:
+		action = "registration.hold"
+	case registration.Status == REGISTRATION_RELEASED:
+		action = "registration.release"
+	case registration.Status == REGISTRATION_REGISTERED:
+		n = &Notification{
+			Type: NOTIFICATION_REGISTERED,
+			Title: "You are registered for " + conf.Name,
+		}
+		event = EVENT_REGISTRATION_CREATED
+	case registration.Status == REGISTRATION_CANCELLED:
+		action = "registration.delete"
+		n = &Notification{
+			Type: NOTIFICATION_UNREGISTERED,
+			Title: "You are no longer registered for " + conf.Name,
+		}
+		if registration.RefundAmount > 0 {
+			n.Body = formatAmount(registration.RefundAmount, registration.Currency) + " will be refunded to you"
+		}
+		event = EVENT_REGISTRATION_CANCELLED
+	}
+	recordAudit(appCtx, userId, action, regKey, confKey, regBefore, regAfter)
+	recordAudit(appCtx, userId, action, shardKey, confKey, shardBefore, shardAfter)
+	if typeKey != nil {
+		recordAudit(appCtx, userId, action, typeShardKey, confKey, typeShardBefore, typeShardAfter)
+		forgetTicketSeats(appCtx, typeKey)
+	}
+	if n != nil {
+		n.WebsafeConferenceKey = websafeConferenceKey
+		addNotification(appCtx, userId, n)
+		//report the conference with its up to date seat count
+		conferences := []Conference{*conf}
+		aggregateSeatsAvailable(appCtx, conferences, []*datastore.Key{confKey})
+		cf, _ := copyConferenceToForm(&conferences[0], websafeConferenceKey, "")
+		fireWebhookEvent(appCtx, conf.OrganizerUserId, event, &registrationEventData{
+			Conference: cf,
+			AttendeeUserId: userId,
+		})
+	}
+	return &registration, true, nil
+}
+
+func (h *ConferenceApi) GetConferencesToAttend(r *http.Request) (*ConferenceForms, error) {
+	//Get list of conferences that user has registered for.
+	_, profKey, err := getProfileFromUser(r) //get user Profile
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	conferences, confKeys, err := getConferencesAttended(appCtx, profKey.StringID())
+	if err != nil {
+		return nil, err
+	}
+	
+	//get organizers
+	organisers := make([]*datastore.Key, 0, len(conferences))
+	for v := range conferences {
+		key := datastore.NewKey(appCtx,"Profile", conferences[v].OrganizerUserId, 0, nil)
+		organisers = append(organisers, key)
+	}
+	profiles := make([]Profile, len(organisers))
+	err = datastore.GetMulti(appCtx, organisers, profiles)
+	if err != nil {
+		return nil, err
+	}
+	
+	//put display names in a dict for easier fetching
+	names := make(map[string]string)
+	for v := range profiles {
+		names[organisers[v].StringID()] = profiles[v].DisplayName
+	}
+	
+	//return set of ConferenceForm objects per Conference
+	forms := &ConferenceForms{
+		Items: make([]ConferenceForm, 0, len(conferences)),
+	}
+	for v := range conferences {
+		cf, _ := copyConferenceToForm(&conferences[v], confKeys[v].Encode(), names[conferences[v].OrganizerUserId])
+		forms.Items = append(forms.Items, *cf)
+	}
+	return forms, nil
+}
+
+type ConfRequest struct {
+	WebsafeConferenceKey string	`json:"websafeConferenceKey"`
+}
+
+func getAuthedUser(r *http.Request) (*appuser.User, error) {
+	//Return the user making the request, or UnauthorizedError.
+	c := endpoints.NewContext(r)
+	user, err := endpoints.CurrentUser(c, []string{endpoints.EmailScope},
+		[]string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID}, []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, endpoints.UnauthorizedError
+	}
+	return user, nil
+}
+
+func getOrganizedConference(r *http.Request, websafeConferenceKey string) (*Conference, *datastore.Key, *appuser.User, error) {
+	//Return the requested Conference if the current user organizes it.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := datastore.DecodeKey(websafeConferenceKey)
+	if err != nil {
+		return nil, nil, nil, endpoints.BadRequestError
+	}
+	var conf Conference
+	appCtx := appengine.NewContext(r)
+	err = datastore.Get(appCtx, key, &conf)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if conf.OrganizerUserId != getUserId(user, "") {
+		return nil, nil, nil, endpoints.NewForbiddenError("Only the organizer can do this")
+	}
+	return &conf, key, user, nil
+}
+
+func (h *ConferenceApi) RegisterForConference(r *http.Request, rr *RegistrationRequest) (*BooleanMessage, error) {
+	//Register user for selected conference, with a ticket type if it has any.
+	return conferenceRegistration(rr, r, true)
+}
+
+func (h *ConferenceApi) UnregisterFromConference(r *http.Request, cr *ConfRequest) (*RegistrationForm, error) {
+	//Unregister user from selected conference, or release their held seats;
+	//a paid registration is refunded as the cancellation policy says.
+	registration, changed, err := changeRegistration(r, &RegistrationRequest{WebsafeConferenceKey: cr.WebsafeConferenceKey}, REGISTRATION_OP_UNREGISTER, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return nil, endpoints.NewNotFoundError("You are not registered for this conference")
+	}
+	return copyRegistrationToForm(registration), nil
+}
+
+func (h *ConferenceApi) GetConference(r *http.Request, cr *ConfRequest) (*ConferenceForm, error) {
+	//Return requested conference (by websafeConferenceKey).
+	//get Conference object from request; bail if not found
+	key, err := datastore.DecodeKey(cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	var conf Conference
+	appCtx := appengine.NewContext(r)
+	err = datastore.Get(appCtx, key, &conf)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	conferences := []Conference{conf}
+	if err := aggregateSeatsAvailable(appCtx, conferences, []*datastore.Key{key}); err != nil {
+		return nil, err
+	}
+	conf = conferences[0]
+	var ticketTypes []TicketTypeForm
+	if conf.TicketTypes > 0 {
+		if ticketTypes, err = getTicketTypeForms(appCtx, &conf, key); err != nil {
+			return nil, err
+		}
+	}
+	//the organizer isn't always the parent; see transferConference
+	organizerKey := datastore.NewKey(appCtx, "Profile", conf.OrganizerUserId, 0, nil)
+	var prof Profile
+	err = datastore.Get(appCtx, organizerKey, &prof)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	//return ConferenceForm
+	displayName := prof.DisplayName
+	cf, err := copyConferenceToForm(&conf, key.Encode(), displayName)
+	if err != nil {
+		return nil, err
+	}
+	cf.TicketTypes = ticketTypes
+	return cf, nil
+}
+
+func doAlert(r *http.Request) (*LatestAlert, error) {
+	//Get latest alert and return to user
+	//retrieve latest alert from datastore
+	appCtx := appengine.NewContext(r)
+	q := datastore.NewQuery("Alert").Order("-date")
+	var alerts []Alert
+	_, err := q.GetAll(appCtx, &alerts)
+	if err != nil {
+		return nil, err
+	}
+	la := &LatestAlert{}
+	if len(alerts) > 0 {
+		la.Content = alerts[0].Content
+	}
+	return la, nil
+}
+
+func (h *ConferenceApi) GetAlert(r *http.Request) (*LatestAlert, error) {
+	//Return latest alert.
+	return doAlert(r)
+}
+
+func (h *ConferenceApi) FilterPlayground(r *http.Request) (*ConferenceForms, error) {
+	appCtx := appengine.NewContext(r)
+	q := datastore.NewQuery("Conference")
+
+	//simple filter usage:
+	//q = q.Filter("City =", "Paris")
+
+	//TODO
+	//add 2 filters:
+	//1: city equals to Chicago
+	//2: topics equals "Medical Innovations"
+	q = q.Filter("City=", "Chicago")
+	q = q.Filter("Topics=", "Medical Innovations")
+
+	var conferences []Conference
+	keys, err := q.GetAll(appCtx, &conferences)
+	if err != nil {
+		return nil, err
+	}
+	if err := aggregateSeatsAvailable(appCtx, conferences, keys); err != nil {
+		return nil, err
+	}
+
+	forms := &ConferenceForms{
+		Items: make([]ConferenceForm, 0, len(conferences)),
+	}
+	for v := range conferences {
+		cf, _ := copyConferenceToForm(&conferences[v], keys[v].Encode(), "")
+		forms.Items = append(forms.Items, *cf)
+	}
+	return forms, nil
 }
 
 func init() {
@@ -96,10 +1216,62 @@ func init() {
 		i := m.Info()
 		i.Name, i.HTTPMethod, i.Path, i.Desc = name, method, path, desc
 		i.Scopes = []string{endpoints.EmailScope}
-		i.ClientIds = []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID}
+		i.Audiences = []string{ANDROID_AUDIENCE}
+		i.ClientIds = []string{WEB_CLIENT_ID, endpoints.APIExplorerClientID, ANDROID_CLIENT_ID}
 	}
 
 	register("GetProfile", "getProfile", "GET", "profile", "Get profile")
 	register("SaveProfile", "saveProfile", "POST", "profile", "Save profile")
+	register("SetAvatar", "setAvatar", "POST", "profile/avatar", "Set profile avatar")
+	register("DeleteAvatar", "deleteAvatar", "DELETE", "profile/avatar", "Delete profile avatar")
+	register("ExportMyData", "exportMyData", "GET", "profile/export", "Get personal data export link")
+	register("DeleteMyAccount", "deleteMyAccount", "POST", "profile/delete", "Delete account")
+	register("CreateConference", "createConference", "POST", "conference", "Create conference")
+	register("QueryConferences", "queryConferences", "POST", "queryConferences", "Query conferences")
+	register("GetConferencesCreated", "getConferencesCreated", "POST", "getConferencesCreated", "Get conferences created")
+	register("FilterPlayground", "filterPlayground", "GET", "filterPlayground", "Filter playground")
+	register("RegisterForConference", "registerForConference", "POST", "conference/{websafeConferenceKey}", "Register for conference")
+	register("GetConference", "getConference", "GET", "conference/{websafeConferenceKey}", "Get conference")
+	register("GetConferencesToAttend", "getConferencesToAttend", "GET", "conferences/attending", "Get conferences to attend")
+	register("GetAlert", "getAlert", "GET", "alert", "Get alert")
+	register("SendAttendeeMessage", "sendAttendeeMessage", "POST", "conference/{websafeConferenceKey}/message", "Send message to attendees")
+	register("GetAttendeeMessages", "getAttendeeMessages", "GET", "conference/{websafeConferenceKey}/messages", "Get messages sent to attendees")
+	register("SaveSearch", "saveSearch", "POST", "savedSearches", "Save search")
+	register("GetSavedSearches", "getSavedSearches", "GET", "savedSearches", "Get saved searches")
+	register("DeleteSavedSearch", "deleteSavedSearch", "DELETE", "savedSearches/{websafeSavedSearchKey}", "Delete saved search")
+	register("ListNotifications", "listNotifications", "POST", "notifications", "List notifications")
+	register("GetUnreadNotificationCount", "getUnreadNotificationCount", "GET", "notifications/unread", "Get unread notification count")
+	register("MarkRead", "markRead", "POST", "notifications/markRead", "Mark notifications read")
+	register("CreateWebhook", "createWebhook", "POST", "webhooks", "Create webhook")
+	register("GetWebhooks", "getWebhooks", "GET", "webhooks", "Get webhooks")
+	register("DeleteWebhook", "deleteWebhook", "DELETE", "webhooks/{websafeWebhookKey}", "Delete webhook")
+	register("GetWebhookDeliveries", "getWebhookDeliveries", "GET", "webhooks/{websafeWebhookKey}/deliveries", "Get webhook deliveries")
+	register("GetAuditEvents", "getAuditEvents", "POST", "auditEvents", "Get audit events")
+	register("GetCalendarFeed", "getCalendarFeed", "GET", "calendar/feed", "Get calendar feed URL")
+	register("ResetCalendarFeed", "resetCalendarFeed", "POST", "calendar/feed/reset", "Reset calendar feed URL")
+	register("GetConferenceAttendees", "getConferenceAttendees", "POST", "conference/{websafeConferenceKey}/attendees", "Get conference attendees")
+	register("GetConferenceAttendeesCsvUrl", "getConferenceAttendeesCsvUrl", "GET", "conference/{websafeConferenceKey}/attendees/csv", "Get conference attendees CSV link")
+	register("HoldSeat", "holdSeat", "POST", "conference/{websafeConferenceKey}/hold", "Hold a seat")
+	register("ConfirmHold", "confirmHold", "POST", "conference/{websafeConferenceKey}/hold/confirm", "Confirm held seat")
+	register("CreateTicketType", "createTicketType", "POST", "conference/{websafeConferenceKey}/ticketTypes", "Create ticket type")
+	register("GetTicketTypes", "getTicketTypes", "GET", "conference/{websafeConferenceKey}/ticketTypes", "Get ticket types")
+	register("UnregisterFromConference", "unregisterFromConference", "DELETE", "conference/{websafeConferenceKey}", "Unregister from conference")
+	register("SetCancellationPolicy", "setCancellationPolicy", "POST", "conference/{websafeConferenceKey}/cancellationPolicy", "Set cancellation policy")
+	register("SetBillingDetails", "setBillingDetails", "POST", "conference/{websafeConferenceKey}/billing", "Set billing details")
+	register("GetBillingDetails", "getBillingDetails", "GET", "conference/{websafeConferenceKey}/billing", "Get billing details")
+	register("GetInvoice", "getInvoice", "POST", "conference/{websafeConferenceKey}/invoice", "Get invoice")
+	register("GetTicket", "getTicket", "GET", "conference/{websafeConferenceKey}/ticket", "Get ticket")
+	register("CheckIn", "checkIn", "POST", "conference/{websafeConferenceKey}/checkIn", "Check attendee in")
+	register("SetCheckInStaff", "setCheckInStaff", "POST", "conference/{websafeConferenceKey}/checkInStaff", "Set check-in staff")
+	register("GetBadgesPdfUrl", "getBadgesPdfUrl", "POST", "conference/{websafeConferenceKey}/badges", "Get attendee badges PDF link")
+	register("GetTeeShirtReport", "getTeeShirtReport", "GET", "conference/{websafeConferenceKey}/teeShirts", "Get tee-shirt size report")
+	register("GetTeeShirtReportCsvUrl", "getTeeShirtReportCsvUrl", "GET", "conference/{websafeConferenceKey}/teeShirts/csv", "Get tee-shirt size report CSV link")
+	register("CreatePromoCode", "createPromoCode", "POST", "conference/{websafeConferenceKey}/promoCodes", "Create promo code")
+	register("GetPromoCodes", "getPromoCodes", "GET", "conference/{websafeConferenceKey}/promoCodes", "Get promo codes")
+	register("PayForHold", "payForHold", "POST", "conference/{websafeConferenceKey}/hold/pay", "Pay for held seat")
+	register("ConfirmPayment", "confirmPayment", "POST", "conference/{websafeConferenceKey}/hold/pay/confirm", "Confirm payment")
+	register("CheckSeats", "checkSeats", "POST", "admin/checkSeats/{websafeConferenceKey}", "Check conference seats")
+	register("MigrateRegistrations", "migrateRegistrations", "POST", "admin/migrateRegistrations", "Migrate registrations")
+	register("GetAnnouncement", "getAnnouncement", "GET", "conference/announcement/get", "Get announcement")
 	endpoints.HandleHTTP()
 }
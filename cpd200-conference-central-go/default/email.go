@@ -0,0 +1,185 @@
+package main
+
+/*
+email.go -- outgoing email, per-profile email preferences
+    and signed one-click unsubscribe links
+
+*/
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+//Email categories a Profile can opt out of.
+const (
+	EMAIL_CONFERENCE_CREATED = "CONFERENCE_CREATED"
+	EMAIL_REMINDERS = "REMINDERS"
+	EMAIL_ANNOUNCEMENTS = "ANNOUNCEMENTS"
+	EMAIL_DIGESTS = "DIGESTS"
+	EMAIL_ORGANIZER_REPORTS = "ORGANIZER_REPORTS"
+)
+
+var emailCategoryNames = map[string]string{
+	EMAIL_CONFERENCE_CREATED: "conference creation confirmations",
+	EMAIL_REMINDERS: "reminders",
+	EMAIL_ANNOUNCEMENTS: "announcements",
+	EMAIL_DIGESTS: "digests",
+	EMAIL_ORGANIZER_REPORTS: "organizer reports",
+}
+
+func isOptedOut(prof *Profile, category string) bool {
+	//Return true if the Profile does not want emails of this category.
+	for _, c := range prof.EmailOptOuts {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func copyEmailPreferencesToForm(prof *Profile) EmailPreferencesForm {
+	//Turn the stored opt-outs into the outbound preferences message.
+	return EmailPreferencesForm{
+		ConferenceCreated: !isOptedOut(prof, EMAIL_CONFERENCE_CREATED),
+		Reminders: !isOptedOut(prof, EMAIL_REMINDERS),
+		Announcements: !isOptedOut(prof, EMAIL_ANNOUNCEMENTS),
+		Digests: !isOptedOut(prof, EMAIL_DIGESTS),
+		OrganizerReports: !isOptedOut(prof, EMAIL_ORGANIZER_REPORTS),
+	}
+}
+
+func emailOptOutsFromForm(epf *EmailPreferencesForm) []string {
+	//Turn an inbound preferences message into the list of opted-out categories.
+	wanted := map[string]bool{
+		EMAIL_CONFERENCE_CREATED: epf.ConferenceCreated,
+		EMAIL_REMINDERS: epf.Reminders,
+		EMAIL_ANNOUNCEMENTS: epf.Announcements,
+		EMAIL_DIGESTS: epf.Digests,
+		EMAIL_ORGANIZER_REPORTS: epf.OrganizerReports,
+	}
+	optOuts := make([]string, 0, len(wanted))
+	for c, ok := range wanted {
+		if !ok {
+			optOuts = append(optOuts, c)
+		}
+	}
+	return optOuts
+}
+
+func emailSender(appCtx context.Context) string {
+	//Return the sender address used for all outgoing email.
+	return "noreply@" + appengine.AppID(appCtx) + ".appspotmail.com"
+}
+
+func unsubscribeURL(appCtx context.Context, userId string, category string) string {
+	//Return a signed link that unsubscribes userId from category without login.
+	v := url.Values{
+		"user": {userId},
+		"category": {category},
+		"sig": {signToken("unsubscribe", userId, category)},
+	}
+	return "https://" + appengine.DefaultVersionHostname(appCtx) + "/unsubscribe?" + v.Encode()
+}
+
+func sendEmail(appCtx context.Context, userId string, category string, msg *mail.Message) error {
+	//Send msg on behalf of the app unless userId's Profile opted out of category.
+	//Every email carries a signed unsubscribe link, in the body and as a
+	//List-Unsubscribe header for clients supporting one-click unsubscribe.
+	var prof Profile
+	key := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	err := datastore.Get(appCtx, key, &prof)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if isOptedOut(&prof, category) {
+		applog.Infof(appCtx, "Not sending %s email to %s: opted out", category, userId)
+		return nil
+	}
+
+	link := unsubscribeURL(appCtx, userId, category)
+	if msg.Sender == "" {
+		msg.Sender = emailSender(appCtx)
+	}
+	msg.Body += "\r\n\r\n--\r\nTo stop receiving " + emailCategoryNames[category] +
+		", follow this link: " + link + "\r\n"
+	if msg.HTMLBody != "" {
+		msg.HTMLBody += `<p style="font-size:small"><a href="` + html.EscapeString(link) +
+			`">Unsubscribe from ` + emailCategoryNames[category] + `</a></p>`
+	}
+	if msg.Headers == nil {
+		msg.Headers = netmail.Header{}
+	}
+	msg.Headers["List-Unsubscribe"] = []string{"<" + link + ">"}
+	msg.Headers["List-Unsubscribe-Post"] = []string{"List-Unsubscribe=One-Click"}
+	return mail.Send(appCtx, msg)
+}
+
+var unsubscribePage = `<!DOCTYPE html>
+<html><head><title>Conference Central</title></head><body>
+<p>Stop receiving %s from Conference Central?</p>
+<form method="POST" action="/unsubscribe?%s"><button type="submit">Unsubscribe</button></form>
+</body></html>`
+
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	//Honour a signed unsubscribe link; no login required.
+	//GET asks for confirmation so link scanners don't unsubscribe anyone,
+	//POST (including RFC 8058 one-click) records the opt-out.
+	userId := r.FormValue("user")
+	category := r.FormValue("category")
+	if _, ok := emailCategoryNames[category]; !ok || userId == "" ||
+		!verifyToken(r.FormValue("sig"), "unsubscribe", userId, category) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid unsubscribe link"))
+		return
+	}
+	if r.Method == "GET" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, unsubscribePage, emailCategoryNames[category], html.EscapeString(r.URL.RawQuery))
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	appCtx := appengine.NewContext(r)
+	key := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	var before, after []byte
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		var prof Profile
+		err := datastore.Get(appCtx, key, &prof)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if isOptedOut(&prof, category) {
+			return nil
+		}
+		before = auditSnapshot(&prof)
+		prof.EmailOptOuts = append(prof.EmailOptOuts, category)
+		_, err = datastore.Put(appCtx, key, &prof)
+		after = auditSnapshot(&prof)
+		return err
+	}, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "unsubscribe %s from %s: %v", userId, category, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if after != nil {
+		recordAudit(appCtx, userId, "profile.unsubscribe", key, nil, before, after)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("You will no longer receive " + emailCategoryNames[category] + " from Conference Central.\n"))
+}
@@ -0,0 +1,215 @@
+package main
+
+/*
+fakepay.go -- an in-process PaymentProvider for development and tests,
+    keeping its payment intents in the datastore
+
+Confirming with FAKE_PAYMENT_METHOD_DECLINED fails, any other payment
+method succeeds. Each outcome is also reported to the payment webhook
+through the task queue, the way a real provider would call it.
+
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//Name of the fake provider, for PAYMENT_PROVIDER.
+const FAKE_PAYMENT_PROVIDER = "fake"
+
+//Payment method the fake provider declines.
+const FAKE_PAYMENT_METHOD_DECLINED = "fake_card_declined"
+
+//Header carrying the signature of fake webhook calls.
+const FAKE_PAYMENT_SIGNATURE_HEADER = "X-Fake-Payment-Signature"
+
+type fakePaymentProvider struct{}
+
+type fakePaymentEvent struct {
+	//fakePaymentEvent -- body of a fake webhook call
+	Type string `json:"type"`
+	IntentId string `json:"intentId"`
+}
+
+func init() {
+	paymentProviders[FAKE_PAYMENT_PROVIDER] = fakePaymentProvider{}
+}
+
+func fakePaymentIntentKey(appCtx context.Context, intentId string) (*datastore.Key, error) {
+	//Return the key of the FakePaymentIntent with intentId.
+	id, err := strconv.ParseInt(strings.TrimPrefix(intentId, "fpi_"), 10, 64)
+	if err != nil || !strings.HasPrefix(intentId, "fpi_") {
+		return nil, errors.New("fakepay: bad payment intent id " + strconv.Quote(intentId))
+	}
+	return datastore.NewKey(appCtx, "FakePaymentIntent", "", id, nil), nil
+}
+
+func copyFakePaymentIntent(key *datastore.Key, fpi *FakePaymentIntent) *PaymentIntent {
+	//Return the PaymentIntent of a FakePaymentIntent.
+	id := "fpi_" + strconv.FormatInt(key.IntID(), 10)
+	return &PaymentIntent{
+		Id: id,
+		Amount: fpi.Amount,
+		Currency: fpi.Currency,
+		Reference: fpi.Reference,
+		Status: fpi.Status,
+		ClientSecret: id + "_secret_" + signToken("fakepay.intent", id),
+	}
+}
+
+func (p fakePaymentProvider) CreateIntent(appCtx context.Context, amount int64, currency string, reference string, description string) (*PaymentIntent, error) {
+	//Store a pending payment.
+	if !appengine.IsDevAppServer() && !FAKE_PAYMENTS_IN_PRODUCTION {
+		return nil, endpoints.NewInternalServerError("the fake payment provider only runs on the development server")
+	}
+	now := time.Now()
+	fpi := &FakePaymentIntent{
+		Amount: amount,
+		Currency: currency,
+		Reference: reference,
+		Description: description,
+		Status: PAYMENT_PENDING,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	key, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "FakePaymentIntent", nil), fpi)
+	if err != nil {
+		return nil, err
+	}
+	return copyFakePaymentIntent(key, fpi), nil
+}
+
+func (p fakePaymentProvider) ConfirmIntent(appCtx context.Context, intentId string, paymentMethod string) (*PaymentIntent, error) {
+	//Settle a pending payment, then report it to the webhook. Settled
+	//payments are returned as they are.
+	key, err := fakePaymentIntentKey(appCtx, intentId)
+	if err != nil {
+		return nil, err
+	}
+	var fpi FakePaymentIntent
+	settled := false
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, key, &fpi); err != nil {
+			return err
+		}
+		settled = fpi.Status == PAYMENT_PENDING
+		if !settled {
+			return nil
+		}
+		fpi.Status = PAYMENT_SUCCEEDED
+		if paymentMethod == FAKE_PAYMENT_METHOD_DECLINED {
+			fpi.Status = PAYMENT_FAILED
+		}
+		fpi.UpdatedAt = time.Now()
+		_, err := datastore.Put(appCtx, key, &fpi)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	intent := copyFakePaymentIntent(key, &fpi)
+	if settled {
+		event := PAYMENT_EVENT_SUCCEEDED
+		if intent.Status == PAYMENT_FAILED {
+			event = PAYMENT_EVENT_FAILED
+		}
+		p.sendWebhook(appCtx, &fakePaymentEvent{Type: event, IntentId: intent.Id})
+	}
+	return intent, nil
+}
+
+func (p fakePaymentProvider) Refund(appCtx context.Context, intentId string, amount int64, reference string) (*PaymentRefund, error) {
+	//Give back amount of a succeeded payment, once per reference.
+	key, err := fakePaymentIntentKey(appCtx, intentId)
+	if err != nil {
+		return nil, err
+	}
+	var fpi FakePaymentIntent
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, key, &fpi); err != nil {
+			return err
+		}
+		for _, ref := range fpi.RefundReferences {
+			if ref == reference {
+				return nil
+			}
+		}
+		if fpi.Status != PAYMENT_SUCCEEDED {
+			return errors.New("fakepay: payment " + intentId + " is " + fpi.Status)
+		}
+		if amount <= 0 || fpi.Refunded + amount > fpi.Amount {
+			return errors.New("fakepay: refund of " + strconv.FormatInt(amount, 10) + " exceeds payment " + intentId)
+		}
+		fpi.Refunded += amount
+		fpi.RefundReferences = append(fpi.RefundReferences, reference)
+		if fpi.Refunded == fpi.Amount {
+			fpi.Status = PAYMENT_REFUNDED
+		}
+		fpi.UpdatedAt = time.Now()
+		_, err := datastore.Put(appCtx, key, &fpi)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &PaymentRefund{
+		Id: intentId + "_refund_" + reference,
+		IntentId: intentId,
+		Amount: amount,
+		Status: PAYMENT_SUCCEEDED,
+	}, nil
+}
+
+func (p fakePaymentProvider) sendWebhook(appCtx context.Context, event *fakePaymentEvent) {
+	//Queue a signed call of the payment webhook reporting event.
+	body, _ := json.Marshal(event)
+	task := &taskqueue.Task{
+		Path: "/payments/webhook/" + FAKE_PAYMENT_PROVIDER,
+		Payload: body,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			FAKE_PAYMENT_SIGNATURE_HEADER: {signToken("fakepay.webhook", string(body))},
+		},
+		Method: "POST",
+	}
+	if _, err := taskqueue.Add(appCtx, task, ""); err != nil {
+		applog.Warningf(appCtx, "fakepay webhook %s: %v", event.IntentId, err)
+	}
+}
+
+func (p fakePaymentProvider) VerifyWebhook(appCtx context.Context, r *http.Request) (*PaymentEvent, error) {
+	//Check the signature of a fake webhook call, and return the event with
+	//the intent as stored.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyToken(r.Header.Get(FAKE_PAYMENT_SIGNATURE_HEADER), "fakepay.webhook", string(body)) {
+		return nil, errors.New("fakepay: bad webhook signature")
+	}
+	var event fakePaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	key, err := fakePaymentIntentKey(appCtx, event.IntentId)
+	if err != nil {
+		return nil, err
+	}
+	var fpi FakePaymentIntent
+	if err := datastore.Get(appCtx, key, &fpi); err != nil {
+		return nil, err
+	}
+	return &PaymentEvent{Type: event.Type, Intent: copyFakePaymentIntent(key, &fpi)}, nil
+}
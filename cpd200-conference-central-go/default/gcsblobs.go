@@ -0,0 +1,141 @@
+package main
+
+/*
+gcsblobs.go -- a BlobStore on Google Cloud Storage, through its JSON API
+    with the app's service account
+
+Each blob is an object named after the blob in GCS_BLOB_BUCKET, or the
+app's default bucket when empty.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/file"
+	"google.golang.org/appengine/urlfetch"
+)
+
+//Name of the Cloud Storage store, for BLOB_STORE.
+const GCS_BLOB_STORE = "gcs"
+
+//OAuth scope of the app's service account for reading and writing objects.
+const GCS_SCOPE = "https://www.googleapis.com/auth/devstorage.read_write"
+
+type gcsBlobStore struct{}
+
+func init() {
+	blobStores[GCS_BLOB_STORE] = gcsBlobStore{}
+}
+
+func gcsBucket(appCtx context.Context) (string, error) {
+	//Return the bucket holding the blobs.
+	if GCS_BLOB_BUCKET != "" {
+		return GCS_BLOB_BUCKET, nil
+	}
+	bucket, err := file.DefaultBucketName(appCtx)
+	if err == nil && bucket == "" {
+		err = fmt.Errorf("the app has no default Cloud Storage bucket; set GCS_BLOB_BUCKET")
+	}
+	return bucket, err
+}
+
+func gcsDo(appCtx context.Context, method string, rawurl string, contentType string, data []byte) (*http.Response, error) {
+	//Send a request to the Cloud Storage JSON API as the app.
+	token, _, err := appengine.AccessToken(appCtx, GCS_SCOPE)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer " + token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return urlfetch.Client(appCtx).Do(req)
+}
+
+func gcsObjectUrl(appCtx context.Context, name string) (string, error) {
+	//Return the JSON API URL of the object holding the blob name.
+	bucket, err := gcsBucket(appCtx)
+	if err != nil {
+		return "", err
+	}
+	return "https://www.googleapis.com/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name), nil
+}
+
+func (s gcsBlobStore) Put(appCtx context.Context, name string, contentType string, data []byte) error {
+	//Upload the object in one request; an object only appears once
+	//it is complete.
+	if !validBlobName(name) {
+		return fmt.Errorf("invalid blob name %q", name)
+	}
+	bucket, err := gcsBucket(appCtx)
+	if err != nil {
+		return err
+	}
+	resp, err := gcsDo(appCtx, "POST", "https://www.googleapis.com/upload/storage/v1/b/" + url.PathEscape(bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(name), contentType, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud storage upload of %q replied %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (s gcsBlobStore) Get(appCtx context.Context, name string) ([]byte, string, error) {
+	//Download the object's data.
+	if !validBlobName(name) {
+		return nil, "", ErrBlobNotFound
+	}
+	objectUrl, err := gcsObjectUrl(appCtx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := gcsDo(appCtx, "GET", objectUrl + "?alt=media", "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("cloud storage download of %q replied %s", name, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (s gcsBlobStore) Delete(appCtx context.Context, name string) error {
+	//Delete the object.
+	if !validBlobName(name) {
+		return nil
+	}
+	objectUrl, err := gcsObjectUrl(appCtx, name)
+	if err != nil {
+		return err
+	}
+	resp, err := gcsDo(appCtx, "DELETE", objectUrl, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("cloud storage delete of %q replied %s", name, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+/*
+holds.go -- seats held for a few minutes while a user checks out,
+    and the cron job releasing holds that were never confirmed
+
+*/
+
+import (
+	"net/http"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//holdSeat duration in minutes, default and maximum.
+const (
+	DEFAULT_HOLD_MINUTES = 10
+	MAX_HOLD_MINUTES = 30
+)
+
+//Expired holds released per sweep; the cron runs every minute.
+const HOLD_SWEEP_BATCH = 500
+
+func copyHoldToForm(reg *Registration, websafeConferenceKey string) *HoldForm {
+	//Copy relevant fields from a held Registration to HoldForm.
+	return &HoldForm{
+		WebsafeConferenceKey: websafeConferenceKey,
+		WebsafeTicketTypeKey: reg.TicketTypeKey,
+		Quantity: registrationSeats(reg),
+		Amount: reg.Amount,
+		Discount: reg.Discount,
+		Currency: reg.Currency,
+		PaymentStatus: reg.PaymentStatus,
+		Status: reg.Status,
+		ExpiresAt: reg.HoldExpiresAt.Format(time.RFC3339),
+	}
+}
+
+func (h *ConferenceApi) HoldSeat(r *http.Request, hr *HoldRequest) (*HoldForm, error) {
+	//Reserve seats for the user for a few minutes; confirmHold turns them
+	//into a registration. Holding again returns the current hold unchanged.
+	minutes := hr.Minutes
+	if minutes <= 0 {
+		minutes = DEFAULT_HOLD_MINUTES
+	}
+	if minutes > MAX_HOLD_MINUTES {
+		return nil, endpoints.NewBadRequestError("minutes must be at most %d", MAX_HOLD_MINUTES)
+	}
+	rr := &RegistrationRequest{
+		WebsafeConferenceKey: hr.WebsafeConferenceKey,
+		WebsafeTicketTypeKey: hr.WebsafeTicketTypeKey,
+		Quantity: hr.Quantity,
+		PromoCode: hr.PromoCode,
+	}
+	reg, _, err := changeRegistration(r, rr, REGISTRATION_OP_HOLD, time.Duration(minutes) * time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return copyHoldToForm(reg, hr.WebsafeConferenceKey), nil
+}
+
+func (h *ConferenceApi) ConfirmHold(r *http.Request, cr *ConfRequest) (*BooleanMessage, error) {
+	//Register the user on the seat they hold, if the hold hasn't expired.
+	_, changed, err := changeRegistration(r, &RegistrationRequest{WebsafeConferenceKey: cr.WebsafeConferenceKey}, REGISTRATION_OP_CONFIRM_HOLD, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &BooleanMessage{Data: changed}, nil
+}
+
+func releaseExpiredHold(appCtx context.Context, regKey *datastore.Key, now time.Time) (string, error) {
+	//Give the seats of an expired hold back to its shards, and its use to
+	//its promo code, returning the websafe conference key if it was released.
+	//A paid hold is registered instead, or released with a full refund if
+	//it can't be.
+	var reg Registration
+	if err := datastore.Get(appCtx, regKey, &reg); err != nil {
+		return "", err
+	}
+	//the key is named after the user id, which a deleted account's
+	//Registration no longer has
+	userId := regKey.StringID()
+	refund := false
+	if reg.Status == REGISTRATION_HELD && reg.PaymentStatus == PAYMENT_SUCCEEDED {
+		if !deletedRegistration(regKey, &reg) {
+			//paid for, but the registration didn't complete
+			_, _, err := applyRegistration(appCtx, userId, &RegistrationRequest{WebsafeConferenceKey: reg.ConferenceKey}, REGISTRATION_OP_CONFIRM_HOLD, 0)
+			if _, refused := err.(*endpoints.APIError); !refused {
+				//registered, or left for the next run
+				return "", err
+			}
+			//e.g. the conference was cancelled
+			applog.Warningf(appCtx, "release hold %v: can't register it: %v", regKey, err)
+		}
+		refund = true
+	}
+	//the ticket type of a registration never changes
+	var typeKey, typeShardKey *datastore.Key
+	if reg.TicketTypeKey != "" {
+		var tt TicketType
+		var err error
+		if typeKey, err = datastore.DecodeKey(reg.TicketTypeKey); err != nil {
+			return "", err
+		}
+		if err := datastore.Get(appCtx, typeKey, &tt); err != nil {
+			return "", err
+		}
+		typeShardKey = ticketSeatShardKey(appCtx, typeKey, &tt, userId)
+	}
+	var promoKey *datastore.Key
+	if reg.PromoCode != "" {
+		confKey, err := datastore.DecodeKey(reg.ConferenceKey)
+		if err != nil {
+			return "", err
+		}
+		promoKey = promoCodeKey(appCtx, confKey, reg.PromoCode)
+	}
+	var websafeConferenceKey string
+	var before, after []byte
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		websafeConferenceKey = ""
+		if err := datastore.Get(appCtx, regKey, &reg); err != nil {
+			return err
+		}
+		if reg.Status != REGISTRATION_HELD || now.Before(reg.HoldExpiresAt) || (reg.PaymentStatus == PAYMENT_SUCCEEDED) != refund {
+			return nil
+		}
+		keys := []*datastore.Key{regKey, regKey.Parent()}
+		shards := make([]SeatShard, 1, 2)
+		if typeShardKey != nil {
+			keys = append(keys, typeShardKey)
+			shards = shards[:2]
+		}
+		if err := datastore.GetMulti(appCtx, keys[1:], shards); err != nil {
+			return err
+		}
+		before = auditSnapshot(&reg)
+		reg.Status = REGISTRATION_RELEASED
+		reg.CancelledAt = now
+		reg.UpdatedAt = now
+		if refund {
+			reg.RefundAmount = reg.Amount
+			reg.RefundStatus = REFUND_PENDING
+			if err := queueRefund(appCtx, regKey); err != nil {
+				return err
+			}
+		}
+		for i := range shards {
+			shards[i].Taken -= registrationSeats(&reg)
+		}
+		after = auditSnapshot(&reg)
+		if _, err := datastore.Put(appCtx, regKey, &reg); err != nil {
+			return err
+		}
+		if promoKey != nil {
+			var promo PromoCode
+			if err := datastore.Get(appCtx, promoKey, &promo); err != nil {
+				return err
+			}
+			promo.Used -= 1
+			if _, err := datastore.Put(appCtx, promoKey, &promo); err != nil {
+				return err
+			}
+		}
+		_, err := datastore.PutMulti(appCtx, keys[1:], shards)
+		if err == nil {
+			websafeConferenceKey = reg.ConferenceKey
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: typeShardKey != nil || promoKey != nil})
+	if err == nil && websafeConferenceKey != "" {
+		confKey, _ := datastore.DecodeKey(websafeConferenceKey)
+		recordAudit(appCtx, "cron", "registration.expire", regKey, confKey, before, after)
+		if typeKey != nil {
+			forgetTicketSeats(appCtx, typeKey)
+		}
+	}
+	return websafeConferenceKey, err
+}
+
+func ReleaseExpiredHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	//Release the seats of holds past their expiry back into SeatsAvailable.
+	if !checkCronRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	now := time.Now()
+	keys, err := datastore.NewQuery("Registration").
+		Filter("Status=", REGISTRATION_HELD).
+		Filter("HoldExpiresAt<", now).
+		KeysOnly().Limit(HOLD_SWEEP_BATCH).GetAll(appCtx, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "release holds: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	changed := make(map[string]bool)
+	failed := false
+	for _, key := range keys {
+		websafeConferenceKey, err := releaseExpiredHold(appCtx, key, now)
+		if err != nil {
+			//left for the next run
+			applog.Warningf(appCtx, "release hold %v: %v", key, err)
+			failed = true
+			continue
+		}
+		if websafeConferenceKey != "" {
+			changed[websafeConferenceKey] = true
+		}
+	}
+	for websafeConferenceKey := range changed {
+		publishSeatsChanged(appCtx, websafeConferenceKey)
+	}
+	applog.Infof(appCtx, "release holds: %d expired, %d conferences changed", len(keys), len(changed))
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,505 @@
+package main
+
+/*
+invoices.go -- numbered invoices for paid registrations, as HTML and PDF,
+    and the billing details organizers print on them
+
+An invoice is issued the first time the attendee asks for it, for the
+payment their registration holds, with the seller and buyer details of
+that moment; asking again returns the same invoice. Numbers run per
+conference, without gaps, from the counter kept on its BillingDetails.
+Ticket prices include VAT at the conference's VatPercent. Once paid, the
+invoice doubles as the receipt; a later refund is shown on it.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Limits of the free-form billing fields.
+const (
+	MAX_BILLING_ADDRESS_LENGTH = 500
+	MAX_VAT_ID_LENGTH = 32
+	MAX_INVOICE_PREFIX_LENGTH = 16
+)
+
+//How long a signed invoice download link stays valid.
+const INVOICE_LINK_TTL = 10 * time.Minute
+
+func billingDetailsKey(appCtx context.Context, confKey *datastore.Key) *datastore.Key {
+	//Return the key of a conference's BillingDetails.
+	return datastore.NewKey(appCtx, "BillingDetails", "billing", 0, confKey)
+}
+
+func invoiceKey(appCtx context.Context, regKey *datastore.Key, paymentIntentId string) *datastore.Key {
+	//Return the key of the Invoice for one payment of a Registration.
+	return datastore.NewKey(appCtx, "Invoice", regKey.Encode() + "/" + paymentIntentId, 0, nil)
+}
+
+func invoicePrefix(bd *BillingDetails, confKey *datastore.Key) string {
+	//Return the prefix of a conference's invoice numbers.
+	if bd.InvoicePrefix != "" {
+		return bd.InvoicePrefix
+	}
+	return "CC" + strconv.FormatInt(confKey.IntID(), 10)
+}
+
+func vatIncluded(amount int64, vatPercent float64) int64 {
+	//Return the VAT included in amount, rounded to the nearest minor unit.
+	if vatPercent <= 0 {
+		return 0
+	}
+	return int64(math.Floor(float64(amount) * vatPercent / (100 + vatPercent) + 0.5))
+}
+
+func copyBillingDetailsToForm(bd *BillingDetails) *BillingDetailsForm {
+	//Copy relevant fields from BillingDetails to BillingDetailsForm.
+	return &BillingDetailsForm{
+		Name: bd.Name,
+		Address: bd.Address,
+		Email: bd.Email,
+		VatId: bd.VatId,
+		VatPercent: bd.VatPercent,
+		InvoicePrefix: bd.InvoicePrefix,
+		InvoicesIssued: bd.InvoicesIssued,
+	}
+}
+
+func invoiceLocation(inv *Invoice) *time.Location {
+	//Return the time zone dates of an invoice are printed in.
+	return conferenceLocation(&Conference{TimeZone: inv.TimeZone})
+}
+
+func invoiceLink(appCtx context.Context, key *datastore.Key, userId string, format string) string {
+	//Return a short-lived signed link to an invoice in format "html" or "pdf".
+	//The browser can't send the OAuth token on a plain download.
+	invoice := key.Encode()
+	expires := strconv.FormatInt(time.Now().Add(INVOICE_LINK_TTL).Unix(), 10)
+	v := url.Values{
+		"invoice": {invoice},
+		"user": {userId},
+		"format": {format},
+		"expires": {expires},
+		"sig": {signToken("invoice", invoice, userId, expires)},
+	}
+	return "https://" + appengine.DefaultVersionHostname(appCtx) + "/export/invoice?" + v.Encode()
+}
+
+func copyInvoiceToForm(appCtx context.Context, inv *Invoice, key *datastore.Key) *InvoiceForm {
+	//Copy relevant fields from Invoice to InvoiceForm, with download links.
+	return &InvoiceForm{
+		Number: inv.Number,
+		IssuedAt: inv.IssuedAt.In(invoiceLocation(inv)).Format(time.RFC3339),
+		Amount: inv.Amount,
+		NetAmount: inv.NetAmount,
+		VatAmount: inv.VatAmount,
+		VatPercent: inv.VatPercent,
+		Currency: inv.Currency,
+		HtmlUrl: invoiceLink(appCtx, key, inv.UserId, "html"),
+		PdfUrl: invoiceLink(appCtx, key, inv.UserId, "pdf"),
+	}
+}
+
+func (h *ConferenceApi) SetBillingDetails(r *http.Request, br *BillingDetailsRequest) (*BillingDetailsForm, error) {
+	//Set who sells a conference's tickets; organizer only. Invoices already
+	//issued keep the details they were issued with.
+	_, confKey, user, err := getOrganizedConference(r, br.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	br.InvoicePrefix = strings.ToUpper(strings.TrimSpace(br.InvoicePrefix))
+	if err := validateBillingDetailsRequest(br); err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	key := billingDetailsKey(appCtx, confKey)
+	var bd BillingDetails
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		bd = BillingDetails{}
+		before = nil
+		err := datastore.Get(appCtx, key, &bd)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil {
+			before = auditSnapshot(&bd)
+		}
+		if bd.InvoicesIssued > 0 && br.InvoicePrefix != bd.InvoicePrefix {
+			return endpoints.NewConflictError("The invoice prefix can't change once invoices were issued")
+		}
+		bd.Name = strings.TrimSpace(br.Name)
+		bd.Address = strings.TrimSpace(br.Address)
+		bd.Email = br.Email
+		bd.VatId = strings.TrimSpace(br.VatId)
+		bd.VatPercent = br.VatPercent
+		bd.InvoicePrefix = br.InvoicePrefix
+		bd.UpdatedAt = time.Now()
+		after = auditSnapshot(&bd)
+		_, err = datastore.Put(appCtx, key, &bd)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "conference.setBillingDetails", key, confKey, before, after)
+	return copyBillingDetailsToForm(&bd), nil
+}
+
+func (h *ConferenceApi) GetBillingDetails(r *http.Request, cr *ConfRequest) (*BillingDetailsForm, error) {
+	//Return the billing details of a conference; organizer only.
+	_, confKey, _, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var bd BillingDetails
+	err = datastore.Get(appCtx, billingDetailsKey(appCtx, confKey), &bd)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return copyBillingDetailsToForm(&bd), nil
+}
+
+func (h *ConferenceApi) GetInvoice(r *http.Request, ir *InvoiceRequest) (*InvoiceForm, error) {
+	//Return the invoice of the current user's paid registration for a
+	//conference, issuing it the first time.
+	if err := validateInvoiceRequest(ir); err != nil {
+		return nil, err
+	}
+	prof, profKey, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, err
+	}
+	userId := profKey.StringID()
+	confKey, err := datastore.DecodeKey(ir.WebsafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	conf, err := ensureSeatShards(appCtx, confKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	regKey := registrationKey(appCtx, confKey, conf.SeatShards, userId)
+	var reg Registration
+	err = datastore.Get(appCtx, regKey, &reg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if reg.Amount == 0 || reg.PaidAt.IsZero() || deletedRegistration(regKey, &reg) {
+		return nil, endpoints.NewNotFoundError("You have no paid registration for this conference")
+	}
+
+	key := invoiceKey(appCtx, regKey, reg.PaymentIntentId)
+	var inv Invoice
+	err = datastore.Get(appCtx, key, &inv)
+	if err == nil {
+		return copyInvoiceToForm(appCtx, &inv, key), nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	description := conf.Name
+	if reg.TicketTypeKey != "" {
+		if tt, _, err := getConferenceTicketType(appCtx, confKey, reg.TicketTypeKey); err == nil {
+			description += " – " + tt.Name + " ticket"
+		}
+	}
+	email := prof.MainEmail
+	if email == "" {
+		email = userId
+	}
+	quantity := registrationSeats(&reg)
+	inv = Invoice{
+		ConferenceKey: confKey.Encode(),
+		RegistrationKey: regKey.Encode(),
+		UserId: userId,
+		ConferenceName: conf.Name,
+		BuyerName: prof.DisplayName,
+		BuyerEmail: email,
+		BuyerCompany: strings.TrimSpace(ir.Company),
+		BuyerAddress: strings.TrimSpace(ir.Address),
+		BuyerVatId: strings.TrimSpace(ir.VatId),
+		Description: description,
+		Quantity: quantity,
+		UnitPrice: (reg.Amount + reg.Discount) / int64(quantity),
+		Discount: reg.Discount,
+		Amount: reg.Amount,
+		Currency: reg.Currency,
+		PaymentProvider: reg.PaymentProvider,
+		PaymentIntentId: reg.PaymentIntentId,
+		PaidAt: reg.PaidAt,
+		TimeZone: conferenceLocation(conf).String(),
+	}
+
+	//the number is taken in the same transaction the invoice is stored in,
+	//so numbers are never skipped or used twice
+	bdKey := billingDetailsKey(appCtx, confKey)
+	issued := false
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		issued = false
+		var existing Invoice
+		err := datastore.Get(appCtx, key, &existing)
+		if err == nil {
+			inv = existing
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		var bd BillingDetails
+		if err := datastore.Get(appCtx, bdKey, &bd); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		bd.InvoicesIssued++
+		inv.Number = fmt.Sprintf("%s-%06d", invoicePrefix(&bd, confKey), bd.InvoicesIssued)
+		inv.SellerName = bd.Name
+		if inv.SellerName == "" {
+			inv.SellerName = conf.Name
+		}
+		inv.SellerAddress = bd.Address
+		inv.SellerEmail = bd.Email
+		inv.SellerVatId = bd.VatId
+		inv.VatPercent = bd.VatPercent
+		inv.VatAmount = vatIncluded(inv.Amount, inv.VatPercent)
+		inv.NetAmount = inv.Amount - inv.VatAmount
+		inv.IssuedAt = time.Now()
+		_, err = datastore.PutMulti(appCtx, []*datastore.Key{key, bdKey}, []interface{}{&inv, &bd})
+		issued = err == nil
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	if issued {
+		recordAudit(appCtx, userId, "invoice.issue", key, confKey, nil, auditSnapshot(&inv))
+	}
+	return copyInvoiceToForm(appCtx, &inv, key), nil
+}
+
+type invoiceView struct {
+	//invoiceView -- an Invoice formatted for printing
+	Invoice *Invoice
+	IssuedOn string
+	PaidOn string
+	UnitPrice string
+	Discount string
+	NetAmount string
+	VatAmount string
+	Amount string
+	VatPercent string
+	Refunded string
+	RefundedOn string
+	SellerAddress []string
+	BuyerAddress []string
+}
+
+func newInvoiceView(inv *Invoice, reg *Registration) *invoiceView {
+	//Format an invoice; reg, if it still holds the invoiced payment, adds
+	//the refund made on it.
+	loc := invoiceLocation(inv)
+	iv := &invoiceView{
+		Invoice: inv,
+		IssuedOn: inv.IssuedAt.In(loc).Format("2 January 2006"),
+		PaidOn: inv.PaidAt.In(loc).Format("2 January 2006"),
+		UnitPrice: formatAmount(inv.UnitPrice, inv.Currency),
+		Discount: formatAmount(inv.Discount, inv.Currency),
+		NetAmount: formatAmount(inv.NetAmount, inv.Currency),
+		VatAmount: formatAmount(inv.VatAmount, inv.Currency),
+		Amount: formatAmount(inv.Amount, inv.Currency),
+		VatPercent: strconv.FormatFloat(inv.VatPercent, 'f', -1, 64) + "%",
+		SellerAddress: strings.Split(inv.SellerAddress, "\n"),
+		BuyerAddress: strings.Split(inv.BuyerAddress, "\n"),
+	}
+	if reg != nil && reg.PaymentIntentId == inv.PaymentIntentId && reg.RefundStatus == REFUND_SUCCEEDED {
+		iv.Refunded = formatAmount(reg.RefundAmount, inv.Currency)
+		iv.RefundedOn = reg.RefundedAt.In(loc).Format("2 January 2006")
+	}
+	return iv
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Invoice {{.Invoice.Number}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; max-width: 50em; margin: 2em auto; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: .3em; text-align: left; border-bottom: 1px solid #ccc; }
+.amount { text-align: right; }
+.parties { display: flex; justify-content: space-between; margin: 2em 0; }
+</style></head><body>
+<h1>Invoice</h1>
+<p>Number: {{.Invoice.Number}}<br>Date: {{.IssuedOn}}</p>
+<div class="parties">
+<div><strong>{{.Invoice.SellerName}}</strong>{{range .SellerAddress}}<br>{{.}}{{end}}
+{{if .Invoice.SellerEmail}}<br>{{.Invoice.SellerEmail}}{{end}}
+{{if .Invoice.SellerVatId}}<br>VAT ID: {{.Invoice.SellerVatId}}{{end}}</div>
+<div><strong>Bill to</strong>
+{{if .Invoice.BuyerCompany}}<br>{{.Invoice.BuyerCompany}}{{end}}
+<br>{{.Invoice.BuyerName}}{{range .BuyerAddress}}<br>{{.}}{{end}}
+<br>{{.Invoice.BuyerEmail}}
+{{if .Invoice.BuyerVatId}}<br>VAT ID: {{.Invoice.BuyerVatId}}{{end}}</div>
+</div>
+<table>
+<tr><th>Description</th><th class="amount">Quantity</th><th class="amount">Unit price</th><th class="amount">Discount</th><th class="amount">Amount</th></tr>
+<tr><td>{{.Invoice.Description}}</td><td class="amount">{{.Invoice.Quantity}}</td><td class="amount">{{.UnitPrice}}</td><td class="amount">{{.Discount}}</td><td class="amount">{{.Amount}}</td></tr>
+<tr><td colspan="4" class="amount">Net</td><td class="amount">{{.NetAmount}}</td></tr>
+<tr><td colspan="4" class="amount">VAT {{.VatPercent}}</td><td class="amount">{{.VatAmount}}</td></tr>
+<tr><th colspan="4" class="amount">Total</th><th class="amount">{{.Amount}}</th></tr>
+</table>
+<p>Paid on {{.PaidOn}}; this invoice is also your receipt.</p>
+{{if .Refunded}}<p>Refunded {{.Refunded}} on {{.RefundedOn}}.</p>{{end}}
+</body></html>
+`))
+
+func truncateRunes(s string, n int) string {
+	//Return s cut to at most n characters, marking the cut with an ellipsis.
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n - 1]) + "…"
+}
+
+func renderInvoicePDF(iv *invoiceView) []byte {
+	//Lay an invoice out on an A4 page.
+	inv := iv.Invoice
+	const left, right = 50.0, PDF_A4_WIDTH - 50
+	d := newPDFDocument(PDF_A4_WIDTH, PDF_A4_HEIGHT)
+	d.text(left, 80, 24, PDF_FONT_BOLD, "Invoice")
+	d.text(360, 70, 10, PDF_FONT_REGULAR, "Number: " + inv.Number)
+	d.text(360, 84, 10, PDF_FONT_REGULAR, "Date: " + iv.IssuedOn)
+
+	//seller on the left, buyer on the right
+	seller := []string{inv.SellerName}
+	seller = append(seller, iv.SellerAddress...)
+	seller = append(seller, inv.SellerEmail)
+	if inv.SellerVatId != "" {
+		seller = append(seller, "VAT ID: " + inv.SellerVatId)
+	}
+	buyer := []string{"Bill to", inv.BuyerCompany, inv.BuyerName}
+	buyer = append(buyer, iv.BuyerAddress...)
+	buyer = append(buyer, inv.BuyerEmail)
+	if inv.BuyerVatId != "" {
+		buyer = append(buyer, "VAT ID: " + inv.BuyerVatId)
+	}
+	bottom := 0.0
+	for column, lines := range [][]string{seller, buyer} {
+		y := 130.0
+		for i, line := range lines {
+			if line == "" {
+				continue
+			}
+			font := PDF_FONT_REGULAR
+			if i == 0 {
+				font = PDF_FONT_BOLD
+			}
+			d.text(left + float64(column) * 260, y, 10, font, truncateRunes(line, 45))
+			y += 14
+		}
+		bottom = math.Max(bottom, y)
+	}
+
+	//one line, then the totals
+	y := bottom + 30
+	d.text(left, y, 10, PDF_FONT_BOLD, "Description")
+	d.text(290, y, 10, PDF_FONT_BOLD, "Qty")
+	d.text(330, y, 10, PDF_FONT_BOLD, "Unit price")
+	d.text(420, y, 10, PDF_FONT_BOLD, "Discount")
+	d.text(500, y, 10, PDF_FONT_BOLD, "Amount")
+	d.line(left, y + 6, right, y + 6, 0.5)
+	y += 22
+	d.text(left, y, 10, PDF_FONT_REGULAR, truncateRunes(inv.Description, 40))
+	d.monoTextRight(315, y, 9, strconv.Itoa(inv.Quantity))
+	d.monoTextRight(405, y, 9, iv.UnitPrice)
+	d.monoTextRight(485, y, 9, iv.Discount)
+	d.monoTextRight(right, y, 9, iv.Amount)
+	d.line(left, y + 8, right, y + 8, 0.5)
+	y += 24
+	for _, total := range [][2]string{{"Net", iv.NetAmount}, {"VAT " + iv.VatPercent, iv.VatAmount}, {"Total", iv.Amount}} {
+		font := PDF_FONT_REGULAR
+		if total[0] == "Total" {
+			font = PDF_FONT_BOLD
+		}
+		d.text(400, y, 10, font, total[0])
+		d.monoTextRight(right, y, 9, total[1])
+		y += 16
+	}
+
+	y += 20
+	d.text(left, y, 10, PDF_FONT_REGULAR, "Paid on " + iv.PaidOn + "; this invoice is also your receipt.")
+	if iv.Refunded != "" {
+		d.text(left, y + 16, 10, PDF_FONT_REGULAR, "Refunded " + iv.Refunded + " on " + iv.RefundedOn + ".")
+	}
+	return d.bytes()
+}
+
+func InvoiceHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve a signed link from getInvoice.
+	invoice := r.FormValue("invoice")
+	userId := r.FormValue("user")
+	expires := r.FormValue("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!verifyToken(r.FormValue("sig"), "invoice", invoice, userId, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired link"))
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	key, err := datastore.DecodeKey(invoice)
+	if err != nil || key.Kind() != "Invoice" {
+		http.NotFound(w, r)
+		return
+	}
+	var inv Invoice
+	if err := datastore.Get(appCtx, key, &inv); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if inv.UserId != userId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var reg *Registration
+	if regKey, err := datastore.DecodeKey(inv.RegistrationKey); err == nil {
+		reg = &Registration{}
+		if err := datastore.Get(appCtx, regKey, reg); err != nil {
+			reg = nil
+		}
+	}
+	iv := newInvoiceView(&inv, reg)
+
+	w.Header().Set("Cache-Control", "private, no-store")
+	if r.FormValue("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="invoice-` + inv.Number + `.pdf"`)
+		w.Write(renderInvoicePDF(iv))
+		return
+	}
+	var b bytes.Buffer
+	if err := invoiceTemplate.Execute(&b, iv); err != nil {
+		applog.Errorf(appCtx, "invoice %s: %v", inv.Number, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,102 @@
+package main
+
+/*
+localblobs.go -- a BlobStore on the local filesystem, for the development
+    server; App Engine instances can't write files
+
+Each blob is a file under LOCAL_BLOB_STORE_DIR named after the blob; its
+content type is told by its extension.
+
+*/
+
+import (
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+//Name of the local store, for BLOB_STORE.
+const LOCAL_BLOB_STORE = "local"
+
+type localBlobStore struct{}
+
+func init() {
+	blobStores[LOCAL_BLOB_STORE] = localBlobStore{}
+}
+
+func localBlobPath(name string) (string, error) {
+	//Return the file holding the blob name.
+	if !validBlobName(name) {
+		return "", endpoints.NewBadRequestError("invalid blob name %q", name)
+	}
+	dir := LOCAL_BLOB_STORE_DIR
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "conference-central-blobs")
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func (s localBlobStore) Put(appCtx context.Context, name string, contentType string, data []byte) error {
+	//Write the file, through a temporary file so readers never see part of it.
+	if !appengine.IsDevAppServer() {
+		return endpoints.NewInternalServerError("the local blob store only runs on the development server")
+	}
+	if mime.TypeByExtension(path.Ext(name)) != contentType {
+		return endpoints.NewInternalServerError("blob %q can't hold %s", name, contentType)
+	}
+	file, err := localBlobPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".upload")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s localBlobStore) Get(appCtx context.Context, name string) ([]byte, string, error) {
+	//Read the file.
+	file, err := localBlobPath(name)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, "", ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mime.TypeByExtension(path.Ext(name)), nil
+}
+
+func (s localBlobStore) Delete(appCtx context.Context, name string) error {
+	//Remove the file.
+	file, err := localBlobPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -1,5 +1,115 @@
 package main
 
 import (
+	"net/http"
+	"log"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/mail"
 )
 
+func SetAnnouncementHandler(w http.ResponseWriter, r *http.Request) {
+	//Set Announcement in Memcache.
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	header := r.Header.Get("X-AppEngine-Cron")
+	if header == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("attempt to access cron handler directly, missing custom App Engine header"))
+		return
+	}
+	cacheAnnouncement(r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func SendConfirmationEmailHandler(w http.ResponseWriter, r *http.Request) {
+	//Send email confirming Conference creation.
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	header := r.Header.Get("X-AppEngine-QueueName")
+	if header == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("attempt to access task handler directly, missing custom App Engine header"))
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	msg := &mail.Message{
+		To:	[]string{r.PostFormValue("email")},
+		Subject: "You created a new Conference!",
+		Body: "Hi, you have created a following conference:\r\n\r\n" +
+			r.PostFormValue("conferenceInfo"),
+	}
+	userId := r.PostFormValue("userId")
+	if userId == "" {
+		userId = r.PostFormValue("email")
+	}
+	err := sendEmail(appCtx, userId, EMAIL_CONFERENCE_CREATED, msg)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func checkTaskRequest(w http.ResponseWriter, r *http.Request) bool {
+	//Reject anything but a POST from the App Engine task queue.
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return false
+	}
+	header := r.Header.Get("X-AppEngine-QueueName")
+	if header == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("attempt to access task handler directly, missing custom App Engine header"))
+		return false
+	}
+	return true
+}
+
+func checkCronRequest(w http.ResponseWriter, r *http.Request) bool {
+	//Reject anything but a GET from the App Engine cron service.
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return false
+	}
+	header := r.Header.Get("X-AppEngine-Cron")
+	if header == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("attempt to access cron handler directly, missing custom App Engine header"))
+		return false
+	}
+	return true
+}
+
+func init() {
+	http.HandleFunc("/crons/set_announcement", SetAnnouncementHandler)
+	http.HandleFunc("/tasks/send_confirmation_email", SendConfirmationEmailHandler)
+	http.HandleFunc("/tasks/fanout_attendee_message", FanoutAttendeeMessageHandler)
+	http.HandleFunc("/tasks/send_attendee_message", SendAttendeeMessageHandler)
+	http.HandleFunc("/crons/send_search_digests", SendSearchDigestsHandler)
+	http.HandleFunc("/tasks/send_search_digest", SendSearchDigestHandler)
+	http.HandleFunc("/tasks/deliver_webhook", DeliverWebhookHandler)
+	http.HandleFunc("/unsubscribe", UnsubscribeHandler)
+	http.HandleFunc("/seats/stream", SeatsStreamHandler)
+	http.HandleFunc("/seats/poll", SeatsPollHandler)
+	http.HandleFunc("/calendar/conference/", ConferenceCalendarHandler)
+	http.HandleFunc("/calendar/feed/", CalendarFeedHandler)
+	http.HandleFunc("/export/attendees.csv", AttendeesCsvHandler)
+	http.HandleFunc("/export/invoice", InvoiceHandler)
+	http.HandleFunc("/export/badges.pdf", BadgesPdfHandler)
+	http.HandleFunc("/tasks/migrate_registrations", MigrateRegistrationsHandler)
+	http.HandleFunc("/tasks/refresh_seats_available", RefreshSeatsAvailableHandler)
+	http.HandleFunc("/crons/release_expired_holds", ReleaseExpiredHoldsHandler)
+	http.HandleFunc("/payments/webhook/", PaymentWebhookHandler)
+	http.HandleFunc("/tasks/refund_registration", RefundRegistrationHandler)
+	http.HandleFunc("/export/teeshirts.csv", TeeShirtsCsvHandler)
+	http.HandleFunc("/crons/send_tee_shirt_tallies", SendTeeShirtTalliesHandler)
+	http.HandleFunc("/tasks/send_tee_shirt_tally", SendTeeShirtTallyHandler)
+	http.HandleFunc("/avatars/", AvatarHandler)
+	http.HandleFunc("/export/mydata.json", MyDataHandler)
+	http.HandleFunc("/tasks/cancel_conference", CancelConferenceHandler)
+}
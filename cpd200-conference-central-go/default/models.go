@@ -11,12 +11,29 @@ type Profile struct {
 	DisplayName string	`json:"displayName"`
 	MainEmail string	`json:"mainEmail"`
 	TeeShirtSize string	`json:"teeShirtSize"`
+	Affiliation string	`json:"affiliation" datastore:",noindex"`	//company or organisation, printed on badges
+	JobTitle string	`json:"jobTitle" datastore:",noindex"`
+	Location string	`json:"location" datastore:",noindex"`
+	Bio string	`json:"bio" datastore:",noindex"`
+	Links []string	`json:"links" datastore:",noindex"`
+	AvatarBlob string	`json:"-" datastore:",noindex"`	//blob names, see avatars.go
+	AvatarThumbnailBlob string	`json:"-" datastore:",noindex"`
+	ConferenceKeysToAttend []string	`json:"conferenceKeysToAttend"`	//legacy, see migrateProfileRegistrations
+	EmailOptOuts []string	`json:"emailOptOuts"`
+	CalendarToken string	`json:"-"`
+	DeletedAt time.Time	`json:"deletedAt" datastore:",noindex"`	//anonymized by deleteMyAccount, see account.go
 }
 
 type ProfileMiniForm struct {
 	//ProfileMiniForm -- update Profile form message
 	DisplayName string	`json:"displayName"`
 	TeeShirtSize TeeShirtSize	`json:"teeShirtSize"`
+	Affiliation *string	`json:"affiliation"`	//left unchanged when absent, like the fields below
+	JobTitle *string	`json:"jobTitle"`
+	Location *string	`json:"location"`
+	Bio *string	`json:"bio"`
+	Links []string	`json:"links"`	//an empty list removes them
+	EmailPreferences *EmailPreferencesForm	`json:"emailPreferences"`
 }
 
 type ProfileForm struct {
@@ -24,6 +41,24 @@ type ProfileForm struct {
 	DisplayName  string	`json:"displayName"`
 	MainEmail string	`json:"mainEmail"`
 	TeeShirtSize TeeShirtSize	`json:"teeShirtSize"`
+	Affiliation string	`json:"affiliation"`
+	JobTitle string	`json:"jobTitle"`
+	Location string	`json:"location"`
+	Bio string	`json:"bio"`
+	Links []string	`json:"links"`
+	AvatarUrl string	`json:"avatarUrl"`
+	AvatarThumbnailUrl string	`json:"avatarThumbnailUrl"`
+	ConferenceKeysToAttend []string	`json:"conferenceKeysToAttend"`
+	EmailPreferences EmailPreferencesForm	`json:"emailPreferences"`
+}
+
+type EmailPreferencesForm struct {
+	//EmailPreferencesForm -- which emails the user wants to receive
+	ConferenceCreated bool	`json:"conferenceCreated"`
+	Reminders bool	`json:"reminders"`
+	Announcements bool	`json:"announcements"`
+	Digests bool	`json:"digests"`
+	OrganizerReports bool	`json:"organizerReports"`
 }
 
 type StringMessage struct {
@@ -36,6 +71,11 @@ type BooleanMessage struct {
 	Data bool `json:"data"`
 }
 
+type IntegerMessage struct {
+	//IntegerMessage -- outbound integer value message
+	Data int `json:"data"`
+}
+
 type Conference struct {
 	//Conference -- Conference object
 	Name string `json:"name"`
@@ -43,11 +83,21 @@ type Conference struct {
 	OrganizerUserId string `json:"organizerUserId"`
 	Topics []string `json:"topics"`
 	City string `json:"city"`
+	TimeZone string `json:"timeZone"`
 	StartDate time.Time `json:"startDate"`
 	Month int `json:"month"`
 	EndDate time.Time `json:"endDate"`
 	MaxAttendees int `json:"maxAttendees"`
-	SeatsAvailable int `json:"seatsAvailable"`
+	SeatsAvailable int `json:"seatsAvailable"`	//refreshed from the seat shards, see seatshards.go
+	CreatedAt time.Time `json:"createdAt"`
+	SeatShards int `json:"seatShards" datastore:",noindex"`
+	TicketTypes int `json:"ticketTypes" datastore:",noindex"`
+	FullRefundUntil time.Time `json:"fullRefundUntil" datastore:",noindex"`	//cancellation policy, see refunds.go
+	PartialRefundUntil time.Time `json:"partialRefundUntil" datastore:",noindex"`
+	PartialRefundPercent int `json:"partialRefundPercent" datastore:",noindex"`
+	CheckInStaff []string `json:"checkInStaff" datastore:",noindex"`	//user ids allowed to check attendees in, besides the organizer
+	TeeShirtTallySentAt time.Time `json:"teeShirtTallySentAt" datastore:",noindex"`
+	CancelledAt time.Time `json:"cancelledAt" datastore:",noindex"`	//see cancelConference
 }
 
 type ConferenceForm struct {
@@ -57,6 +107,7 @@ type ConferenceForm struct {
 	OrganizerUserId string `json:"organizerUserId"`
 	Topics []string `json:"topics"`
 	City string `json:"city"`
+	TimeZone string `json:"timeZone"`
 	StartDate string `json:"startDate"`
 	Month int `json:"month"`
 	MaxAttendees int `json:"maxAttendees,string,omitempty"`
@@ -64,6 +115,9 @@ type ConferenceForm struct {
 	EndDate string `json:"endDate"`
 	WebsafeKey string `json:"websafeKey"`
 	OrganizerDisplayName string `json:"organizerDisplayName"`
+	TicketTypes []TicketTypeForm `json:"ticketTypes,omitempty"`
+	CancellationPolicy *CancellationPolicyForm `json:"cancellationPolicy,omitempty"`
+	Cancelled bool `json:"cancelled"`
 }
 
 type ConferenceForms struct {
@@ -71,6 +125,13 @@ type ConferenceForms struct {
 	Items []ConferenceForm `json:"items"`
 }
 
+type SeatsMessage struct {
+	//SeatsMessage -- live SeatsAvailable update, see seats.go
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	SeatsAvailable int `json:"seatsAvailable"`
+	Version uint64 `json:"version,string"`
+}
+
 type ConferenceQueryForm struct {
 	//ConferenceQueryForm -- Conference query inbound form message
 	Field string `json:"field"`
@@ -83,6 +144,180 @@ type ConferenceQueryForms struct {
 	Filters []ConferenceQueryForm `json:"filters"`
 }
 
+type SavedSearch struct {
+	//SavedSearch -- named set of query filters, child of its Profile
+	Name string `json:"name"`
+	Filters []byte `json:"filters" datastore:",noindex"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type SavedSearchForm struct {
+	//SavedSearchForm -- SavedSearch inbound/outbound form message
+	Name string `json:"name"`
+	Filters []ConferenceQueryForm `json:"filters"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type SavedSearchForms struct {
+	//SavedSearchForms -- multiple SavedSearchForm outbound form message
+	Items []SavedSearchForm `json:"items"`
+}
+
+type SavedSearchRequest struct {
+	WebsafeSavedSearchKey string `json:"websafeSavedSearchKey"`
+}
+
+type CronRun struct {
+	//CronRun -- when a cron job last completed, keyed by job name
+	LastRun time.Time
+	RunUntil time.Time	//end of the run in progress, so a retry covers the same window
+}
+
+type Notification struct {
+	//Notification -- in-app notification, child of the Profile it is for
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Body string `json:"body" datastore:",noindex"`
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Read bool `json:"read"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type NotificationForm struct {
+	//NotificationForm -- Notification outbound form message
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Body string `json:"body"`
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Read bool `json:"read"`
+	CreatedAt string `json:"createdAt"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type NotificationForms struct {
+	//NotificationForms -- page of NotificationForm outbound form message
+	Items []NotificationForm `json:"items"`
+	NextCursor string `json:"nextCursor"`
+	UnreadCount int `json:"unreadCount"`
+}
+
+type NotificationQueryForm struct {
+	//NotificationQueryForm -- listNotifications inbound form message
+	UnreadOnly bool `json:"unreadOnly"`
+	Limit int `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type MarkReadForm struct {
+	//MarkReadForm -- markRead inbound form message; All marks every notification
+	WebsafeKeys []string `json:"websafeKeys"`
+	All bool `json:"all"`
+}
+
+type Webhook struct {
+	//Webhook -- organizer subscription to conference events, child of its Profile
+	URL string `json:"url"`
+	Secret string `json:"secret" datastore:",noindex"`
+	Events []string `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebhookForm struct {
+	//WebhookForm -- Webhook inbound/outbound form message; Secret is only
+	//sent back when the webhook is created
+	URL string `json:"url"`
+	Secret string `json:"secret"`
+	Events []string `json:"events"`
+	CreatedAt string `json:"createdAt"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type WebhookForms struct {
+	//WebhookForms -- multiple WebhookForm outbound form message
+	Items []WebhookForm `json:"items"`
+}
+
+type WebhookRequest struct {
+	WebsafeWebhookKey string `json:"websafeWebhookKey"`
+}
+
+type WebhookDelivery struct {
+	//WebhookDelivery -- one event sent to a Webhook, child of the Webhook
+	Event string `json:"event"`
+	Payload []byte `json:"payload" datastore:",noindex"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	LastStatusCode int `json:"lastStatusCode"`
+	LastError string `json:"lastError" datastore:",noindex"`
+	CreatedAt time.Time `json:"createdAt"`
+	DeliveredAt time.Time `json:"deliveredAt"`
+}
+
+type WebhookDeliveryForm struct {
+	//WebhookDeliveryForm -- WebhookDelivery outbound form message
+	Event string `json:"event"`
+	Payload string `json:"payload"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	LastStatusCode int `json:"lastStatusCode"`
+	LastError string `json:"lastError"`
+	CreatedAt string `json:"createdAt"`
+	DeliveredAt string `json:"deliveredAt"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type WebhookDeliveryForms struct {
+	//WebhookDeliveryForms -- multiple WebhookDeliveryForm outbound form message
+	Items []WebhookDeliveryForm `json:"items"`
+}
+
+type AuditEvent struct {
+	//AuditEvent -- append-only record of one mutation, see audit.go
+	Actor string `json:"actor"`
+	Action string `json:"action"`
+	EntityKind string `json:"entityKind"`
+	EntityKey string `json:"entityKey"`
+	ConferenceKey string `json:"conferenceKey"`
+	Before []byte `json:"before" datastore:",noindex"`
+	After []byte `json:"after" datastore:",noindex"`
+	Diff []byte `json:"diff" datastore:",noindex"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type AuditEventForm struct {
+	//AuditEventForm -- AuditEvent outbound form message; Before, After
+	//and Diff are JSON documents
+	Actor string `json:"actor"`
+	Action string `json:"action"`
+	EntityKind string `json:"entityKind"`
+	EntityKey string `json:"entityKey"`
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Before string `json:"before"`
+	After string `json:"after"`
+	Diff string `json:"diff"`
+	Timestamp string `json:"timestamp"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type AuditEventForms struct {
+	//AuditEventForms -- page of AuditEventForm outbound form message
+	Items []AuditEventForm `json:"items"`
+	NextCursor string `json:"nextCursor"`
+}
+
+type AuditQueryForm struct {
+	//AuditQueryForm -- getAuditEvents inbound form message; Since and
+	//Until are RFC3339 dates
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Actor string `json:"actor"`
+	Action string `json:"action"`
+	EntityKey string `json:"entityKey"`
+	Since string `json:"since"`
+	Until string `json:"until"`
+	Limit int `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
 type TeeShirtSize int
 
 const (
@@ -104,6 +339,9 @@ const (
 	XXXL_W
 )
 
+//TEE_SHIRT_SIZE_INVALID -- unknown size received from a client; never stored
+const TEE_SHIRT_SIZE_INVALID TeeShirtSize = -1
+
 var teeShirtSizeEnumTypeNames = map[TeeShirtSize]string{
 	NOT_SPECIFIED: "NOT_SPECIFIED",
 	XS_M: "XS_M",
@@ -129,7 +367,14 @@ func (m TeeShirtSize) MarshalJSON() ([]byte, error){
 
 func (m *TeeShirtSize) UnmarshalJSON(value []byte) error {
 	str := strings.Replace(string(value), "\"", "", -1)
+	if str == "" || str == "null" {
+		*m = NOT_SPECIFIED
+		return nil
+	}
 	*m = StringEnumToTeeShirtSize(str)
+	if *m == NOT_SPECIFIED && str != teeShirtSizeEnumTypeNames[NOT_SPECIFIED] {
+		*m = TEE_SHIRT_SIZE_INVALID
+	}
 	return nil
 }
 
@@ -160,3 +405,466 @@ type LatestAlert struct {
 	//LatestAlert -- Latest alert message
 	Content string `json:"content"`
 }
+
+type AttendeeMessage struct {
+	//AttendeeMessage -- stored copy of an organizer broadcast, child of its Conference
+	Subject string `json:"subject"`
+	Body string `json:"body" datastore:",noindex"`
+	OrganizerUserId string `json:"organizerUserId"`
+	OrganizerEmail string `json:"organizerEmail"`
+	Recipients int `json:"recipients"`
+	SentAt time.Time `json:"sentAt"`
+}
+
+type AttendeeMessageRequest struct {
+	//AttendeeMessageRequest -- sendAttendeeMessage inbound message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Subject string `json:"subject"`
+	Body string `json:"body"`
+	Preview bool `json:"preview"`
+}
+
+type AttendeeMessageForm struct {
+	//AttendeeMessageForm -- organizer broadcast outbound message
+	Subject string `json:"subject"`
+	Body string `json:"body"`
+	Recipients int `json:"recipients"`
+	SentAt string `json:"sentAt"`
+	Preview bool `json:"preview"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type AttendeeMessageForms struct {
+	//AttendeeMessageForms -- multiple AttendeeMessageForm outbound message
+	Items []AttendeeMessageForm `json:"items"`
+}
+
+type CalendarFeedForm struct {
+	//CalendarFeedForm -- secret calendar subscription URL outbound form message
+	Url string `json:"url"`
+	WebcalUrl string `json:"webcalUrl"`
+}
+
+type AttendeeForm struct {
+	//AttendeeForm -- one getConferenceAttendees result
+	DisplayName string `json:"displayName"`
+	MainEmail string `json:"mainEmail"`
+	TeeShirtSize TeeShirtSize `json:"teeShirtSize"`
+}
+
+type AttendeeForms struct {
+	//AttendeeForms -- page of AttendeeForm outbound form message
+	Items []AttendeeForm `json:"items"`
+	NextCursor string `json:"nextCursor"`
+}
+
+type AttendeeQueryForm struct {
+	//AttendeeQueryForm -- getConferenceAttendees inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Limit int `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type Registration struct {
+	//Registration -- a Profile's registration for a Conference, child of the
+	//attendee's SeatShard with the attendee's userId as its name
+	UserId string `json:"userId"`
+	ConferenceKey string `json:"conferenceKey"`
+	TicketTypeKey string `json:"ticketTypeKey"`
+	Quantity int `json:"quantity" datastore:",noindex"`	//seats taken; 0 for registrations older than ticket types, which took one
+	PromoCode string `json:"promoCode"`
+	Amount int64 `json:"amount" datastore:",noindex"`	//due, in minor units of Currency, after Discount
+	Discount int64 `json:"discount" datastore:",noindex"`
+	Currency string `json:"currency" datastore:",noindex"`
+	PaymentProvider string `json:"paymentProvider" datastore:",noindex"`
+	PaymentIntentId string `json:"paymentIntentId" datastore:",noindex"`
+	PaymentStatus string `json:"paymentStatus" datastore:",noindex"`
+	PaidAt time.Time `json:"paidAt" datastore:",noindex"`
+	RefundAmount int64 `json:"refundAmount" datastore:",noindex"`
+	RefundStatus string `json:"refundStatus" datastore:",noindex"`
+	RefundId string `json:"refundId" datastore:",noindex"`
+	RefundedAt time.Time `json:"refundedAt" datastore:",noindex"`
+	TicketId string `json:"-"`	//secret part of the ticket token, see checkin.go
+	CheckedInAt time.Time `json:"checkedInAt" datastore:",noindex"`
+	CheckedInBy string `json:"checkedInBy" datastore:",noindex"`
+	Status string `json:"status"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	HeldAt time.Time `json:"heldAt" datastore:",noindex"`
+	HoldExpiresAt time.Time `json:"holdExpiresAt"`
+	CancelledAt time.Time `json:"cancelledAt" datastore:",noindex"`
+	UpdatedAt time.Time `json:"updatedAt" datastore:",noindex"`
+}
+
+type SeatsCheckRequest struct {
+	//SeatsCheckRequest -- checkSeats inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Repair bool `json:"repair"`
+}
+
+type SeatsCheckForm struct {
+	//SeatsCheckForm -- checkSeats outbound form message
+	MaxAttendees int `json:"maxAttendees"`
+	Allocated int `json:"allocated"`
+	Registered int `json:"registered"`
+	SeatsAvailable int `json:"seatsAvailable"`
+	ExpectedSeatsAvailable int `json:"expectedSeatsAvailable"`
+	Consistent bool `json:"consistent"`
+	Repaired bool `json:"repaired"`
+}
+
+type SeatShard struct {
+	//SeatShard -- Allocated seats of a Conference, Taken of them registered
+	ConferenceKey string `json:"conferenceKey" datastore:",noindex"`
+	Allocated int `json:"allocated" datastore:",noindex"`
+	Taken int `json:"taken" datastore:",noindex"`
+}
+
+type HoldRequest struct {
+	//HoldRequest -- holdSeat inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	WebsafeTicketTypeKey string `json:"websafeTicketTypeKey"`
+	Quantity int `json:"quantity"`
+	PromoCode string `json:"promoCode"`
+	Minutes int `json:"minutes"`
+}
+
+type HoldForm struct {
+	//HoldForm -- holdSeat outbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	WebsafeTicketTypeKey string `json:"websafeTicketTypeKey"`
+	Quantity int `json:"quantity"`
+	Amount int64 `json:"amount,string"`
+	Discount int64 `json:"discount,string"`
+	Currency string `json:"currency"`
+	PaymentStatus string `json:"paymentStatus"`
+	Status string `json:"status"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+type RegistrationRequest struct {
+	//RegistrationRequest -- registerForConference inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	WebsafeTicketTypeKey string `json:"websafeTicketTypeKey"`
+	Quantity int `json:"quantity"`
+	PromoCode string `json:"promoCode"`
+}
+
+type TicketType struct {
+	//TicketType -- a kind of ticket for a Conference, e.g. early bird or
+	//VIP, and its own pool of Capacity seats; child of the Conference
+	Name string `json:"name"`
+	Description string `json:"description" datastore:",noindex"`
+	Price int64 `json:"price"`	//in minor units of Currency, e.g. cents
+	Currency string `json:"currency" datastore:",noindex"`
+	Capacity int `json:"capacity" datastore:",noindex"`
+	SalesStart time.Time `json:"salesStart" datastore:",noindex"`
+	SalesEnd time.Time `json:"salesEnd" datastore:",noindex"`
+	MaxPerUser int `json:"maxPerUser" datastore:",noindex"`
+	SeatShards int `json:"seatShards" datastore:",noindex"`
+	CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+}
+
+type TicketTypeForm struct {
+	//TicketTypeForm -- TicketType outbound form message
+	Name string `json:"name"`
+	Description string `json:"description"`
+	Price int64 `json:"price,string"`
+	Currency string `json:"currency"`
+	Capacity int `json:"capacity"`
+	SeatsAvailable int `json:"seatsAvailable"`
+	SalesStart string `json:"salesStart"`
+	SalesEnd string `json:"salesEnd"`
+	MaxPerUser int `json:"maxPerUser"`
+	OnSale bool `json:"onSale"`
+	WebsafeKey string `json:"websafeKey"`
+}
+
+type TicketTypeForms struct {
+	//TicketTypeForms -- multiple TicketTypeForm outbound form message
+	Items []TicketTypeForm `json:"items"`
+}
+
+type TicketTypeRequest struct {
+	//TicketTypeRequest -- createTicketType inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Name string `json:"name"`
+	Description string `json:"description"`
+	Price int64 `json:"price,string"`
+	Currency string `json:"currency"`
+	Capacity int `json:"capacity"`
+	SalesStart string `json:"salesStart"`
+	SalesEnd string `json:"salesEnd"`
+	MaxPerUser int `json:"maxPerUser"`
+}
+
+type PromoCode struct {
+	//PromoCode -- a discount on a Conference's tickets, a root entity named
+	//after the websafe conference key and the upper-cased Code
+	Code string `json:"code"`
+	ConferenceKey string `json:"conferenceKey"`
+	PercentOff int `json:"percentOff" datastore:",noindex"`
+	AmountOff int64 `json:"amountOff" datastore:",noindex"`	//per ticket, in minor units of the ticket's currency
+	MaxUses int `json:"maxUses" datastore:",noindex"`	//0 for unlimited
+	Used int `json:"used" datastore:",noindex"`
+	ExpiresAt time.Time `json:"expiresAt" datastore:",noindex"`
+	TicketTypeKeys []string `json:"ticketTypeKeys" datastore:",noindex"`	//empty for all ticket types
+	CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+}
+
+type PromoCodeForm struct {
+	//PromoCodeForm -- PromoCode outbound form message
+	Code string `json:"code"`
+	PercentOff int `json:"percentOff"`
+	AmountOff int64 `json:"amountOff,string"`
+	MaxUses int `json:"maxUses"`
+	Used int `json:"used"`
+	ExpiresAt string `json:"expiresAt"`
+	WebsafeTicketTypeKeys []string `json:"websafeTicketTypeKeys"`
+	Active bool `json:"active"`
+}
+
+type PromoCodeForms struct {
+	//PromoCodeForms -- multiple PromoCodeForm outbound form message
+	Items []PromoCodeForm `json:"items"`
+}
+
+type PromoCodeRequest struct {
+	//PromoCodeRequest -- createPromoCode inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Code string `json:"code"`
+	PercentOff int `json:"percentOff"`
+	AmountOff int64 `json:"amountOff,string"`
+	MaxUses int `json:"maxUses"`
+	ExpiresAt string `json:"expiresAt"`
+	WebsafeTicketTypeKeys []string `json:"websafeTicketTypeKeys"`
+}
+
+type PaymentForm struct {
+	//PaymentForm -- payForHold outbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Provider string `json:"provider"`
+	IntentId string `json:"intentId"`
+	ClientSecret string `json:"clientSecret"`
+	Amount int64 `json:"amount,string"`
+	Currency string `json:"currency"`
+	Status string `json:"status"`
+	HoldExpiresAt string `json:"holdExpiresAt"`
+}
+
+type PaymentConfirmRequest struct {
+	//PaymentConfirmRequest -- confirmPayment inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	PaymentMethod string `json:"paymentMethod"`
+}
+
+type FakePaymentIntent struct {
+	//FakePaymentIntent -- a payment of the fake payment provider, see fakepay.go
+	Amount int64 `json:"amount" datastore:",noindex"`
+	Currency string `json:"currency" datastore:",noindex"`
+	Reference string `json:"reference" datastore:",noindex"`
+	Description string `json:"description" datastore:",noindex"`
+	Status string `json:"status" datastore:",noindex"`
+	Refunded int64 `json:"refunded" datastore:",noindex"`
+	RefundReferences []string `json:"refundReferences" datastore:",noindex"`
+	CreatedAt time.Time `json:"createdAt" datastore:",noindex"`
+	UpdatedAt time.Time `json:"updatedAt" datastore:",noindex"`
+}
+
+type CancellationPolicyForm struct {
+	//CancellationPolicyForm -- refunds given on unregistration, outbound form message
+	FullRefundUntil string `json:"fullRefundUntil"`
+	PartialRefundUntil string `json:"partialRefundUntil"`
+	PartialRefundPercent int `json:"partialRefundPercent"`
+}
+
+type CancellationPolicyRequest struct {
+	//CancellationPolicyRequest -- setCancellationPolicy inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	FullRefundUntil string `json:"fullRefundUntil"`
+	PartialRefundUntil string `json:"partialRefundUntil"`
+	PartialRefundPercent int `json:"partialRefundPercent"`
+}
+
+type RegistrationForm struct {
+	//RegistrationForm -- a user's Registration outbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	WebsafeTicketTypeKey string `json:"websafeTicketTypeKey"`
+	Quantity int `json:"quantity"`
+	Status string `json:"status"`
+	Amount int64 `json:"amount,string"`
+	Discount int64 `json:"discount,string"`
+	Currency string `json:"currency"`
+	PaymentStatus string `json:"paymentStatus"`
+	RefundAmount int64 `json:"refundAmount,string"`
+	RefundStatus string `json:"refundStatus"`
+}
+
+type BillingDetails struct {
+	//BillingDetails -- who sells a conference's tickets, printed on its
+	//invoices; child of the Conference, which it also numbers invoices for
+	Name string `json:"name" datastore:",noindex"`
+	Address string `json:"address" datastore:",noindex"`
+	Email string `json:"email" datastore:",noindex"`
+	VatId string `json:"vatId" datastore:",noindex"`
+	VatPercent float64 `json:"vatPercent" datastore:",noindex"`	//included in ticket prices
+	InvoicePrefix string `json:"invoicePrefix" datastore:",noindex"`
+	InvoicesIssued int64 `json:"invoicesIssued" datastore:",noindex"`
+	UpdatedAt time.Time `json:"updatedAt" datastore:",noindex"`
+}
+
+type BillingDetailsForm struct {
+	//BillingDetailsForm -- BillingDetails outbound form message
+	Name string `json:"name"`
+	Address string `json:"address"`
+	Email string `json:"email"`
+	VatId string `json:"vatId"`
+	VatPercent float64 `json:"vatPercent"`
+	InvoicePrefix string `json:"invoicePrefix"`
+	InvoicesIssued int64 `json:"invoicesIssued"`
+}
+
+type BillingDetailsRequest struct {
+	//BillingDetailsRequest -- setBillingDetails inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Name string `json:"name"`
+	Address string `json:"address"`
+	Email string `json:"email"`
+	VatId string `json:"vatId"`
+	VatPercent float64 `json:"vatPercent"`
+	InvoicePrefix string `json:"invoicePrefix"`
+}
+
+type Invoice struct {
+	//Invoice -- a numbered invoice for one payment of a Registration, with
+	//the seller and buyer details as they were when it was issued
+	Number string `json:"number"`
+	ConferenceKey string `json:"conferenceKey"`
+	RegistrationKey string `json:"registrationKey" datastore:",noindex"`
+	UserId string `json:"userId"`
+	ConferenceName string `json:"conferenceName" datastore:",noindex"`
+	SellerName string `json:"sellerName" datastore:",noindex"`
+	SellerAddress string `json:"sellerAddress" datastore:",noindex"`
+	SellerEmail string `json:"sellerEmail" datastore:",noindex"`
+	SellerVatId string `json:"sellerVatId" datastore:",noindex"`
+	BuyerName string `json:"buyerName" datastore:",noindex"`
+	BuyerEmail string `json:"buyerEmail" datastore:",noindex"`
+	BuyerCompany string `json:"buyerCompany" datastore:",noindex"`
+	BuyerAddress string `json:"buyerAddress" datastore:",noindex"`
+	BuyerVatId string `json:"buyerVatId" datastore:",noindex"`
+	Description string `json:"description" datastore:",noindex"`
+	Quantity int `json:"quantity" datastore:",noindex"`
+	UnitPrice int64 `json:"unitPrice" datastore:",noindex"`
+	Discount int64 `json:"discount" datastore:",noindex"`
+	Amount int64 `json:"amount" datastore:",noindex"`	//paid, VAT included
+	NetAmount int64 `json:"netAmount" datastore:",noindex"`
+	VatAmount int64 `json:"vatAmount" datastore:",noindex"`
+	VatPercent float64 `json:"vatPercent" datastore:",noindex"`
+	Currency string `json:"currency" datastore:",noindex"`
+	PaymentProvider string `json:"paymentProvider" datastore:",noindex"`
+	PaymentIntentId string `json:"paymentIntentId" datastore:",noindex"`
+	PaidAt time.Time `json:"paidAt" datastore:",noindex"`
+	TimeZone string `json:"timeZone" datastore:",noindex"`	//the conference's, for printing dates
+	IssuedAt time.Time `json:"issuedAt"`
+}
+
+type InvoiceRequest struct {
+	//InvoiceRequest -- getInvoice inbound form message; the buyer's company
+	//details are only used when the invoice is first issued
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Company string `json:"company"`
+	Address string `json:"address"`
+	VatId string `json:"vatId"`
+}
+
+type InvoiceForm struct {
+	//InvoiceForm -- getInvoice outbound form message, with short-lived
+	//download links
+	Number string `json:"number"`
+	IssuedAt string `json:"issuedAt"`
+	Amount int64 `json:"amount,string"`
+	NetAmount int64 `json:"netAmount,string"`
+	VatAmount int64 `json:"vatAmount,string"`
+	VatPercent float64 `json:"vatPercent"`
+	Currency string `json:"currency"`
+	HtmlUrl string `json:"htmlUrl"`
+	PdfUrl string `json:"pdfUrl"`
+}
+
+type TicketForm struct {
+	//TicketForm -- getTicket outbound form message; QrCode is a PNG data URI
+	//of Token
+	Token string `json:"token"`
+	QrCode string `json:"qrCode"`
+	Quantity int `json:"quantity"`
+	CheckedInAt string `json:"checkedInAt"`
+}
+
+type CheckInRequest struct {
+	//CheckInRequest -- checkIn inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Token string `json:"token"`
+}
+
+type CheckInForm struct {
+	//CheckInForm -- checkIn outbound form message, the attendee let in
+	DisplayName string `json:"displayName"`
+	MainEmail string `json:"mainEmail"`
+	TicketTypeName string `json:"ticketTypeName"`
+	Quantity int `json:"quantity"`
+	CheckedInAt string `json:"checkedInAt"`
+}
+
+type CheckInStaffRequest struct {
+	//CheckInStaffRequest -- setCheckInStaff inbound form message
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	Emails []string `json:"emails"`
+}
+
+type CheckInStaffForm struct {
+	//CheckInStaffForm -- setCheckInStaff outbound form message
+	Emails []string `json:"emails"`
+}
+
+type BadgesRequest struct {
+	//BadgesRequest -- getBadgesPdfUrl inbound form message, the layout of
+	//the badge sheets
+	WebsafeConferenceKey string `json:"websafeConferenceKey"`
+	PageSize string `json:"pageSize"`
+	Columns int `json:"columns"`
+	Rows int `json:"rows"`
+	HideQrCode bool `json:"hideQrCode"`
+	HideAffiliation bool `json:"hideAffiliation"`
+	HideTeeShirtSize bool `json:"hideTeeShirtSize"`
+}
+
+type TeeShirtSizeCount struct {
+	//TeeShirtSizeCount -- attendees wearing one tee-shirt size
+	Size TeeShirtSize `json:"size"`
+	Count int `json:"count"`
+}
+
+type TeeShirtReportForm struct {
+	//TeeShirtReportForm -- getTeeShirtReport outbound form message; every
+	//size is listed, NOT_SPECIFIED first
+	Items []TeeShirtSizeCount `json:"items"`
+	Attendees int `json:"attendees"`
+	GuestSeats int `json:"guestSeats"`
+}
+
+type AvatarRequest struct {
+	//AvatarRequest -- setAvatar inbound form message
+	Data string `json:"data"`	//the image, base64 or as a data: URI
+}
+
+type DeleteAccountRequest struct {
+	//DeleteAccountRequest -- deleteMyAccount inbound form message
+	ConfirmEmail string `json:"confirmEmail"`	//the user's own email, against accidents
+	TransferConferencesTo string `json:"transferConferencesTo"`	//email of the new organizer of upcoming conferences; they are cancelled when empty
+}
+
+type DeleteAccountForm struct {
+	//DeleteAccountForm -- deleteMyAccount outbound form message
+	Unregistered int `json:"unregistered"`
+	Transferred int `json:"transferred"`
+	Cancelled int `json:"cancelled"`
+}
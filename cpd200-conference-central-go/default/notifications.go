@@ -0,0 +1,185 @@
+package main
+
+/*
+notifications.go -- per-profile in-app notification inbox
+
+*/
+
+import (
+	"net/http"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Notification types.
+const (
+	NOTIFICATION_REGISTERED = "REGISTERED"
+	NOTIFICATION_UNREGISTERED = "UNREGISTERED"
+	NOTIFICATION_CONFERENCE_CANCELLED = "CONFERENCE_CANCELLED"
+	NOTIFICATION_ORGANIZER_MESSAGE = "ORGANIZER_MESSAGE"
+	NOTIFICATION_REFUNDED = "REFUNDED"
+	NOTIFICATION_CONFERENCE_TRANSFERRED = "CONFERENCE_TRANSFERRED"
+)
+
+//listNotifications page size, default and maximum.
+const (
+	DEFAULT_NOTIFICATIONS_LIMIT = 20
+	MAX_NOTIFICATIONS_LIMIT = 100
+)
+
+func addNotification(appCtx context.Context, userId string, n *Notification) error {
+	//Store a new unread Notification in userId's inbox.
+	n.Read = false
+	n.CreatedAt = time.Now()
+	profKey := datastore.NewKey(appCtx, "Profile", userId, 0, nil)
+	_, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "Notification", profKey), n)
+	if err != nil {
+		applog.Errorf(appCtx, "notify %s: %v", userId, err)
+	}
+	return err
+}
+
+func copyNotificationToForm(n *Notification, keyStr string) *NotificationForm {
+	//Copy relevant fields from Notification to NotificationForm.
+	return &NotificationForm{
+		Type: n.Type,
+		Title: n.Title,
+		Body: n.Body,
+		WebsafeConferenceKey: n.WebsafeConferenceKey,
+		Read: n.Read,
+		CreatedAt: n.CreatedAt.Format(time.RFC3339),
+		WebsafeKey: keyStr,
+	}
+}
+
+func unreadNotificationsQuery(profKey *datastore.Key) *datastore.Query {
+	//Return a query over the unread notifications of a Profile.
+	return datastore.NewQuery("Notification").Ancestor(profKey).Filter("Read=", false)
+}
+
+func getUserProfileKey(r *http.Request) (*datastore.Key, error) {
+	//Return the Profile key of the authed user.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	return datastore.NewKey(appCtx, "Profile", getUserId(user, ""), 0, nil), nil
+}
+
+func (h *ConferenceApi) ListNotifications(r *http.Request, nqf *NotificationQueryForm) (*NotificationForms, error) {
+	//Return a page of the user's notifications, newest first.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	q := datastore.NewQuery("Notification").Ancestor(profKey)
+	if nqf.UnreadOnly {
+		q = unreadNotificationsQuery(profKey)
+	}
+	limit := nqf.Limit
+	if limit <= 0 {
+		limit = DEFAULT_NOTIFICATIONS_LIMIT
+	}
+	if limit > MAX_NOTIFICATIONS_LIMIT {
+		limit = MAX_NOTIFICATIONS_LIMIT
+	}
+	q = q.Order("-CreatedAt").Limit(limit)
+	if nqf.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(nqf.Cursor)
+		if err != nil {
+			return nil, endpoints.NewBadRequestError("invalid cursor")
+		}
+		q = q.Start(cursor)
+	}
+
+	forms := &NotificationForms{
+		Items: make([]NotificationForm, 0, limit),
+	}
+	it := q.Run(appCtx)
+	for {
+		var n Notification
+		key, err := it.Next(&n)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		forms.Items = append(forms.Items, *copyNotificationToForm(&n, key.Encode()))
+	}
+	if len(forms.Items) == limit {
+		if cursor, err := it.Cursor(); err == nil {
+			forms.NextCursor = cursor.String()
+		}
+	}
+	forms.UnreadCount, err = unreadNotificationsQuery(profKey).KeysOnly().Count(appCtx)
+	if err != nil {
+		return nil, err
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) GetUnreadNotificationCount(r *http.Request) (*IntegerMessage, error) {
+	//Return how many of the user's notifications are unread; cheap enough to poll.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	count, err := unreadNotificationsQuery(profKey).KeysOnly().Count(appCtx)
+	if err != nil {
+		return nil, err
+	}
+	return &IntegerMessage{Data: count}, nil
+}
+
+func (h *ConferenceApi) MarkRead(r *http.Request, mrf *MarkReadForm) (*IntegerMessage, error) {
+	//Mark the given (or all) notifications read; returns the new unread count.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var keys []*datastore.Key
+	if mrf.All {
+		keys, err = unreadNotificationsQuery(profKey).KeysOnly().GetAll(appCtx, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, k := range mrf.WebsafeKeys {
+			key, err := datastore.DecodeKey(k)
+			if err != nil || key.Kind() != "Notification" || !key.Parent().Equal(profKey) {
+				return nil, endpoints.NewBadRequestError("invalid notification key %q", k)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	//the datastore takes at most 500 entities per batch call
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		notifications := make([]Notification, n)
+		err := datastore.GetMulti(appCtx, keys[:n], notifications)
+		if err != nil {
+			return nil, err
+		}
+		for v := range notifications {
+			notifications[v].Read = true
+		}
+		if _, err := datastore.PutMulti(appCtx, keys[:n], notifications); err != nil {
+			return nil, err
+		}
+		keys = keys[n:]
+	}
+	return h.GetUnreadNotificationCount(r)
+}
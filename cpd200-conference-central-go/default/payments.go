@@ -0,0 +1,346 @@
+package main
+
+/*
+payments.go -- the payment step of paid registrations, behind a
+    PaymentProvider so the payment service can be swapped
+
+A paid ticket is held with holdSeat, then paid: payForHold creates a
+payment intent for the amount of the hold, which is confirmed either with
+confirmPayment or on the client, and reported by the provider's webhook.
+Only a succeeded payment turns the hold into a registration; a payment
+succeeding for a hold that was released meanwhile is refunded.
+
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+)
+
+//Payment statuses, of intents and of Registrations.
+const (
+	PAYMENT_PENDING = "PENDING"
+	PAYMENT_SUCCEEDED = "SUCCEEDED"
+	PAYMENT_FAILED = "FAILED"
+	PAYMENT_REFUNDED = "REFUNDED"
+)
+
+//Payment webhook event types.
+const (
+	PAYMENT_EVENT_SUCCEEDED = "payment.succeeded"
+	PAYMENT_EVENT_FAILED = "payment.failed"
+)
+
+type PaymentIntent struct {
+	//PaymentIntent -- a provider's record of one payment being made
+	Id string
+	Amount int64
+	Currency string
+	Reference string	//the websafe key of the Registration paid for
+	Status string
+	ClientSecret string	//lets the client confirm the payment with the provider
+}
+
+type PaymentRefund struct {
+	//PaymentRefund -- money given back on a PaymentIntent
+	Id string
+	IntentId string
+	Amount int64
+	Status string
+}
+
+type PaymentEvent struct {
+	//PaymentEvent -- a verified webhook call from a provider
+	Type string
+	Intent *PaymentIntent
+}
+
+type PaymentProvider interface {
+	//PaymentProvider -- a payment service. Amounts are in minor units;
+	//a refund repeating the reference of an earlier refund of the same
+	//intent isn't issued again.
+	CreateIntent(appCtx context.Context, amount int64, currency string, reference string, description string) (*PaymentIntent, error)
+	ConfirmIntent(appCtx context.Context, intentId string, paymentMethod string) (*PaymentIntent, error)
+	Refund(appCtx context.Context, intentId string, amount int64, reference string) (*PaymentRefund, error)
+	VerifyWebhook(appCtx context.Context, r *http.Request) (*PaymentEvent, error)
+}
+
+//Payment providers by name; PAYMENT_PROVIDER picks the one new payments use.
+var paymentProviders = map[string]PaymentProvider{}
+
+func getPaymentProvider(name string) (PaymentProvider, error) {
+	//Return the named payment provider.
+	provider, ok := paymentProviders[name]
+	if !ok {
+		return nil, endpoints.NewInternalServerError("unknown payment provider %q", name)
+	}
+	return provider, nil
+}
+
+//Currencies without minor units.
+var zeroDecimalCurrencies = map[string]bool{
+	"JPY": true,
+	"KRW": true,
+	"VND": true,
+	"CLP": true,
+	"ISK": true,
+}
+
+func formatAmount(amount int64, currency string) string {
+	//Format an amount in minor units, e.g. "12.50 USD".
+	if zeroDecimalCurrencies[currency] {
+		return strconv.FormatInt(amount, 10) + " " + currency
+	}
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount / 100, amount % 100, currency)
+}
+
+func copyPaymentToForm(reg *Registration, intent *PaymentIntent) *PaymentForm {
+	//Copy the payment of a held Registration to PaymentForm.
+	return &PaymentForm{
+		WebsafeConferenceKey: reg.ConferenceKey,
+		Provider: reg.PaymentProvider,
+		IntentId: intent.Id,
+		ClientSecret: intent.ClientSecret,
+		Amount: reg.Amount,
+		Currency: reg.Currency,
+		Status: intent.Status,
+		HoldExpiresAt: reg.HoldExpiresAt.Format(time.RFC3339),
+	}
+}
+
+func getHeldRegistration(r *http.Request, websafeConferenceKey string) (*Registration, *datastore.Key, error) {
+	//Return the current user's held Registration for a conference.
+	_, profKey, err := getProfileFromUser(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	confKey, err := datastore.DecodeKey(websafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	conf, err := ensureSeatShards(appCtx, confKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	regKey := registrationKey(appCtx, confKey, conf.SeatShards, profKey.StringID())
+	var reg Registration
+	err = datastore.Get(appCtx, regKey, &reg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, nil, err
+	}
+	if deletedRegistration(regKey, &reg) {
+		reg = Registration{}
+	}
+	if reg.Status == REGISTRATION_REGISTERED {
+		return nil, nil, endpoints.NewConflictError("You have already registered for this conference")
+	}
+	if reg.Status != REGISTRATION_HELD {
+		return nil, nil, endpoints.NewNotFoundError("You have no seat held for this conference")
+	}
+	return &reg, regKey, nil
+}
+
+func (h *ConferenceApi) PayForHold(r *http.Request, cr *ConfRequest) (*PaymentForm, error) {
+	//Start paying for the seats the user holds. Calling it again starts a
+	//new payment; an earlier one that still succeeds is refunded.
+	reg, regKey, err := getHeldRegistration(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	if reg.Amount == 0 {
+		return nil, endpoints.NewBadRequestError("There is nothing to pay; confirm the hold")
+	}
+	if reg.PaymentStatus == PAYMENT_SUCCEEDED {
+		return nil, endpoints.NewConflictError("You have already paid for this hold")
+	}
+	if time.Now().After(reg.HoldExpiresAt) {
+		return nil, endpoints.NewConflictError("Your hold has expired")
+	}
+	provider, err := getPaymentProvider(PAYMENT_PROVIDER)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var conf Conference
+	confKey, _ := datastore.DecodeKey(reg.ConferenceKey)
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+		return nil, err
+	}
+	intent, err := provider.CreateIntent(appCtx, reg.Amount, reg.Currency, regKey.Encode(), conf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, regKey, reg); err != nil {
+			return err
+		}
+		if reg.Status != REGISTRATION_HELD || reg.PaymentStatus == PAYMENT_SUCCEEDED {
+			return endpoints.NewConflictError("Your hold changed, please try again")
+		}
+		before = auditSnapshot(reg)
+		reg.PaymentProvider = PAYMENT_PROVIDER
+		reg.PaymentIntentId = intent.Id
+		reg.PaymentStatus = PAYMENT_PENDING
+		reg.UpdatedAt = time.Now()
+		after = auditSnapshot(reg)
+		_, err := datastore.Put(appCtx, regKey, reg)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, reg.UserId, "registration.pay", regKey, confKey, before, after)
+	return copyPaymentToForm(reg, intent), nil
+}
+
+func (h *ConferenceApi) ConfirmPayment(r *http.Request, pr *PaymentConfirmRequest) (*BooleanMessage, error) {
+	//Pay for the held seats with a payment method, registering the user
+	//on success.
+	reg, _, err := getHeldRegistration(r, pr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	if reg.PaymentIntentId == "" {
+		return nil, endpoints.NewConflictError("Start the payment with payForHold first")
+	}
+	provider, err := getPaymentProvider(reg.PaymentProvider)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	intent, err := provider.ConfirmIntent(appCtx, reg.PaymentIntentId, pr.PaymentMethod)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := completePayment(appCtx, reg.PaymentProvider, intent)
+	if err != nil {
+		return nil, err
+	}
+	if intent.Status == PAYMENT_FAILED {
+		return nil, endpoints.NewConflictError("Your payment was declined")
+	}
+	return &BooleanMessage{Data: changed}, nil
+}
+
+func completePayment(appCtx context.Context, providerName string, intent *PaymentIntent) (bool, error) {
+	//Record the outcome of a payment on its Registration, and register the
+	//user once it succeeded. Safe to call again with the same intent.
+	regKey, err := datastore.DecodeKey(intent.Reference)
+	if err != nil || regKey.Kind() != "Registration" {
+		applog.Errorf(appCtx, "payment %s: bad reference %q", intent.Id, intent.Reference)
+		return false, nil
+	}
+	if intent.Status != PAYMENT_SUCCEEDED && intent.Status != PAYMENT_FAILED {
+		return false, nil
+	}
+	var reg Registration
+	var refund bool
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		refund = false
+		before, after = nil, nil
+		err := datastore.Get(appCtx, regKey, &reg)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == datastore.ErrNoSuchEntity || reg.PaymentIntentId != intent.Id {
+			//superseded by a later payForHold
+			refund = intent.Status == PAYMENT_SUCCEEDED
+			return nil
+		}
+		if reg.PaymentStatus != PAYMENT_PENDING {
+			return nil	//already recorded
+		}
+		before = auditSnapshot(&reg)
+		reg.PaymentStatus = intent.Status
+		if intent.Status == PAYMENT_SUCCEEDED {
+			reg.PaidAt = time.Now()
+			//paid too late, or not what was asked for
+			if reg.Status != REGISTRATION_HELD || intent.Amount != reg.Amount || intent.Currency != reg.Currency {
+				reg.PaymentStatus = PAYMENT_REFUNDED
+				refund = true
+			}
+		}
+		reg.UpdatedAt = time.Now()
+		after = auditSnapshot(&reg)
+		_, err = datastore.Put(appCtx, regKey, &reg)
+		return err
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	confKey, _ := datastore.DecodeKey(reg.ConferenceKey)
+	if after != nil {
+		recordAudit(appCtx, "payments", "registration.payment", regKey, confKey, before, after)
+	}
+	if refund {
+		return false, refundPayment(appCtx, providerName, intent.Id, intent.Amount, regKey, confKey)
+	}
+	if reg.Status != REGISTRATION_HELD || reg.PaymentStatus != PAYMENT_SUCCEEDED {
+		return false, nil
+	}
+	_, changed, err := applyRegistration(appCtx, reg.UserId, &RegistrationRequest{WebsafeConferenceKey: reg.ConferenceKey}, REGISTRATION_OP_CONFIRM_HOLD, 0)
+	return changed, err
+}
+
+func refundPayment(appCtx context.Context, providerName string, intentId string, amount int64, regKey *datastore.Key, confKey *datastore.Key) error {
+	//Give back a payment that came too late for its hold.
+	provider, err := getPaymentProvider(providerName)
+	if err != nil {
+		return err
+	}
+	refund, err := provider.Refund(appCtx, intentId, amount, REFUND_REFERENCE_LATE_PAYMENT)
+	if err != nil {
+		applog.Errorf(appCtx, "refund %d of payment %s: %v", amount, intentId, err)
+		return err
+	}
+	applog.Infof(appCtx, "refunded %d of payment %s as %s", amount, intentId, refund.Id)
+	recordAudit(appCtx, "payments", "payment.refund", regKey, confKey, nil, auditSnapshot(refund))
+	return nil
+}
+
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve /payments/webhook/{provider}, where providers report payment
+	//outcomes. An error status makes the provider retry.
+	appCtx := appengine.NewContext(r)
+	name := strings.TrimPrefix(r.URL.Path, "/payments/webhook/")
+	provider, ok := paymentProviders[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	event, err := provider.VerifyWebhook(appCtx, r)
+	if err != nil {
+		applog.Warningf(appCtx, "payment webhook %s: %v", name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch event.Type {
+	case PAYMENT_EVENT_SUCCEEDED, PAYMENT_EVENT_FAILED:
+		_, err = completePayment(appCtx, name, event.Intent)
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "payment webhook %s %s: %v", name, event.Intent.Id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package main
+
+/*
+pdf.go -- a minimal PDF writer for the documents the app hands out:
+    text in the standard Helvetica and Courier fonts, lines and boxes
+
+Positions are in points, measured from the top left corner of the page,
+with text placed by its baseline. Text is WinAnsi encoded, so characters
+outside Latin-1 (and a few common punctuation marks) print as '?'.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+//Page sizes, in points.
+const (
+	PDF_A4_WIDTH = 595.28
+	PDF_A4_HEIGHT = 841.89
+	PDF_LETTER_WIDTH = 612.0
+	PDF_LETTER_HEIGHT = 792.0
+)
+
+//Fonts of pdfDocument.text; every document embeds the three of them.
+const (
+	PDF_FONT_REGULAR = "F1"
+	PDF_FONT_BOLD = "F2"
+	PDF_FONT_MONO = "F3"
+)
+
+var pdfFontNames = []string{"Helvetica", "Helvetica-Bold", "Courier"}
+
+//Width of a Courier glyph, per point of font size.
+const PDF_MONO_ADVANCE = 0.6
+
+//WinAnsi codes of the characters above Latin-1 worth keeping.
+var pdfWinAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92,
+	'“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+type pdfDocument struct {
+	//pdfDocument -- pages being drawn, each a content stream
+	width float64
+	height float64
+	pages []*bytes.Buffer
+}
+
+func newPDFDocument(width float64, height float64) *pdfDocument {
+	//Return a document of width x height pages, with a first blank page.
+	d := &pdfDocument{width: width, height: height}
+	d.addPage()
+	return d
+}
+
+func (d *pdfDocument) addPage() {
+	//Start a new page; later drawing goes on it.
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	//Return the content stream of the current page.
+	return d.pages[len(d.pages) - 1]
+}
+
+func pdfString(s string) string {
+	//Return s as a PDF literal string in WinAnsi encoding.
+	var b bytes.Buffer
+	b.WriteByte('(')
+	for _, r := range s {
+		c, ok := pdfWinAnsi[r]
+		switch {
+		case ok:
+		case r == '\t' || r == '\n' || r == '\r':
+			c = ' '
+		case r < ' ' || r > 0xff || (r >= 0x7f && r < 0xa0):
+			c = '?'
+		default:
+			c = byte(r)
+		}
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (d *pdfDocument) text(x float64, y float64, size float64, font string, s string) {
+	//Write s with its baseline starting at x, y.
+	fmt.Fprintf(d.page(), "BT /%s %.2f Tf %.2f %.2f Td %s Tj ET\n", font, size, x, d.height - y, pdfString(s))
+}
+
+func (d *pdfDocument) monoTextRight(x float64, y float64, size float64, s string) {
+	//Write s in PDF_FONT_MONO, ending at x; used for columns of amounts.
+	width := float64(len([]rune(s))) * size * PDF_MONO_ADVANCE
+	d.text(x - width, y, size, PDF_FONT_MONO, s)
+}
+
+func (d *pdfDocument) line(x1 float64, y1 float64, x2 float64, y2 float64, width float64) {
+	//Draw a line from x1, y1 to x2, y2.
+	fmt.Fprintf(d.page(), "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, d.height - y1, x2, d.height - y2)
+}
+
+func (d *pdfDocument) rect(x float64, y float64, w float64, h float64, width float64) {
+	//Draw the outline of a box whose top left corner is at x, y.
+	fmt.Fprintf(d.page(), "%.2f w %.2f %.2f %.2f %.2f re S\n", width, x, d.height - y - h, w, h)
+}
+
+func (d *pdfDocument) fillRect(x float64, y float64, w float64, h float64) {
+	//Fill a black box whose top left corner is at x, y.
+	fmt.Fprintf(d.page(), "%.2f %.2f %.2f %.2f re f\n", x, d.height - y - h, w, h)
+}
+
+func (d *pdfDocument) bytes() []byte {
+	//Return the finished PDF file.
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	//1 catalog, 2 page tree, 3.. fonts, then a page and its content per page
+	firstPage := 3 + len(pdfFontNames)
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage + 2 * i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	fonts := make([]string, len(pdfFontNames))
+	for i, name := range pdfFontNames {
+		object("<< /Type /Font /Subtype /Type1 /BaseFont /" + name + " /Encoding /WinAnsiEncoding >>")
+		fonts[i] = fmt.Sprintf("/F%d %d 0 R", i + 1, 3 + i)
+	}
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << %s >> >> /Contents %d 0 R >>",
+			d.width, d.height, strings.Join(fonts, " "), firstPage + 2 * i + 1))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets) + 1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets) + 1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,168 @@
+package main
+
+/*
+promos.go -- discount codes organizers hand out for their conference's
+    ticket types
+
+A PromoCode takes a percentage or a fixed amount per ticket off the price.
+It is a root entity, so codes don't contend with each other or with the
+conference, and its Used count changes in the registration's transaction
+with the seats; a registration that is cancelled or a hold that expires
+gives its use back.
+
+*/
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+//Promo codes are MIN_PROMO_CODE_LENGTH to MAX_PROMO_CODE_LENGTH letters,
+//digits, '-' or '_', compared case-insensitively.
+const (
+	MIN_PROMO_CODE_LENGTH = 3
+	MAX_PROMO_CODE_LENGTH = 32
+)
+
+func normalizePromoCode(code string) string {
+	//Return code as it is stored, upper-cased without surrounding spaces.
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func promoCodeKey(appCtx context.Context, confKey *datastore.Key, code string) *datastore.Key {
+	//Return the key of a conference's promo code.
+	return datastore.NewKey(appCtx, "PromoCode", confKey.Encode() + "/" + normalizePromoCode(code), 0, nil)
+}
+
+func checkPromoCode(promo *PromoCode, websafeTicketTypeKey string, now time.Time) error {
+	//Return an error if promo can't be used on a ticket type at now.
+	//Running out of uses is checked in the registration transaction.
+	if !promo.ExpiresAt.IsZero() && !now.Before(promo.ExpiresAt) {
+		return endpoints.NewConflictError("This promo code has expired")
+	}
+	if len(promo.TicketTypeKeys) == 0 {
+		return nil
+	}
+	for _, key := range promo.TicketTypeKeys {
+		if key == websafeTicketTypeKey {
+			return nil
+		}
+	}
+	return endpoints.NewBadRequestError("This promo code isn't valid for this ticket type")
+}
+
+func priceRegistration(tt *TicketType, promo *PromoCode, quantity int) (int64, int64) {
+	//Return the amount due for quantity tickets of a type with promo, which
+	//may be nil, and the discount included; the amount never goes below zero.
+	if tt == nil {
+		return 0, 0
+	}
+	total := tt.Price * int64(quantity)
+	var discount int64
+	if promo != nil {
+		if promo.PercentOff > 0 {
+			discount = total * int64(promo.PercentOff) / 100
+		} else {
+			discount = promo.AmountOff * int64(quantity)
+		}
+	}
+	if discount > total {
+		discount = total
+	}
+	return total - discount, discount
+}
+
+func copyPromoCodeToForm(conf *Conference, promo *PromoCode, now time.Time) *PromoCodeForm {
+	//Copy relevant fields from PromoCode to PromoCodeForm.
+	return &PromoCodeForm{
+		Code: promo.Code,
+		PercentOff: promo.PercentOff,
+		AmountOff: promo.AmountOff,
+		MaxUses: promo.MaxUses,
+		Used: promo.Used,
+		ExpiresAt: formatConferenceTime(conf, promo.ExpiresAt),
+		WebsafeTicketTypeKeys: promo.TicketTypeKeys,
+		Active: (promo.ExpiresAt.IsZero() || now.Before(promo.ExpiresAt)) &&
+			(promo.MaxUses == 0 || promo.Used < promo.MaxUses),
+	}
+}
+
+func (h *ConferenceApi) CreatePromoCode(r *http.Request, pr *PromoCodeRequest) (*PromoCodeForm, error) {
+	//Add a promo code to a conference; organizer only.
+	conf, confKey, user, err := getOrganizedConference(r, pr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	pr.Code = normalizePromoCode(pr.Code)
+	expiresAt, err := validatePromoCodeRequest(pr, conferenceLocation(conf))
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	v := &ValidationError{}
+	for i, websafeKey := range pr.WebsafeTicketTypeKeys {
+		if _, _, err := getConferenceTicketType(appCtx, confKey, websafeKey); err != nil {
+			v.Add(fmt.Sprintf("websafeTicketTypeKeys[%d]", i), "must be a ticket type of this conference")
+		}
+	}
+	if err := v.Err(); err != nil {
+		return nil, err
+	}
+
+	key := promoCodeKey(appCtx, confKey, pr.Code)
+	promo := &PromoCode{
+		Code: pr.Code,
+		ConferenceKey: confKey.Encode(),
+		PercentOff: pr.PercentOff,
+		AmountOff: pr.AmountOff,
+		MaxUses: pr.MaxUses,
+		ExpiresAt: expiresAt,
+		TicketTypeKeys: pr.WebsafeTicketTypeKeys,
+		CreatedAt: time.Now(),
+	}
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		err := datastore.Get(appCtx, key, &PromoCode{})
+		if err == nil {
+			return endpoints.NewConflictError("There already is a promo code %s", pr.Code)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(appCtx, key, promo)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "promoCode.create", key, confKey, nil, auditSnapshot(promo))
+	return copyPromoCodeToForm(conf, promo, time.Now()), nil
+}
+
+func (h *ConferenceApi) GetPromoCodes(r *http.Request, cr *ConfRequest) (*PromoCodeForms, error) {
+	//Return the promo codes of a conference and how often each was used;
+	//organizer only.
+	conf, confKey, _, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var promos []PromoCode
+	_, err = datastore.NewQuery("PromoCode").Filter("ConferenceKey=", confKey.Encode()).GetAll(appCtx, &promos)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	forms := &PromoCodeForms{
+		Items: make([]PromoCodeForm, 0, len(promos)),
+	}
+	for v := range promos {
+		forms.Items = append(forms.Items, *copyPromoCodeToForm(conf, &promos[v], now))
+	}
+	return forms, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+/*
+qrcode.go -- a QR code encoder for ticket tokens: byte mode, error
+    correction level M, versions 1 to 10 (up to 213 bytes)
+
+The steps follow ISO/IEC 18004: the data is split into blocks with
+Reed-Solomon error correction, interleaved, laid out in a zigzag around
+the function patterns, and masked with the pattern scoring the lowest
+penalty.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+//Light modules around the code readers need to find it.
+const QR_QUIET_ZONE = 4
+
+type qrBlocks struct {
+	//qrBlocks -- the level M error correction layout of one version
+	ecPerBlock int
+	groups [][2]int	//block count, data codewords per block
+}
+
+//Level M layouts of versions 1 to 10.
+var qrVersions = []qrBlocks{
+	{10, [][2]int{{1, 16}}},
+	{16, [][2]int{{1, 28}}},
+	{26, [][2]int{{1, 44}}},
+	{18, [][2]int{{2, 32}}},
+	{24, [][2]int{{2, 43}}},
+	{16, [][2]int{{4, 27}}},
+	{18, [][2]int{{4, 31}}},
+	{22, [][2]int{{2, 38}, {2, 39}}},
+	{22, [][2]int{{3, 36}, {2, 37}}},
+	{26, [][2]int{{4, 43}, {1, 44}}},
+}
+
+//Alignment pattern centres of versions 1 to 10.
+var qrAlignment = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+type qrCode struct {
+	//qrCode -- a square of modules, true for dark
+	size int
+	modules [][]bool
+	function [][]bool	//modules not carrying data, left unmasked
+}
+
+func qrDataCodewords(version int) int {
+	//Return how many data codewords a version holds at level M.
+	n := 0
+	for _, g := range qrVersions[version - 1].groups {
+		n += g[0] * g[1]
+	}
+	return n
+}
+
+func qrMultiply(x byte, y byte) byte {
+	//Multiply in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x1d)
+		z ^= ((y >> uint(i)) & 1) * x
+	}
+	return z
+}
+
+func qrErrorCorrection(data []byte, degree int) []byte {
+	//Return the Reed-Solomon error correction codewords of data.
+	divisor := make([]byte, degree)
+	divisor[degree - 1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			divisor[j] = qrMultiply(divisor[j], root)
+			if j + 1 < degree {
+				divisor[j] ^= divisor[j + 1]
+			}
+		}
+		root = qrMultiply(root, 2)
+	}
+	result := make([]byte, degree)
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[degree - 1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func qrCodewords(text []byte, version int) []byte {
+	//Return the interleaved data and error correction codewords of text.
+	capacity := qrDataCodewords(version)
+	var bits []bool
+	put := func(value int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value >> uint(i)) & 1 == 1)
+		}
+	}
+	put(4, 4) //byte mode
+	if version < 10 {
+		put(len(text), 8)
+	} else {
+		put(len(text), 16)
+	}
+	for _, b := range text {
+		put(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity * 8; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits) % 8 != 0 {
+		bits = append(bits, false)
+	}
+	data := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i + j] {
+				b |= 0x80 >> uint(j)
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xec); len(data) < capacity; pad ^= 0xec ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	layout := qrVersions[version - 1]
+	var blocks, ecBlocks [][]byte
+	for _, g := range layout.groups {
+		for i := 0; i < g[0]; i++ {
+			block := data[:g[1]]
+			data = data[g[1]:]
+			blocks = append(blocks, block)
+			ecBlocks = append(ecBlocks, qrErrorCorrection(block, layout.ecPerBlock))
+		}
+	}
+	var out []byte
+	for i := 0; ; i++ {
+		n := 0
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+				n++
+			}
+		}
+		if n == 0 {
+			break
+		}
+	}
+	for i := 0; i < layout.ecPerBlock; i++ {
+		for _, ec := range ecBlocks {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+func (q *qrCode) set(x int, y int, dark bool) {
+	//Set a function module at column x, row y.
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	//Draw the finder, timing and alignment patterns, and version information.
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i % 2 == 0)
+		q.set(i, 6, i % 2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0] + dx, c[1] + dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := qrMax(qrAbs(dx), qrAbs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignment[version - 1]
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i] + dx, pos[j] + dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(0) //reserves the area; redrawn once the mask is chosen
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := version << 12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits >> uint(i)) & 1 == 1
+			a, b := q.size - 11 + i % 3, i / 3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	//Draw both copies of the level M format information for mask.
+	data := mask //level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data << 10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits >> uint(i)) & 1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14 - i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size - 1 - i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size - 15 + i, bit(i))
+	}
+	q.set(8, q.size - 8, true)
+}
+
+func (q *qrCode) drawCodewords(codewords []byte) {
+	//Lay the codewords out in two-column zigzags from the bottom right.
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right + 1) & 2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(codewords) * 8 {
+					q.modules[y][x] = (codewords[i >> 3] >> uint(7 - (i & 7))) & 1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func qrMasked(mask int, x int, y int) bool {
+	//Return true if mask flips the module at column x, row y.
+	switch mask {
+	case 0:
+		return (x + y) % 2 == 0
+	case 1:
+		return y % 2 == 0
+	case 2:
+		return x % 3 == 0
+	case 3:
+		return (x + y) % 3 == 0
+	case 4:
+		return (x / 3 + y / 2) % 2 == 0
+	case 5:
+		return x * y % 2 + x * y % 3 == 0
+	case 6:
+		return (x * y % 2 + x * y % 3) % 2 == 0
+	}
+	return ((x + y) % 2 + x * y % 3) % 2 == 0
+}
+
+func (q *qrCode) applyMask(mask int) {
+	//Flip the data modules selected by mask; applying it twice undoes it.
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.function[y][x] && qrMasked(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+func (q *qrCode) penalty() int {
+	//Score how hard the symbol is to read: long runs, 2x2 blocks,
+	//finder-like patterns and an unbalanced dark ratio.
+	score, dark := 0, 0
+	at := func(line int, i int, rows bool) bool {
+		if rows {
+			return q.modules[line][i]
+		}
+		return q.modules[i][line]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, rows := range []bool{true, false} {
+		for line := 0; line < q.size; line++ {
+			run := 1
+			for i := 1; i <= q.size; i++ {
+				if i < q.size && at(line, i, rows) == at(line, i - 1, rows) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			for i := 0; i + 7 <= q.size; i++ {
+				match := true
+				for j, d := range finder {
+					if at(line, i + j, rows) != d {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				//four light modules, or the edge, on either side
+				before, after := true, true
+				for j := 1; j <= 4; j++ {
+					if i - j >= 0 && at(line, i - j, rows) {
+						before = false
+					}
+					if i + 6 + j < q.size && at(line, i + 6 + j, rows) {
+						after = false
+					}
+				}
+				if before || after {
+					score += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			c := q.modules[y][x]
+			if c {
+				dark++
+			}
+			if x + 1 < q.size && y + 1 < q.size && c == q.modules[y][x + 1] &&
+				c == q.modules[y + 1][x] && c == q.modules[y + 1][x + 1] {
+				score += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	score += qrAbs(dark * 20 - total * 10) / total * 10
+	return score
+}
+
+func qrAbs(n int) int {
+	//Return the absolute value of n.
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func qrMax(a int, b int) int {
+	//Return the larger of a and b.
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func encodeQR(text string) (*qrCode, error) {
+	//Return the smallest level M QR code holding text.
+	version := 0
+	for v := 1; v <= len(qrVersions); v++ {
+		header := 12
+		if v >= 10 {
+			header = 20
+		}
+		if header + 8 * len(text) <= qrDataCodewords(v) * 8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errors.New("qrcode: text too long")
+	}
+	q := &qrCode{size: 17 + 4 * version}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.size)
+		q.function[y] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords([]byte(text), version))
+
+	best, bestScore := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if score := q.penalty(); bestScore < 0 || score < bestScore {
+			best, bestScore = mask, score
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+func (q *qrCode) png(scale int) []byte {
+	//Return the code as a black on white PNG, scale pixels per module.
+	side := (q.size + 2 * QR_QUIET_ZONE) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetGray((x + QR_QUIET_ZONE) * scale + px, (y + QR_QUIET_ZONE) * scale + py, color.Gray{0})
+				}
+			}
+		}
+	}
+	var b bytes.Buffer
+	png.Encode(&b, img)
+	return b.Bytes()
+}
@@ -0,0 +1,195 @@
+package main
+
+/*
+refunds.go -- conference cancellation policies, and the refunds they
+    give users who unregister from a paid registration
+
+A policy gives a full refund until FullRefundUntil, PartialRefundPercent
+of the amount paid until PartialRefundUntil, and nothing after. A
+conference without a policy refunds in full until it starts. The refund
+is decided in the unregistration transaction, which queues a task issuing
+it through the registration's payment provider.
+
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//Registration refund statuses.
+const (
+	REFUND_PENDING = "PENDING"
+	REFUND_SUCCEEDED = "SUCCEEDED"
+)
+
+//Payment status of a registration refunded in part.
+const PAYMENT_PARTIALLY_REFUNDED = "PARTIALLY_REFUNDED"
+
+//Provider refund references, so a retried refund isn't issued twice.
+const (
+	REFUND_REFERENCE_CANCELLATION = "cancellation"
+	REFUND_REFERENCE_LATE_PAYMENT = "late-payment"
+)
+
+func hasCancellationPolicy(conf *Conference) bool {
+	//Return true if the organizer set a cancellation policy.
+	return !conf.FullRefundUntil.IsZero() || !conf.PartialRefundUntil.IsZero()
+}
+
+func copyCancellationPolicyToForm(conf *Conference) *CancellationPolicyForm {
+	//Return the cancellation policy in effect for a conference.
+	if !hasCancellationPolicy(conf) {
+		return &CancellationPolicyForm{
+			FullRefundUntil: formatConferenceTime(conf, conf.StartDate),
+		}
+	}
+	return &CancellationPolicyForm{
+		FullRefundUntil: formatConferenceTime(conf, conf.FullRefundUntil),
+		PartialRefundUntil: formatConferenceTime(conf, conf.PartialRefundUntil),
+		PartialRefundPercent: conf.PartialRefundPercent,
+	}
+}
+
+func cancellationRefund(conf *Conference, reg *Registration, now time.Time) int64 {
+	//Return how much of a paid registration is refunded if it is cancelled at now.
+	if reg.PaymentStatus != PAYMENT_SUCCEEDED {
+		return 0
+	}
+	if !conf.CancelledAt.IsZero() {
+		return reg.Amount
+	}
+	if !hasCancellationPolicy(conf) {
+		if conf.StartDate.IsZero() || now.Before(conf.StartDate) {
+			return reg.Amount
+		}
+		return 0
+	}
+	if now.Before(conf.FullRefundUntil) {
+		return reg.Amount
+	}
+	if now.Before(conf.PartialRefundUntil) {
+		return reg.Amount * int64(conf.PartialRefundPercent) / 100
+	}
+	return 0
+}
+
+func queueRefund(appCtx context.Context, regKey *datastore.Key) error {
+	//Queue the refund recorded on a Registration; transactional when appCtx
+	//is a transaction's.
+	task := taskqueue.NewPOSTTask("/tasks/refund_registration", url.Values{
+		"registrationKey": {regKey.Encode()},
+	})
+	_, err := taskqueue.Add(appCtx, task, "")
+	return err
+}
+
+func (h *ConferenceApi) SetCancellationPolicy(r *http.Request, cpr *CancellationPolicyRequest) (*CancellationPolicyForm, error) {
+	//Set the refunds given on unregistration; organizer only. It applies to
+	//unregistrations from now on. An empty policy restores the default.
+	conf, confKey, user, err := getOrganizedConference(r, cpr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	fullRefundUntil, partialRefundUntil, err := validateCancellationPolicyRequest(cpr, conferenceLocation(conf))
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, conf); err != nil {
+			return err
+		}
+		before = auditSnapshot(copyCancellationPolicyToForm(conf))
+		conf.FullRefundUntil = fullRefundUntil
+		conf.PartialRefundUntil = partialRefundUntil
+		conf.PartialRefundPercent = cpr.PartialRefundPercent
+		if partialRefundUntil.IsZero() {
+			conf.PartialRefundPercent = 0
+		}
+		after = auditSnapshot(copyCancellationPolicyToForm(conf))
+		_, err := datastore.Put(appCtx, confKey, conf)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "conference.setCancellationPolicy", confKey, confKey, before, after)
+	fireConferenceEvent(appCtx, EVENT_CONFERENCE_UPDATED, conf, confKey)
+	return copyCancellationPolicyToForm(conf), nil
+}
+
+func RefundRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	//Issue the pending refund of a cancelled Registration; the task is
+	//retried until the provider accepts it.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	regKey, err := datastore.DecodeKey(r.PostFormValue("registrationKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var reg Registration
+	if err := datastore.Get(appCtx, regKey, &reg); err != nil || reg.RefundStatus != REFUND_PENDING {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	provider, err := getPaymentProvider(reg.PaymentProvider)
+	var refund *PaymentRefund
+	if err == nil {
+		refund, err = provider.Refund(appCtx, reg.PaymentIntentId, reg.RefundAmount, REFUND_REFERENCE_CANCELLATION)
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "refund %v: %v", regKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var before, after []byte
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		before, after = nil, nil
+		if err := datastore.Get(appCtx, regKey, &reg); err != nil {
+			return err
+		}
+		if reg.RefundStatus != REFUND_PENDING {
+			return nil
+		}
+		before = auditSnapshot(&reg)
+		now := time.Now()
+		reg.RefundStatus = REFUND_SUCCEEDED
+		reg.RefundId = refund.Id
+		reg.RefundedAt = now
+		reg.PaymentStatus = PAYMENT_PARTIALLY_REFUNDED
+		if reg.RefundAmount == reg.Amount {
+			reg.PaymentStatus = PAYMENT_REFUNDED
+		}
+		reg.UpdatedAt = now
+		after = auditSnapshot(&reg)
+		_, err := datastore.Put(appCtx, regKey, &reg)
+		return err
+	}, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "refund %v: %v", regKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if after != nil {
+		confKey, _ := datastore.DecodeKey(reg.ConferenceKey)
+		recordAudit(appCtx, "payments", "registration.refund", regKey, confKey, before, after)
+		addNotification(appCtx, reg.UserId, &Notification{
+			Type: NOTIFICATION_REFUNDED,
+			Title: "You were refunded " + formatAmount(reg.RefundAmount, reg.Currency),
+			WebsafeConferenceKey: reg.ConferenceKey,
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,367 @@
+package main
+
+/*
+registrations.go -- Registration entities, one per attendee and
+    conference, and the migration off Profile.ConferenceKeysToAttend
+
+*/
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//Registration statuses. HELD registrations hold a Taken seat until they
+//become REGISTERED or are RELEASED.
+const (
+	REGISTRATION_REGISTERED = "REGISTERED"
+	REGISTRATION_CANCELLED = "CANCELLED"
+	REGISTRATION_HELD = "HELD"
+	REGISTRATION_RELEASED = "RELEASED"
+)
+
+//Changes changeRegistration can make to a Registration.
+type registrationOp int
+
+const (
+	REGISTRATION_OP_REGISTER registrationOp = iota
+	REGISTRATION_OP_UNREGISTER
+	REGISTRATION_OP_HOLD
+	REGISTRATION_OP_CONFIRM_HOLD
+)
+
+//Attempts at a registration transaction before reporting the conference busy.
+const REGISTRATION_TRANSACTION_ATTEMPTS = 5
+
+//Profiles are migrated this many per task.
+const REGISTRATION_MIGRATION_BATCH = 50
+
+func registrationSeats(reg *Registration) int {
+	//Return the seats a Registration takes while REGISTERED or HELD.
+	if reg.Quantity <= 0 {
+		return 1
+	}
+	return reg.Quantity
+}
+
+func copyRegistrationToForm(reg *Registration) *RegistrationForm {
+	//Copy relevant fields from Registration to RegistrationForm.
+	return &RegistrationForm{
+		WebsafeConferenceKey: reg.ConferenceKey,
+		WebsafeTicketTypeKey: reg.TicketTypeKey,
+		Quantity: registrationSeats(reg),
+		Status: reg.Status,
+		Amount: reg.Amount,
+		Discount: reg.Discount,
+		Currency: reg.Currency,
+		PaymentStatus: reg.PaymentStatus,
+		RefundAmount: reg.RefundAmount,
+		RefundStatus: reg.RefundStatus,
+	}
+}
+
+func attendeesQuery(confKey *datastore.Key) *datastore.Query {
+	//Return a query over the active Registrations of a conference.
+	return datastore.NewQuery("Registration").
+		Filter("ConferenceKey=", confKey.Encode()).
+		Filter("Status=", REGISTRATION_REGISTERED)
+}
+
+func getRegisteredProfiles(appCtx context.Context, regKeys []*datastore.Key) ([]Profile, []*datastore.Key, error) {
+	//Return the Profiles behind Registration keys; a missing Profile is left empty.
+	profKeys := make([]*datastore.Key, len(regKeys))
+	for v := range regKeys {
+		profKeys[v] = datastore.NewKey(appCtx, "Profile", regKeys[v].StringID(), 0, nil)
+	}
+	profiles := make([]Profile, len(profKeys))
+	err := datastore.GetMulti(appCtx, profKeys, profiles)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, e := range merr {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return nil, nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return profiles, profKeys, nil
+}
+
+func getRegisteredConferenceKeys(appCtx context.Context, userId string) ([]*datastore.Key, error) {
+	//Return the keys of the conferences userId is registered for.
+	var regs []Registration
+	_, err := datastore.NewQuery("Registration").
+		Filter("UserId=", userId).
+		Filter("Status=", REGISTRATION_REGISTERED).
+		GetAll(appCtx, &regs)
+	if err != nil {
+		return nil, err
+	}
+	confKeys := make([]*datastore.Key, 0, len(regs))
+	for v := range regs {
+		key, err := datastore.DecodeKey(regs[v].ConferenceKey)
+		if err != nil {
+			return nil, err
+		}
+		confKeys = append(confKeys, key)
+	}
+	return confKeys, nil
+}
+
+func getConferencesAttended(appCtx context.Context, userId string) ([]Conference, []*datastore.Key, error) {
+	//Return the conferences userId is registered for, with their keys.
+	confKeys, err := getRegisteredConferenceKeys(appCtx, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+	conferences := make([]Conference, len(confKeys))
+	if err := datastore.GetMulti(appCtx, confKeys, conferences); err != nil {
+		return nil, nil, err
+	}
+	if err := aggregateSeatsAvailable(appCtx, conferences, confKeys); err != nil {
+		return nil, nil, err
+	}
+	return conferences, confKeys, nil
+}
+
+func migrateProfileRegistrations(appCtx context.Context, profKey *datastore.Key) error {
+	//Turn the legacy ConferenceKeysToAttend of a Profile into Registrations.
+	//Their seats were taken before the conference was sharded, so each adds
+	//one seat that is both Allocated and Taken to the user's shard. Each
+	//conference is moved in a cross-group transaction with the Profile, so
+	//concurrent migrations and crashes never lose or duplicate a registration.
+	userId := profKey.StringID()
+	for {
+		var prof Profile
+		if err := datastore.Get(appCtx, profKey, &prof); err != nil {
+			if err == datastore.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+		if len(prof.ConferenceKeysToAttend) == 0 {
+			return nil
+		}
+		websafeKey := prof.ConferenceKeysToAttend[0]
+		//a key of a deleted or malformed conference is just dropped
+		var regKey *datastore.Key
+		confKey, err := datastore.DecodeKey(websafeKey)
+		if err == nil {
+			var conf *Conference
+			conf, err = ensureSeatShards(appCtx, confKey)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			if err == nil {
+				regKey = registrationKey(appCtx, confKey, conf.SeatShards, userId)
+			}
+		}
+		if regKey == nil {
+			applog.Warningf(appCtx, "migrate registrations %s: dropping %q: %v", userId, websafeKey, err)
+		}
+
+		err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			if err := datastore.Get(appCtx, profKey, &prof); err != nil {
+				return err
+			}
+			if len(prof.ConferenceKeysToAttend) == 0 || prof.ConferenceKeysToAttend[0] != websafeKey {
+				return nil	//someone else moved it
+			}
+			prof.ConferenceKeysToAttend = prof.ConferenceKeysToAttend[1:]
+			keys := []*datastore.Key{profKey}
+			entities := []interface{}{&prof}
+			if regKey != nil {
+				var reg Registration
+				err := datastore.Get(appCtx, regKey, &reg)
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return err
+				}
+				if err == datastore.ErrNoSuchEntity || reg.Status != REGISTRATION_REGISTERED {
+					var shard SeatShard
+					if err := datastore.Get(appCtx, regKey.Parent(), &shard); err != nil {
+						return err
+					}
+					shard.Allocated++
+					shard.Taken++
+					now := time.Now()
+					keys = append(keys, regKey, regKey.Parent())
+					entities = append(entities, &Registration{
+						UserId: userId,
+						ConferenceKey: websafeKey,
+						Status: REGISTRATION_REGISTERED,
+						RegisteredAt: now,
+						UpdatedAt: now,
+					}, &shard)
+				}
+			}
+			_, err := datastore.PutMulti(appCtx, keys, entities)
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (h *ConferenceApi) CheckSeats(r *http.Request, sr *SeatsCheckRequest) (*SeatsCheckForm, error) {
+	//Compare the Taken count of each of a conference's seat shards with the
+	//seats of its active Registrations; admin only. With repair set, Taken
+	//is corrected. Ticket type pools aren't checked.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(user) {
+		return nil, endpoints.NewForbiddenError("Only admins can do this")
+	}
+	confKey, err := datastore.DecodeKey(sr.WebsafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	conf, err := ensureSeatShards(appCtx, confKey)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	form := &SeatsCheckForm{
+		MaxAttendees: conf.MaxAttendees,
+		Consistent: true,
+	}
+	for _, shardKey := range seatShardKeys(appCtx, confKey, conf.SeatShards) {
+		var shard SeatShard
+		var registered int
+		var before, after []byte
+		//ancestor queries run inside the transaction, so the count is consistent
+		err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			if err := datastore.Get(appCtx, shardKey, &shard); err != nil {
+				return err
+			}
+			//held seats are Taken too
+			registered = 0
+			for _, status := range []string{REGISTRATION_REGISTERED, REGISTRATION_HELD} {
+				var regs []Registration
+				_, err := datastore.NewQuery("Registration").Ancestor(shardKey).
+					Filter("Status=", status).GetAll(appCtx, &regs)
+				if err != nil {
+					return err
+				}
+				for v := range regs {
+					registered += registrationSeats(&regs[v])
+				}
+			}
+			var err error
+			before, after = nil, nil
+			if shard.Taken == registered || !sr.Repair {
+				return nil
+			}
+			before = auditSnapshot(&shard)
+			repaired := shard
+			repaired.Taken = registered
+			if repaired.Allocated < registered {
+				repaired.Allocated = registered
+			}
+			after = auditSnapshot(&repaired)
+			_, err = datastore.Put(appCtx, shardKey, &repaired)
+			return err
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		form.Allocated += shard.Allocated
+		form.Registered += registered
+		form.SeatsAvailable += shard.Allocated - shard.Taken
+		if shard.Taken != registered {
+			form.Consistent = false
+		}
+		if after != nil {
+			form.Repaired = true
+			recordAudit(appCtx, getUserId(user, ""), "conference.repairSeats", shardKey, confKey, before, after)
+		}
+	}
+	form.ExpectedSeatsAvailable = form.Allocated - form.Registered
+	if form.Repaired {
+		publishSeatsChanged(appCtx, sr.WebsafeConferenceKey)
+	}
+	return form, nil
+}
+
+func (h *ConferenceApi) MigrateRegistrations(r *http.Request) (*BooleanMessage, error) {
+	//Start moving every Profile's ConferenceKeysToAttend to Registrations; admin only.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin(user) {
+		return nil, endpoints.NewForbiddenError("Only admins can do this")
+	}
+	appCtx := appengine.NewContext(r)
+	task := taskqueue.NewPOSTTask("/tasks/migrate_registrations", url.Values{})
+	if _, err := taskqueue.Add(appCtx, task, ""); err != nil {
+		return nil, err
+	}
+	return &BooleanMessage{Data: true}, nil
+}
+
+func MigrateRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	//Migrate REGISTRATION_MIGRATION_BATCH Profiles, re-queueing itself
+	//with a cursor until all Profiles are covered. Safe to re-run.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	q := datastore.NewQuery("Profile").KeysOnly()
+	if c := r.PostFormValue("cursor"); c != "" {
+		cursor, err := datastore.DecodeCursor(c)
+		if err != nil {
+			applog.Errorf(appCtx, "migrate registrations: bad cursor: %v", err)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q = q.Start(cursor)
+	}
+	it := q.Limit(REGISTRATION_MIGRATION_BATCH).Run(appCtx)
+	n := 0
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err == nil {
+			err = migrateProfileRegistrations(appCtx, key)
+		}
+		if err != nil {
+			applog.Errorf(appCtx, "migrate registrations: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n++
+	}
+	if n == REGISTRATION_MIGRATION_BATCH {
+		cursor, err := it.Cursor()
+		if err == nil {
+			task := taskqueue.NewPOSTTask("/tasks/migrate_registrations", url.Values{
+				"cursor": {cursor.String()},
+			})
+			_, err = taskqueue.Add(appCtx, task, "")
+		}
+		if err != nil {
+			applog.Errorf(appCtx, "migrate registrations: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		applog.Infof(appCtx, "migrate registrations: done")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
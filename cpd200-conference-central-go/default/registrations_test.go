@@ -0,0 +1,165 @@
+package main
+
+/*
+registrations_test.go -- concurrent registrations against a small
+    conference, checking the seat shards neither oversell nor drift; needs
+    the App Engine SDK's aetest
+
+*/
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+//Seats of the test conference; enough for a few shards, so full shards
+//borrow from each other.
+const testConferenceSeats = 25
+
+func putTestConference(t *testing.T, appCtx context.Context, seats int) *datastore.Key {
+	//Store a conference with seats free and no registrations.
+	profKey := datastore.NewKey(appCtx, "Profile", "organizer@example.com", 0, nil)
+	confKey, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "Conference", profKey), &Conference{
+		Name: "Stress test",
+		OrganizerUserId: profKey.StringID(),
+		TimeZone: "UTC",
+		StartDate: time.Now().Add(30 * 24 * time.Hour),
+		EndDate: time.Now().Add(31 * 24 * time.Hour),
+		MaxAttendees: seats,
+		SeatsAvailable: seats,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return confKey
+}
+
+func applyConcurrently(appCtx context.Context, confKey *datastore.Key, userIds []string, op registrationOp) []error {
+	//Apply op for every user at once; returns each user's error.
+	errs := make([]error, len(userIds))
+	var wg sync.WaitGroup
+	for v := range userIds {
+		wg.Add(1)
+		go func(v int) {
+			defer wg.Done()
+			_, _, errs[v] = applyRegistration(appCtx, userIds[v], &RegistrationRequest{
+				WebsafeConferenceKey: confKey.Encode(),
+			}, op, 0)
+		}(v)
+	}
+	wg.Wait()
+	return errs
+}
+
+func checkSeatShards(t *testing.T, appCtx context.Context, confKey *datastore.Key) int {
+	//Check no shard has more seats Taken than Allocated, and that the free
+	//seats over all shards are MaxAttendees less the active registrations'
+	//seats. Returns the active registrations.
+	var conf Conference
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+		t.Fatal(err)
+	}
+	shardKeys := seatShardKeys(appCtx, confKey, conf.SeatShards)
+	shards := make([]SeatShard, len(shardKeys))
+	if err := datastore.GetMulti(appCtx, shardKeys, shards); err != nil {
+		t.Fatal(err)
+	}
+	free, active, seats := 0, 0, 0
+	for v := range shards {
+		if shards[v].Taken > shards[v].Allocated {
+			t.Errorf("shard %d has %d seats taken of %d allocated", v, shards[v].Taken, shards[v].Allocated)
+		}
+		free += shards[v].Allocated - shards[v].Taken
+		var regs []Registration
+		if _, err := datastore.NewQuery("Registration").Ancestor(shardKeys[v]).GetAll(appCtx, &regs); err != nil {
+			t.Fatal(err)
+		}
+		for w := range regs {
+			if regs[w].Status == REGISTRATION_REGISTERED || regs[w].Status == REGISTRATION_HELD {
+				active++
+				seats += registrationSeats(&regs[w])
+			}
+		}
+	}
+	if free < 0 {
+		t.Errorf("%d free seats over all shards", free)
+	}
+	if free != conf.MaxAttendees - seats {
+		t.Errorf("%d free seats over all shards, want %d of %d less %d taken", free, conf.MaxAttendees - seats,
+			conf.MaxAttendees, seats)
+	}
+	return active
+}
+
+func TestConcurrentRegistrations(t *testing.T) {
+	//only ancestor queries are made, which are strongly consistent
+	appCtx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	confKey := putTestConference(t, appCtx, testConferenceSeats)
+
+	//twice as many users as seats register at once
+	userIds := make([]string, 2 * testConferenceSeats)
+	for v := range userIds {
+		userIds[v] = fmt.Sprintf("attendee%d@example.com", v)
+	}
+	errs := applyConcurrently(appCtx, confKey, userIds, REGISTRATION_OP_REGISTER)
+	registered := []string{}
+	for v, err := range errs {
+		if err == nil {
+			registered = append(registered, userIds[v])
+		}
+	}
+	if len(registered) > testConferenceSeats {
+		t.Fatalf("%d users registered for %d seats", len(registered), testConferenceSeats)
+	}
+	if active := checkSeatShards(t, appCtx, confKey); active != len(registered) {
+		t.Fatalf("%d active registrations, want the %d that succeeded", active, len(registered))
+	}
+
+	//half of them leave while the users who got no seat try again
+	leaving := registered[:len(registered) / 2]
+	retrying := []string{}
+	for v, err := range errs {
+		if err != nil {
+			retrying = append(retrying, userIds[v])
+		}
+	}
+	var wg sync.WaitGroup
+	var leaveErrs, retryErrs []error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		leaveErrs = applyConcurrently(appCtx, confKey, leaving, REGISTRATION_OP_UNREGISTER)
+	}()
+	go func() {
+		defer wg.Done()
+		retryErrs = applyConcurrently(appCtx, confKey, retrying, REGISTRATION_OP_REGISTER)
+	}()
+	wg.Wait()
+	want := len(registered)
+	for _, err := range leaveErrs {
+		if err == nil {
+			want--
+		}
+	}
+	for _, err := range retryErrs {
+		if err == nil {
+			want++
+		}
+	}
+	if want > testConferenceSeats {
+		t.Fatalf("%d users registered for %d seats", want, testConferenceSeats)
+	}
+	if active := checkSeatShards(t, appCtx, confKey); active != want {
+		t.Fatalf("%d active registrations, want the %d left after the changes that succeeded", active, want)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+/*
+searches.go -- saved conference searches and the daily digest
+    of new conferences matching them
+
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//A Profile can keep at most this many saved searches.
+const MAX_SAVED_SEARCHES = 20
+
+func copySavedSearchToForm(ss *SavedSearch, keyStr string) (*SavedSearchForm, error) {
+	//Copy relevant fields from SavedSearch to SavedSearchForm.
+	ssf := &SavedSearchForm{
+		Name: ss.Name,
+		WebsafeKey: keyStr,
+	}
+	if err := json.Unmarshal(ss.Filters, &ssf.Filters); err != nil {
+		return nil, err
+	}
+	return ssf, nil
+}
+
+func (h *ConferenceApi) SaveSearch(r *http.Request, ssf *SavedSearchForm) (*SavedSearchForm, error) {
+	//Save a named set of queryConferences filters on the user's Profile.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	ssf.Name = strings.TrimSpace(ssf.Name)
+	if ssf.Name == "" {
+		return nil, endpoints.NewBadRequestError("name is required")
+	}
+	if _, _, err := formatFilters(ssf.Filters); err != nil {
+		return nil, err
+	}
+
+	appCtx := appengine.NewContext(r)
+	profKey := datastore.NewKey(appCtx, "Profile", getUserId(user, ""), 0, nil)
+	count, err := datastore.NewQuery("SavedSearch").Ancestor(profKey).KeysOnly().Count(appCtx)
+	if err != nil {
+		return nil, err
+	}
+	if count >= MAX_SAVED_SEARCHES {
+		return nil, endpoints.NewConflictError("You can keep at most %d saved searches", MAX_SAVED_SEARCHES)
+	}
+	filters, err := json.Marshal(ssf.Filters)
+	if err != nil {
+		return nil, err
+	}
+	ss := &SavedSearch{
+		Name: ssf.Name,
+		Filters: filters,
+		CreatedAt: time.Now(),
+	}
+	key, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "SavedSearch", profKey), ss)
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, profKey.StringID(), "savedSearch.create", key, nil, nil, auditSnapshot(ss))
+	return copySavedSearchToForm(ss, key.Encode())
+}
+
+func (h *ConferenceApi) GetSavedSearches(r *http.Request) (*SavedSearchForms, error) {
+	//Return the user's saved searches.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	profKey := datastore.NewKey(appCtx, "Profile", getUserId(user, ""), 0, nil)
+	var searches []SavedSearch
+	keys, err := datastore.NewQuery("SavedSearch").Ancestor(profKey).GetAll(appCtx, &searches)
+	if err != nil {
+		return nil, err
+	}
+	forms := &SavedSearchForms{
+		Items: make([]SavedSearchForm, 0, len(searches)),
+	}
+	for v := range searches {
+		ssf, err := copySavedSearchToForm(&searches[v], keys[v].Encode())
+		if err != nil {
+			return nil, err
+		}
+		forms.Items = append(forms.Items, *ssf)
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) DeleteSavedSearch(r *http.Request, req *SavedSearchRequest) (*BooleanMessage, error) {
+	//Delete one of the user's saved searches.
+	user, err := getAuthedUser(r)
+	if err != nil {
+		return nil, err
+	}
+	key, err := datastore.DecodeKey(req.WebsafeSavedSearchKey)
+	if err != nil || key.Kind() != "SavedSearch" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	profKey := datastore.NewKey(appCtx, "Profile", getUserId(user, ""), 0, nil)
+	if !key.Parent().Equal(profKey) {
+		return nil, endpoints.NotFoundError
+	}
+	var ss SavedSearch
+	if err := datastore.Get(appCtx, key, &ss); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, endpoints.NotFoundError
+		}
+		return nil, err
+	}
+	if err := datastore.Delete(appCtx, key); err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, profKey.StringID(), "savedSearch.delete", key, nil, auditSnapshot(&ss), nil)
+	return &BooleanMessage{Data: true}, nil
+}
+
+func compareResult(c int, operator string) bool {
+	//Apply a datastore operator to the result of a three-way comparison.
+	switch operator {
+	case "=":
+		return c == 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case "!=":
+		return c != 0
+	}
+	return false
+}
+
+func matchesFilters(conf *Conference, filters []ConferenceQueryForm) (bool, error) {
+	//Evaluate formatted filters (see formatFilters) against conf in memory,
+	//the way the datastore would: a multi-valued field matches if any value does.
+	for _, filtr := range filters {
+		ok := false
+		switch filtr.Field {
+		case "City":
+			ok = compareResult(strings.Compare(conf.City, filtr.Value), filtr.Operator)
+		case "Topics":
+			for _, t := range conf.Topics {
+				if compareResult(strings.Compare(t, filtr.Value), filtr.Operator) {
+					ok = true
+					break
+				}
+			}
+		case "Month", "MaxAttendees":
+			val, err := strconv.Atoi(filtr.Value)
+			if err != nil {
+				return false, err
+			}
+			n := conf.Month
+			if filtr.Field == "MaxAttendees" {
+				n = conf.MaxAttendees
+			}
+			ok = compareResult(n - val, filtr.Operator)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func searchDigestTaskName(userId string, since time.Time, until time.Time) string {
+	//Return the task name of one Profile's digest of conferences created
+	//in a window; user ids are hashed like in attendeeMessageTaskName.
+	sum := sha256.Sum256([]byte(userId))
+	return fmt.Sprintf("search-digest-%d-%d-%s", since.UnixNano(), until.UnixNano(), hex.EncodeToString(sum[:16]))
+}
+
+func SendSearchDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	//Match conferences created since the last run against every saved search
+	//and queue one digest email per Profile with new matches. A retried run
+	//covers the same window and names its tasks the same, so nobody gets a
+	//digest twice.
+	if !checkCronRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	runKey := datastore.NewKey(appCtx, "CronRun", "search_digests", 0, nil)
+	var run CronRun
+	err := datastore.Get(appCtx, runKey, &run)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		applog.Errorf(appCtx, "search digests: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if run.RunUntil.IsZero() {
+		run.RunUntil = time.Now()
+		if _, err := datastore.Put(appCtx, runKey, &run); err != nil {
+			applog.Errorf(appCtx, "search digests: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	now := run.RunUntil
+	since := run.LastRun
+	if since.IsZero() {
+		since = now.Add(-24 * time.Hour)
+	}
+
+	var confs []Conference
+	confKeys, err := datastore.NewQuery("Conference").
+		Filter("CreatedAt>", since).
+		Filter("CreatedAt<=", now).
+		GetAll(appCtx, &confs)
+	if err != nil {
+		applog.Errorf(appCtx, "search digests: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//profile ID -> websafe keys of matching conferences, in order
+	matches := make(map[string][]string)
+	if len(confs) > 0 {
+		var searches []SavedSearch
+		keys, err := datastore.NewQuery("SavedSearch").GetAll(appCtx, &searches)
+		if err != nil {
+			applog.Errorf(appCtx, "search digests: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		seen := make(map[string]bool)
+		for v := range searches {
+			var filters []ConferenceQueryForm
+			if err := json.Unmarshal(searches[v].Filters, &filters); err != nil {
+				applog.Warningf(appCtx, "search digests: skipping %v: %v", keys[v], err)
+				continue
+			}
+			_, filters, err = formatFilters(filters)
+			if err != nil {
+				continue
+			}
+			userId := keys[v].Parent().StringID()
+			for c := range confs {
+				if !confs[c].CancelledAt.IsZero() {
+					continue
+				}
+				ok, err := matchesFilters(&confs[c], filters)
+				if err != nil || !ok {
+					continue
+				}
+				confStr := confKeys[c].Encode()
+				if !seen[userId + " " + confStr] {
+					seen[userId + " " + confStr] = true
+					matches[userId] = append(matches[userId], confStr)
+				}
+			}
+		}
+	}
+
+	tasks := make([]*taskqueue.Task, 0, len(matches))
+	for userId, confStrs := range matches {
+		task := taskqueue.NewPOSTTask("/tasks/send_search_digest", url.Values{
+			"userId": {userId},
+			"conferenceKey": confStrs,
+		})
+		task.Name = searchDigestTaskName(userId, since, now)
+		tasks = append(tasks, task)
+	}
+	//the task queue accepts at most 100 tasks per call
+	for len(tasks) > 0 {
+		n := len(tasks)
+		if n > 100 {
+			n = 100
+		}
+		if err := addTasksOnce(appCtx, tasks[:n]); err != nil {
+			applog.Errorf(appCtx, "search digests: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		tasks = tasks[n:]
+	}
+
+	run.LastRun = now
+	run.RunUntil = time.Time{}
+	if _, err := datastore.Put(appCtx, runKey, &run); err != nil {
+		applog.Errorf(appCtx, "search digests: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func SendSearchDigestHandler(w http.ResponseWriter, r *http.Request) {
+	//Email one Profile the new conferences matching its saved searches.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	userId := r.PostFormValue("userId")
+	confKeys := make([]*datastore.Key, 0, len(r.PostForm["conferenceKey"]))
+	for _, k := range r.PostForm["conferenceKey"] {
+		key, err := datastore.DecodeKey(k)
+		if err != nil {
+			continue
+		}
+		confKeys = append(confKeys, key)
+	}
+	conferences := make([]Conference, len(confKeys))
+	if err := datastore.GetMulti(appCtx, confKeys, conferences); err != nil {
+		applog.Errorf(appCtx, "search digest: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	//conferences cancelled since the digest was queued are left out
+	for v := len(conferences) - 1; v >= 0; v-- {
+		if !conferences[v].CancelledAt.IsZero() {
+			conferences = append(conferences[:v], conferences[v+1:]...)
+			confKeys = append(confKeys[:v], confKeys[v+1:]...)
+		}
+	}
+	if len(conferences) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var prof Profile
+	err := datastore.Get(appCtx, datastore.NewKey(appCtx, "Profile", userId, 0, nil), &prof)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	email := prof.MainEmail
+	if email == "" {
+		email = userId
+	}
+
+	host := "https://" + appengine.DefaultVersionHostname(appCtx)
+	body := "Hi, the following new conferences match your saved searches:\r\n\r\n"
+	for v := range conferences {
+		body += conferences[v].Name + " (" + conferences[v].City
+		if !conferences[v].StartDate.IsZero() {
+			body += ", " + conferences[v].StartDate.In(conferenceLocation(&conferences[v])).Format("2006-01-02")
+		}
+		body += ")\r\n" + host + "/#/conference/detail/" + confKeys[v].Encode() + "\r\n\r\n"
+	}
+	msg := &mail.Message{
+		To: []string{email},
+		Subject: "New conferences matching your searches",
+		Body: body,
+	}
+	if err := sendEmail(appCtx, userId, EMAIL_DIGESTS, msg); err != nil {
+		applog.Errorf(appCtx, "search digest: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
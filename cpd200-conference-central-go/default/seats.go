@@ -0,0 +1,177 @@
+package main
+
+/*
+seats.go -- live SeatsAvailable updates, as a Server-Sent Events
+    stream or, where responses cannot be streamed, as a long poll
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+//How often open streams and long polls check for a change, and how long
+//they are held open before the client has to reconnect.
+const (
+	SEATS_CHECK_INTERVAL = time.Second
+	SEATS_STREAM_DURATION = 50 * time.Second
+	SEATS_LONG_POLL_DURATION = 25 * time.Second
+)
+
+func seatsVersionKey(websafeConferenceKey string) string {
+	//Return the memcache key holding a conference's seat version counter.
+	return "SEATS_VERSION_" + websafeConferenceKey
+}
+
+func publishSeatsChanged(appCtx context.Context, websafeConferenceKey string) {
+	//Tell open streams and long polls that SeatsAvailable changed, drop the
+	//cached total and queue its copy to the Conference; called once the
+	//change is committed.
+	err := memcache.Delete(appCtx, seatsAvailableCacheKey(websafeConferenceKey))
+	if err != nil && err != memcache.ErrCacheMiss {
+		applog.Warningf(appCtx, "publish seats for %s: %v", websafeConferenceKey, err)
+	}
+	_, err = memcache.Increment(appCtx, seatsVersionKey(websafeConferenceKey), 1, 0)
+	if err != nil {
+		applog.Warningf(appCtx, "publish seats for %s: %v", websafeConferenceKey, err)
+	}
+	scheduleSeatsRefresh(appCtx, websafeConferenceKey)
+}
+
+func getSeatsVersion(appCtx context.Context, websafeConferenceKey string) uint64 {
+	//Return the current seat version; 0 if never published or evicted.
+	item, err := memcache.Get(appCtx, seatsVersionKey(websafeConferenceKey))
+	if err != nil {
+		return 0
+	}
+	version, _ := strconv.ParseUint(string(item.Value), 10, 64)
+	return version
+}
+
+func getSeatsMessage(appCtx context.Context, confKey *datastore.Key, version uint64) (*SeatsMessage, error) {
+	//Read the committed SeatsAvailable of a conference.
+	conferences := make([]Conference, 1)
+	if err := datastore.Get(appCtx, confKey, &conferences[0]); err != nil {
+		return nil, err
+	}
+	if err := aggregateSeatsAvailable(appCtx, conferences, []*datastore.Key{confKey}); err != nil {
+		return nil, err
+	}
+	return &SeatsMessage{
+		WebsafeConferenceKey: confKey.Encode(),
+		SeatsAvailable: conferences[0].SeatsAvailable,
+		Version: version,
+	}, nil
+}
+
+func seatsConferenceKey(w http.ResponseWriter, r *http.Request) *datastore.Key {
+	//Return the conference key from the request, or reply 400.
+	key, err := datastore.DecodeKey(r.FormValue("websafeConferenceKey"))
+	if err != nil || key.Kind() != "Conference" {
+		http.Error(w, "invalid websafeConferenceKey", http.StatusBadRequest)
+		return nil
+	}
+	return key
+}
+
+func waitSeatsChange(appCtx context.Context, r *http.Request, websafeConferenceKey string, since uint64, deadline time.Time) (uint64, bool) {
+	//Block until the seat version differs from since or deadline passes.
+	for time.Now().Before(deadline) {
+		select {
+		case <-r.Context().Done():
+			return since, false
+		case <-time.After(SEATS_CHECK_INTERVAL):
+		}
+		if version := getSeatsVersion(appCtx, websafeConferenceKey); version != since {
+			return version, true
+		}
+	}
+	return since, false
+}
+
+func SeatsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	//Stream SeatsAvailable of a conference as Server-Sent Events: the current
+	//value first, then one event per committed change. The stream ends after
+	//SEATS_STREAM_DURATION and EventSource reconnects with Last-Event-ID.
+	confKey := seatsConferenceKey(w, r)
+	if confKey == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !SEATS_STREAMING_ENABLED {
+		//no streaming here; the client falls back to /seats/poll
+		http.Error(w, "streaming unsupported, use /seats/poll", http.StatusNotImplemented)
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	websafeKey := confKey.Encode()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", SEATS_CHECK_INTERVAL / time.Millisecond)
+
+	version := getSeatsVersion(appCtx, websafeKey)
+	last, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	send := last != version || r.Header.Get("Last-Event-ID") == ""
+	deadline := time.Now().Add(SEATS_STREAM_DURATION)
+	for {
+		if send {
+			sm, err := getSeatsMessage(appCtx, confKey, version)
+			if err == datastore.ErrNoSuchEntity {
+				fmt.Fprint(w, "event: gone\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			if err != nil {
+				applog.Errorf(appCtx, "seats stream: %v", err)
+				return
+			}
+			js, _ := json.Marshal(sm)
+			fmt.Fprintf(w, "id: %d\nevent: seats\ndata: %s\n\n", version, js)
+			flusher.Flush()
+		}
+		version, send = waitSeatsChange(appCtx, r, websafeKey, version, deadline)
+		if !send {
+			return
+		}
+	}
+}
+
+func SeatsPollHandler(w http.ResponseWriter, r *http.Request) {
+	//Long-poll fallback for SeatsStreamHandler: reply at once if the seat
+	//version differs from ?since=, else wait up to SEATS_LONG_POLL_DURATION.
+	//Replies with the current SeatsMessage either way.
+	confKey := seatsConferenceKey(w, r)
+	if confKey == nil {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	websafeKey := confKey.Encode()
+	version := getSeatsVersion(appCtx, websafeKey)
+	if since, err := strconv.ParseUint(r.FormValue("since"), 10, 64); err == nil && since == version {
+		version, _ = waitSeatsChange(appCtx, r, websafeKey, since, time.Now().Add(SEATS_LONG_POLL_DURATION))
+	}
+	sm, err := getSeatsMessage(appCtx, confKey, version)
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		applog.Errorf(appCtx, "seats poll: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(sm)
+}
@@ -0,0 +1,345 @@
+package main
+
+/*
+seatshards.go -- sharded seat counters, so registrations for one
+    conference don't all serialize on a single entity group
+
+Each conference's seats are split over SeatShard root entities. A shard
+owns Allocated seats of which Taken are registered, and a user always
+registers on the same shard, picked by hashing the userId; the Registration
+is a child of that shard. Taking a seat is a single-group transaction on
+the shard. A full shard borrows free seats from another shard in a
+cross-group transaction moving Allocated between the two, so the total of
+free seats never grows and conferences are never oversold.
+
+Each ticket type of a conference is a seat pool of its own, sharded the
+same way. A ticket takes seats from both the conference's pool, capped by
+MaxAttendees, and its type's pool, capped by the type's Capacity.
+
+*/
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//Seat pools get one shard per SEATS_PER_SHARD seats, at most MAX_SEAT_SHARDS;
+//shards and the Conference must fit in one cross-group transaction.
+const (
+	SEATS_PER_SHARD = 10
+	MAX_SEAT_SHARDS = 20
+)
+
+//Aggregated SeatsAvailable is cached this long, and copied back to the
+//stored Conference at most once per SEATS_REFRESH_DELAY.
+const (
+	SEATS_AVAILABLE_CACHE_TTL = 30 * time.Second
+	SEATS_REFRESH_DELAY = 10 * time.Second
+)
+
+//Attempts at borrowing seats for a full shard before giving up.
+const SEAT_REBALANCE_ATTEMPTS = 3
+
+//shardFullError is returned from a registration transaction whose shard
+//in a seat pool has too few free seats; the caller rebalances and retries.
+type shardFullError struct {
+	poolKey *datastore.Key
+	shards int
+	index int
+}
+
+func (e *shardFullError) Error() string {
+	return "seat shard " + strconv.Itoa(e.index) + " of " + e.poolKey.String() + " full"
+}
+
+func seatShardCount(seats int) int {
+	//Return the number of shards for a seat pool with this many seats.
+	n := seats / SEATS_PER_SHARD
+	if n < 1 {
+		n = 1
+	}
+	if n > MAX_SEAT_SHARDS {
+		n = MAX_SEAT_SHARDS
+	}
+	return n
+}
+
+func seatShardKey(appCtx context.Context, poolKey *datastore.Key, i int) *datastore.Key {
+	//Return the key of shard i of a seat pool, a Conference or TicketType;
+	//shards are root entities.
+	return datastore.NewKey(appCtx, "SeatShard", poolKey.Encode() + "/" + strconv.Itoa(i), 0, nil)
+}
+
+func seatShardKeys(appCtx context.Context, poolKey *datastore.Key, n int) []*datastore.Key {
+	//Return the keys of all n shards of a seat pool.
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = seatShardKey(appCtx, poolKey, i)
+	}
+	return keys
+}
+
+func newSeatShards(websafeConferenceKey string, n int, free int) []SeatShard {
+	//Return n shards splitting free seats between them.
+	shards := make([]SeatShard, n)
+	for i := range shards {
+		shards[i] = SeatShard{
+			ConferenceKey: websafeConferenceKey,
+			Allocated: free / n,
+		}
+		if i < free % n {
+			shards[i].Allocated++
+		}
+	}
+	return shards
+}
+
+func seatShardIndex(userId string, n int) int {
+	//Return the shard userId registers on.
+	h := fnv.New32a()
+	h.Write([]byte(userId))
+	return int(h.Sum32() % uint32(n))
+}
+
+func registrationKey(appCtx context.Context, confKey *datastore.Key, shards int, userId string) *datastore.Key {
+	//Return the key of userId's Registration for a conference with this
+	//many shards. It is a child of the user's shard, so the seat and the
+	//registration change in one transaction.
+	shardKey := seatShardKey(appCtx, confKey, seatShardIndex(userId, shards))
+	return datastore.NewKey(appCtx, "Registration", userId, 0, shardKey)
+}
+
+func ensureSeatShards(appCtx context.Context, confKey *datastore.Key) (*Conference, error) {
+	//Return the Conference, first splitting its free seats over shards if
+	//it has none yet.
+	var conf Conference
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+		return nil, err
+	}
+	if conf.SeatShards > 0 {
+		return &conf, nil
+	}
+	err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		if conf.SeatShards > 0 {
+			return nil
+		}
+		free := conf.SeatsAvailable
+		if free < 0 {
+			free = 0
+		}
+		n := seatShardCount(conf.MaxAttendees)
+		keys := seatShardKeys(appCtx, confKey, n)
+		shards := newSeatShards(confKey.Encode(), n, free)
+		if _, err := datastore.PutMulti(appCtx, keys, shards); err != nil {
+			return err
+		}
+		conf.SeatShards = n
+		_, err := datastore.Put(appCtx, confKey, &conf)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+func rebalanceSeats(appCtx context.Context, poolKey *datastore.Key, shards int, target int, need int) (bool, error) {
+	//Move free seats from the shard of a pool with the most to shard target,
+	//at least enough for target to have need free if the donor can spare them.
+	//Returns false if no other shard has a free seat.
+	for attempt := 0; attempt < SEAT_REBALANCE_ATTEMPTS; attempt++ {
+		keys := seatShardKeys(appCtx, poolKey, shards)
+		all := make([]SeatShard, shards)
+		if err := datastore.GetMulti(appCtx, keys, all); err != nil {
+			return false, err
+		}
+		donor := -1
+		for i := range all {
+			if i != target && all[i].Allocated - all[i].Taken > 0 &&
+				(donor < 0 || all[i].Allocated - all[i].Taken > all[donor].Allocated - all[donor].Taken) {
+				donor = i
+			}
+		}
+		if donor < 0 {
+			return false, nil
+		}
+		moved := false
+		err := datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+			pair := []*datastore.Key{keys[donor], keys[target]}
+			s := make([]SeatShard, 2)
+			if err := datastore.GetMulti(appCtx, pair, s); err != nil {
+				return err
+			}
+			free := s[0].Allocated - s[0].Taken
+			if free <= 0 {
+				return nil
+			}
+			//take half, so the next full shard still finds some here
+			n := (free + 1) / 2
+			if missing := need - (s[1].Allocated - s[1].Taken); n < missing {
+				n = missing
+			}
+			if n > free {
+				n = free
+			}
+			s[0].Allocated -= n
+			s[1].Allocated += n
+			_, err := datastore.PutMulti(appCtx, pair, s)
+			moved = err == nil
+			return err
+		}, &datastore.TransactionOptions{XG: true})
+		if err != nil && err != datastore.ErrConcurrentTransaction {
+			return false, err
+		}
+		if moved {
+			return true, nil
+		}
+	}
+	return false, datastore.ErrConcurrentTransaction
+}
+
+func seatsAvailableCacheKey(websafePoolKey string) string {
+	//Return the memcache key holding a seat pool's aggregated free seats.
+	return "SEATS_AVAILABLE_" + websafePoolKey
+}
+
+func sumSeatsAvailable(appCtx context.Context, poolKeys []*datastore.Key, shardCounts []int) ([]int, error) {
+	//Return the free seats of each pool totalled over its shards, from
+	//memcache when possible. Pools without shards get -1.
+	free := make([]int, len(poolKeys))
+	cacheKeys := make([]string, 0, len(poolKeys))
+	for v := range poolKeys {
+		if shardCounts[v] > 0 {
+			cacheKeys = append(cacheKeys, seatsAvailableCacheKey(poolKeys[v].Encode()))
+		}
+	}
+	if len(cacheKeys) == 0 {
+		for v := range free {
+			free[v] = -1
+		}
+		return free, nil
+	}
+	cached, err := memcache.GetMulti(appCtx, cacheKeys)
+	if err != nil {
+		applog.Warningf(appCtx, "seats available cache: %v", err)
+	}
+	for v := range poolKeys {
+		free[v] = -1
+		if shardCounts[v] == 0 {
+			continue
+		}
+		cacheKey := seatsAvailableCacheKey(poolKeys[v].Encode())
+		if item, ok := cached[cacheKey]; ok {
+			if n, err := strconv.Atoi(string(item.Value)); err == nil {
+				free[v] = n
+				continue
+			}
+		}
+		shards := make([]SeatShard, shardCounts[v])
+		if err := datastore.GetMulti(appCtx, seatShardKeys(appCtx, poolKeys[v], shardCounts[v]), shards); err != nil {
+			return nil, err
+		}
+		free[v] = 0
+		for i := range shards {
+			free[v] += shards[i].Allocated - shards[i].Taken
+		}
+		memcache.Set(appCtx, &memcache.Item{
+			Key: cacheKey,
+			Value: []byte(strconv.Itoa(free[v])),
+			Expiration: SEATS_AVAILABLE_CACHE_TTL,
+		})
+	}
+	return free, nil
+}
+
+func aggregateSeatsAvailable(appCtx context.Context, conferences []Conference, keys []*datastore.Key) error {
+	//Replace the stored SeatsAvailable of sharded conferences with the
+	//total over their shards.
+	shardCounts := make([]int, len(conferences))
+	for v := range conferences {
+		shardCounts[v] = conferences[v].SeatShards
+	}
+	free, err := sumSeatsAvailable(appCtx, keys, shardCounts)
+	if err != nil {
+		return err
+	}
+	for v := range conferences {
+		if free[v] >= 0 {
+			conferences[v].SeatsAvailable = free[v]
+		}
+	}
+	return nil
+}
+
+func scheduleSeatsRefresh(appCtx context.Context, websafeConferenceKey string) {
+	//Queue a copy of the aggregated SeatsAvailable onto the stored Conference,
+	//which queries and the announcement filter on. Named tasks coalesce
+	//the changes of each SEATS_REFRESH_DELAY window into one write.
+	window := time.Now().Unix() / int64(SEATS_REFRESH_DELAY / time.Second)
+	task := taskqueue.NewPOSTTask("/tasks/refresh_seats_available", url.Values{
+		"conferenceKey": {websafeConferenceKey},
+	})
+	task.Name = "seats-" + websafeConferenceKey + "-" + strconv.FormatInt(window, 10)
+	task.Delay = SEATS_REFRESH_DELAY
+	_, err := taskqueue.Add(appCtx, task, "")
+	if err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		applog.Warningf(appCtx, "refresh seats for %s: %v", websafeConferenceKey, err)
+	}
+}
+
+func RefreshSeatsAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	//Store the total free seats over a conference's shards in Conference.SeatsAvailable.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	confKey, err := datastore.DecodeKey(r.PostFormValue("conferenceKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var conf Conference
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil || conf.SeatShards == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	shards := make([]SeatShard, conf.SeatShards)
+	if err := datastore.GetMulti(appCtx, seatShardKeys(appCtx, confKey, conf.SeatShards), shards); err != nil {
+		applog.Errorf(appCtx, "refresh seats: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	free := 0
+	for i := range shards {
+		free += shards[i].Allocated - shards[i].Taken
+	}
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		if conf.SeatsAvailable == free {
+			return nil
+		}
+		conf.SeatsAvailable = free
+		_, err := datastore.Put(appCtx, confKey, &conf)
+		return err
+	}, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "refresh seats: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
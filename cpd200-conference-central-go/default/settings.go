@@ -16,4 +16,47 @@ import (
 //Console or Cloud Console.
 const (
 	WEB_CLIENT_ID = "replace with Web client ID"
+	ANDROID_CLIENT_ID = "replace with Android client ID"
+	ANDROID_AUDIENCE = WEB_CLIENT_ID
 )
+
+//The secret signing the links sent by email (e.g. unsubscribe links) so
+//they can be trusted without a login is set in app.yaml's env_variables;
+//replace SIGNING_SECRET there with a long random string. Links are only
+//signed with the placeholder on the development server.
+const (
+	SIGNING_SECRET_PLACEHOLDER = "replace with a random secret"
+)
+
+//Set to true where HTTP responses can be streamed (not on the App Engine
+//standard go1 runtime, which buffers them); otherwise live seat updates
+//use the /seats/poll long poll.
+const (
+	SEATS_STREAMING_ENABLED = false
+)
+
+//Payment provider taking new payments; see payments.go. The fake provider
+//only takes payments on the development server unless
+//FAKE_PAYMENTS_IN_PRODUCTION is set, e.g. on a staging app.
+const (
+	PAYMENT_PROVIDER = FAKE_PAYMENT_PROVIDER
+	FAKE_PAYMENTS_IN_PRODUCTION = false
+)
+
+//Blob stores keeping uploaded files such as avatars; see blobs.go.
+//BLOB_STORE is used in production, keeping files in GCS_BLOB_BUCKET, or
+//the app's default Cloud Storage bucket when empty. DEV_BLOB_STORE is used
+//on the development server; the local store keeps files in
+//LOCAL_BLOB_STORE_DIR, or a directory under the system's temporary
+//directory when empty.
+const (
+	BLOB_STORE = GCS_BLOB_STORE
+	GCS_BLOB_BUCKET = ""
+	DEV_BLOB_STORE = LOCAL_BLOB_STORE
+	LOCAL_BLOB_STORE_DIR = ""
+)
+
+//Emails of users allowed to read the whole audit log, on top of
+//App Engine admins.
+var ADMIN_EMAILS = []string{
+}
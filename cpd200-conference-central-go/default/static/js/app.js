@@ -62,6 +62,33 @@ app.filter('startFrom', function () {
     return filter;
 });
 
+/**
+ * @ngdoc filter
+ * @name localDate
+ *
+ * @description
+ * A filter that formats an RFC3339 date in the time zone it was written in,
+ * i.e. the conference's own time zone rather than the browser's.
+ *
+ */
+app.filter('localDate', function ($filter) {
+    /**
+     * Formats the date part of an RFC3339 string.
+     *
+     * @param {string} value an RFC3339 date, e.g. 2016-05-30T09:00:00+02:00
+     * @param {string} format a format accepted by the date filter
+     * @returns {string}
+     */
+    var filter = function (value, format) {
+        if (!value || value.length < 10) {
+            return value;
+        }
+        var parts = value.substring(0, 10).split('-');
+        return $filter('date')(new Date(parts[0], parts[1] - 1, parts[2]), format);
+    }
+    return filter;
+});
+
 
 /**
  * @ngdoc constant
@@ -17,6 +17,28 @@ var conferenceApp = conferenceApp || {};
  */
 conferenceApp.controllers = angular.module('conferenceControllers', ['ui.bootstrap']);
 
+/**
+ * Returns a readable message for a failed API call. Validation failures carry
+ * a JSON message listing each invalid field and why; those are joined up.
+ *
+ * @param error resp.error of the failed call.
+ * @returns {string} the message.
+ */
+conferenceApp.errorMessage = function (error) {
+    var message = (error && error.message) || '';
+    try {
+        var details = JSON.parse(message);
+        if (details.fieldErrors) {
+            return details.fieldErrors.map(function (fe) {
+                return fe.field + ' ' + fe.reason;
+            }).join(', ');
+        }
+    } catch (e) {
+        // Not a validation failure.
+    }
+    return message;
+};
+
 /**
  * @ngdoc controller
  * @name MyProfileCtrl
@@ -25,7 +47,7 @@ conferenceApp.controllers = angular.module('conferenceControllers', ['ui.bootstr
  * A controller used for the My Profile page.
  */
 conferenceApp.controllers.controller('MyProfileCtrl',
-    function ($scope, $log, oauth2Provider, HTTP_ERRORS) {
+    function ($scope, $log, $window, $location, oauth2Provider, HTTP_ERRORS) {
         $scope.submitted = false;
         $scope.loading = false;
 
@@ -73,6 +95,14 @@ conferenceApp.controllers.controller('MyProfileCtrl',
                                 // Succeeded to get the user profile.
                                 $scope.profile.displayName = resp.result.displayName;
                                 $scope.profile.teeShirtSize = resp.result.teeShirtSize;
+                                $scope.profile.affiliation = resp.result.affiliation;
+                                $scope.profile.jobTitle = resp.result.jobTitle;
+                                $scope.profile.location = resp.result.location;
+                                $scope.profile.bio = resp.result.bio;
+                                $scope.profile.emailPreferences = resp.result.emailPreferences;
+                                $scope.linksText = (resp.result.links || []).join('\n');
+                                $scope.initialLinksText = $scope.linksText;
+                                $scope.avatarUrl = resp.result.avatarThumbnailUrl;
                                 $scope.initialProfile = resp.result;
                             }
                         });
@@ -94,13 +124,16 @@ conferenceApp.controllers.controller('MyProfileCtrl',
         $scope.saveProfile = function () {
             $scope.submitted = true;
             $scope.loading = true;
+            $scope.profile.links = ($scope.linksText || '').split('\n').filter(function (link) {
+                return link.trim() != '';
+            });
             gapi.client.conference.saveProfile($scope.profile).
                 execute(function (resp) {
                     $scope.$apply(function () {
                         $scope.loading = false;
                         if (resp.error) {
                             // The request has failed.
-                            var errorMessage = resp.error.message || '';
+                            var errorMessage = conferenceApp.errorMessage(resp.error);
                             $scope.messages = 'Failed to update a profile : ' + errorMessage;
                             $scope.alertStatus = 'warning';
                             $log.error($scope.messages + 'Profile : ' + JSON.stringify($scope.profile));
@@ -116,14 +149,118 @@ conferenceApp.controllers.controller('MyProfileCtrl',
                             $scope.submitted = false;
                             $scope.initialProfile = {
                                 displayName: $scope.profile.displayName,
-                                teeShirtSize: $scope.profile.teeShirtSize
+                                teeShirtSize: $scope.profile.teeShirtSize,
+                                affiliation: $scope.profile.affiliation,
+                                jobTitle: $scope.profile.jobTitle,
+                                location: $scope.profile.location,
+                                bio: $scope.profile.bio
                             };
+                            $scope.initialLinksText = $scope.linksText;
 
                             $log.info($scope.messages + JSON.stringify(resp.result));
                         }
                     });
                 });
         };
+
+        /**
+         * Handles the result of the conference.setAvatar and deleteAvatar APIs.
+         */
+        var avatarCallback = function (resp) {
+            $scope.$apply(function () {
+                $scope.loading = false;
+                if (resp.error) {
+                    var errorMessage = conferenceApp.errorMessage(resp.error);
+                    $scope.messages = 'Failed to update the picture : ' + errorMessage;
+                    $scope.alertStatus = 'warning';
+                    if (resp.code && resp.code == HTTP_ERRORS.UNAUTHORIZED) {
+                        oauth2Provider.showLoginModal();
+                    }
+                } else {
+                    $scope.messages = 'The picture has been updated';
+                    $scope.alertStatus = 'success';
+                    $scope.avatarUrl = resp.result.avatarThumbnailUrl;
+                }
+            });
+        };
+
+        /**
+         * Invokes the conference.setAvatar API with the file picked in input.
+         */
+        $scope.uploadAvatar = function (input) {
+            var file = input.files && input.files[0];
+            if (!file) {
+                return;
+            }
+            var reader = new FileReader();
+            reader.onload = function () {
+                gapi.client.conference.setAvatar({data: reader.result}).execute(avatarCallback);
+            };
+            $scope.$apply(function () {
+                $scope.loading = true;
+            });
+            reader.readAsDataURL(file);
+            input.value = '';
+        };
+
+        /**
+         * Invokes the conference.deleteAvatar API.
+         */
+        $scope.deleteAvatar = function () {
+            $scope.loading = true;
+            gapi.client.conference.deleteAvatar().execute(avatarCallback);
+        };
+
+        /**
+         * The deleteMyAccount request being filled in.
+         * @type {{}}
+         */
+        $scope.deleteAccount = {};
+
+        /**
+         * Invokes the conference.exportMyData API and downloads the archive.
+         */
+        $scope.exportMyData = function () {
+            $scope.loading = true;
+            gapi.client.conference.exportMyData().execute(function (resp) {
+                $scope.$apply(function () {
+                    $scope.loading = false;
+                    if (resp.error) {
+                        var errorMessage = conferenceApp.errorMessage(resp.error);
+                        $scope.messages = 'Failed to export your data : ' + errorMessage;
+                        $scope.alertStatus = 'warning';
+                    } else {
+                        $window.location.href = resp.result.data;
+                    }
+                });
+            });
+        };
+
+        /**
+         * Invokes the conference.deleteMyAccount API.
+         */
+        $scope.deleteMyAccount = function () {
+            if (!$window.confirm('Delete your account? This cannot be undone.')) {
+                return;
+            }
+            $scope.loading = true;
+            gapi.client.conference.deleteMyAccount($scope.deleteAccount).execute(function (resp) {
+                $scope.$apply(function () {
+                    $scope.loading = false;
+                    if (resp.error) {
+                        var errorMessage = conferenceApp.errorMessage(resp.error);
+                        $scope.messages = 'Failed to delete your account : ' + errorMessage;
+                        $scope.alertStatus = 'warning';
+                    } else {
+                        $scope.messages = 'Your account has been deleted';
+                        $scope.alertStatus = 'success';
+                        $scope.deleteAccount = {};
+                        oauth2Provider.signOut();
+                        $location.path('/');
+                    }
+                });
+            });
+        };
     })
 ;
 
@@ -135,13 +272,25 @@ conferenceApp.controllers.controller('MyProfileCtrl',
  * A controller used for the Create conferences page.
  */
 conferenceApp.controllers.controller('CreateConferenceCtrl',
-    function ($scope, $log, oauth2Provider, HTTP_ERRORS) {
+    function ($scope, $log, $filter, oauth2Provider, HTTP_ERRORS) {
+
+        /**
+         * Returns the browser's IANA time zone, used as the default for new conferences.
+         * @returns {string}
+         */
+        var browserTimeZone = function () {
+            try {
+                return Intl.DateTimeFormat().resolvedOptions().timeZone || 'UTC';
+            } catch (e) {
+                return 'UTC';
+            }
+        };
 
         /**
          * The conference object being edited in the page.
          * @type {{}|*}
          */
-        $scope.conference = $scope.conference || {};
+        $scope.conference = $scope.conference || {timeZone: browserTimeZone()};
 
         /**
          * Holds the default values for the input candidates for city select.
@@ -213,14 +362,23 @@ conferenceApp.controllers.controller('CreateConferenceCtrl',
                 return;
             }
 
+            // Send the picked days as local dates; the server reads them in conference.timeZone.
+            var request = angular.copy($scope.conference);
+            if (request.startDate) {
+                request.startDate = $filter('date')(request.startDate, 'yyyy-MM-dd');
+            }
+            if (request.endDate) {
+                request.endDate = $filter('date')(request.endDate, 'yyyy-MM-dd');
+            }
+
             $scope.loading = true;
-            gapi.client.conference.createConference($scope.conference).
+            gapi.client.conference.createConference(request).
                 execute(function (resp) {
                     $scope.$apply(function () {
                         $scope.loading = false;
                         if (resp.error) {
                             // The request has failed.
-                            var errorMessage = resp.error.message || '';
+                            var errorMessage = conferenceApp.errorMessage(resp.error);
                             $scope.messages = 'Failed to create a conference : ' + errorMessage;
                             $scope.alertStatus = 'warning';
                             $log.error($scope.messages + ' Conference : ' + JSON.stringify($scope.conference));
@@ -234,7 +392,7 @@ conferenceApp.controllers.controller('CreateConferenceCtrl',
                             $scope.messages = 'The conference has been created : ' + resp.result.name;
                             $scope.alertStatus = 'success';
                             $scope.submitted = false;
-                            $scope.conference = {};
+                            $scope.conference = {timeZone: request.timeZone};
                             $log.info($scope.messages + ' : ' + JSON.stringify(resp.result));
                         }
                     });
@@ -306,6 +464,7 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
     $scope.tabAllSelected = function () {
         $scope.selectedTab = 'ALL';
         $scope.queryConferences();
+        $scope.getSavedSearches();
     };
 
     /**
@@ -408,6 +567,138 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
         }
     };
 
+    /**
+     * Returns the filters as sent to the conference.queryConferences API.
+     *
+     * @returns {Array}
+     */
+    var formFilters = function () {
+        var filters = [];
+        for (var i = 0; i < $scope.filters.length; i++) {
+            var filter = $scope.filters[i];
+            if (filter.field && filter.operator && filter.value) {
+                filters.push({
+                    field: filter.field.enumValue,
+                    operator: filter.operator.enumValue,
+                    value: filter.value
+                });
+            }
+        }
+        return filters;
+    };
+
+    /**
+     * Returns the element of options whose enumValue is value.
+     */
+    var findEnum = function (options, value) {
+        for (var i = 0; i < options.length; i++) {
+            if (options[i].enumValue == value) {
+                return options[i];
+            }
+        }
+        return options[0];
+    };
+
+    /**
+     * The saved searches of the user, and the name to save the current filters under.
+     * @type {Array}
+     */
+    $scope.savedSearches = [];
+    $scope.savedSearchName = '';
+
+    /**
+     * Handles a failed saved search request.
+     */
+    var savedSearchError = function (action, resp) {
+        var errorMessage = conferenceApp.errorMessage(resp.error);
+        $scope.messages = 'Failed to ' + action + ' : ' + errorMessage;
+        $scope.alertStatus = 'warning';
+        $log.error($scope.messages);
+        if (resp.code && resp.code == HTTP_ERRORS.UNAUTHORIZED) {
+            oauth2Provider.showLoginModal();
+        }
+    };
+
+    /**
+     * Invokes the conference.getSavedSearches API.
+     */
+    $scope.getSavedSearches = function () {
+        if (!oauth2Provider.signedIn) {
+            return;
+        }
+        gapi.client.conference.getSavedSearches().execute(function (resp) {
+            $scope.$apply(function () {
+                if (resp.error) {
+                    savedSearchError('get the saved searches', resp);
+                } else {
+                    $scope.savedSearches = resp.result.items || [];
+                }
+            });
+        });
+    };
+
+    /**
+     * Invokes the conference.saveSearch API with the current filters.
+     */
+    $scope.saveSearch = function () {
+        if (!oauth2Provider.signedIn) {
+            oauth2Provider.showLoginModal();
+            return;
+        }
+        var request = {name: $scope.savedSearchName, filters: formFilters()};
+        $scope.loading = true;
+        gapi.client.conference.saveSearch(request).execute(function (resp) {
+            $scope.$apply(function () {
+                $scope.loading = false;
+                if (resp.error) {
+                    savedSearchError('save the search', resp);
+                } else {
+                    $scope.messages = 'The search has been saved : ' + resp.result.name;
+                    $scope.alertStatus = 'success';
+                    $scope.savedSearchName = '';
+                    $scope.savedSearches.push(resp.result);
+                }
+            });
+        });
+    };
+
+    /**
+     * Replaces the filters with those of a saved search, and runs it.
+     *
+     * @param savedSearch
+     */
+    $scope.applySavedSearch = function (savedSearch) {
+        $scope.filters = [];
+        angular.forEach(savedSearch.filters, function (filter) {
+            $scope.filters.push({
+                field: findEnum($scope.filtereableFields, filter.field),
+                operator: findEnum($scope.operators, filter.operator),
+                value: filter.value
+            });
+        });
+        $scope.queryConferences();
+    };
+
+    /**
+     * Invokes the conference.deleteSavedSearch API.
+     *
+     * @param savedSearch
+     */
+    $scope.deleteSavedSearch = function (savedSearch) {
+        $scope.loading = true;
+        gapi.client.conference.deleteSavedSearch({websafeSavedSearchKey: savedSearch.websafeKey}).
+            execute(function (resp) {
+                $scope.$apply(function () {
+                    $scope.loading = false;
+                    if (resp.error) {
+                        savedSearchError('delete the saved search', resp);
+                    } else {
+                        $scope.savedSearches.splice($scope.savedSearches.indexOf(savedSearch), 1);
+                    }
+                });
+            });
+    };
+
     /**
      * Query the conferences depending on the tab currently selected.
      *
@@ -428,17 +719,7 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
      */
     $scope.queryConferencesAll = function () {
         var sendFilters = {
-            filters: []
-        }
-        for (var i = 0; i < $scope.filters.length; i++) {
-            var filter = $scope.filters[i];
-            if (filter.field && filter.operator && filter.value) {
-                sendFilters.filters.push({
-                    field: filter.field.enumValue,
-                    operator: filter.operator.enumValue,
-                    value: filter.value
-                });
-            }
+            filters: formFilters()
         }
         $scope.loading = true;
         gapi.client.conference.queryConferences(sendFilters).
@@ -447,7 +728,7 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
                     $scope.loading = false;
                     if (resp.error) {
                         // The request has failed.
-                        var errorMessage = resp.error.message || '';
+                        var errorMessage = conferenceApp.errorMessage(resp.error);
                         $scope.messages = 'Failed to query conferences : ' + errorMessage;
                         $scope.alertStatus = 'warning';
                         $log.error($scope.messages + ' filters : ' + JSON.stringify(sendFilters));
@@ -537,6 +818,47 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
                 });
             });
     };
+
+    /**
+     * The secret calendar subscription URLs of the user, once requested.
+     */
+    $scope.calendarFeed = null;
+
+    /**
+     * Invokes the conference.getCalendarFeed method, or conference.resetCalendarFeed if reset is true.
+     */
+    var calendarFeed = function (reset) {
+        var method = reset ? gapi.client.conference.resetCalendarFeed : gapi.client.conference.getCalendarFeed;
+        $scope.loading = true;
+        method().execute(function (resp) {
+            $scope.$apply(function () {
+                $scope.loading = false;
+                if (resp.error) {
+                    // The request has failed.
+                    var errorMessage = conferenceApp.errorMessage(resp.error);
+                    $scope.messages = 'Failed to get the calendar subscription : ' + errorMessage;
+                    $scope.alertStatus = 'warning';
+                    $log.error($scope.messages);
+
+                    if (resp.code && resp.code == HTTP_ERRORS.UNAUTHORIZED) {
+                        oauth2Provider.showLoginModal();
+                        return;
+                    }
+                } else {
+                    // The request has succeeded.
+                    $scope.calendarFeed = resp.result;
+                }
+            });
+        });
+    };
+
+    $scope.getCalendarFeed = function () {
+        calendarFeed(false);
+    };
+
+    $scope.resetCalendarFeed = function () {
+        calendarFeed(true);
+    };
 });
 
 
@@ -547,11 +869,85 @@ conferenceApp.controllers.controller('ShowConferenceCtrl', function ($scope, $lo
  * @description
  * A controller used for the conference detail page.
  */
-conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $log, $routeParams, HTTP_ERRORS) {
+conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $log, $routeParams, $http, $timeout, HTTP_ERRORS) {
     $scope.conference = {};
 
     $scope.isUserAttending = false;
 
+    /**
+     * The ticket type and number of tickets to register with, for conferences with ticket types.
+     */
+    $scope.registration = {quantity: 1};
+
+    /**
+     * The open seats EventSource, or the pending long poll timer.
+     */
+    var seatsSource = null;
+    var seatsPollTimer = null;
+    var seatsStopped = false;
+
+    /**
+     * Applies a seats update pushed by the server.
+     *
+     * @param update {websafeConferenceKey, seatsAvailable, version}
+     */
+    var applySeats = function (update) {
+        $scope.conference.seatsAvailable = update.seatsAvailable;
+    };
+
+    /**
+     * Long polls /seats/poll; used where the server can't stream events.
+     *
+     * @param since the last seen version, undefined on the first call.
+     */
+    var pollSeats = function (since) {
+        if (seatsStopped) {
+            return;
+        }
+        $http.get('/seats/poll', {
+            params: {websafeConferenceKey: $routeParams.websafeConferenceKey, since: since}
+        }).then(function (resp) {
+            applySeats(resp.data);
+            pollSeats(resp.data.version);
+        }, function () {
+            seatsPollTimer = $timeout(function () {
+                pollSeats(since);
+            }, 5000);
+        });
+    };
+
+    /**
+     * Keeps conference.seatsAvailable live, via Server-Sent Events when
+     * available, falling back to long polling.
+     */
+    var watchSeats = function () {
+        if (!window.EventSource) {
+            pollSeats();
+            return;
+        }
+        seatsSource = new EventSource('/seats/stream?websafeConferenceKey=' +
+            encodeURIComponent($routeParams.websafeConferenceKey));
+        seatsSource.addEventListener('seats', function (e) {
+            $scope.$apply(function () {
+                applySeats(JSON.parse(e.data));
+            });
+        });
+        seatsSource.onerror = function () {
+            if (seatsSource.readyState == EventSource.CLOSED) {
+                seatsSource = null;
+                pollSeats();
+            }
+        };
+    };
+
+    $scope.$on('$destroy', function () {
+        seatsStopped = true;
+        if (seatsSource) {
+            seatsSource.close();
+        }
+        $timeout.cancel(seatsPollTimer);
+    });
+
     /**
      * Initializes the conference detail page.
      * Invokes the conference.getConference method and sets the returned conference in the $scope.
@@ -575,6 +971,7 @@ conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $
                     // The request has succeeded.
                     $scope.alertStatus = 'success';
                     $scope.conference = resp.result;
+                    watchSeats();
                 }
             });
         });
@@ -603,22 +1000,124 @@ conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $
 
 
     /**
-     * Invokes the conference.registerForConference method.
+     * Returns the selected ticket type, if any.
+     */
+    var selectedTicketType = function () {
+        var ticketTypes = $scope.conference.ticketTypes || [];
+        for (var i = 0; i < ticketTypes.length; i++) {
+            if (ticketTypes[i].websafeKey == $scope.registration.websafeTicketTypeKey) {
+                return ticketTypes[i];
+            }
+        }
+        return null;
+    };
+
+    /**
+     * Shows a failed registration step.
+     *
+     * @param resp the response with the error, if any.
+     */
+    var registrationFailed = function (resp) {
+        $scope.loading = false;
+        var errorMessage = (resp && resp.error && resp.error.message) || '';
+        $scope.messages = 'Failed to register for the conference : ' + errorMessage;
+        $scope.alertStatus = 'warning';
+        $log.error($scope.messages);
+    };
+
+    /**
+     * Shows a completed registration.
+     *
+     * @param quantity the number of seats taken.
+     */
+    var registrationDone = function (quantity) {
+        $scope.loading = false;
+        $scope.messages = 'Registered for the conference';
+        $scope.alertStatus = 'success';
+        $scope.isUserAttending = true;
+        $scope.conference.seatsAvailable = $scope.conference.seatsAvailable - quantity;
+    };
+
+    /**
+     * Registers for a paid ticket: holds the seats, pays for them and
+     * completes the registration once the payment succeeded.
+     *
+     * @param quantity the number of tickets.
+     */
+    var checkout = function (quantity) {
+        var key = $routeParams.websafeConferenceKey;
+        var finish = function (resp) {
+            $scope.$apply(function () {
+                if (resp.error || !resp.result) {
+                    registrationFailed(resp);
+                } else {
+                    registrationDone(quantity);
+                }
+            });
+        };
+        gapi.client.conference.holdSeat({
+            websafeConferenceKey: key,
+            websafeTicketTypeKey: $scope.registration.websafeTicketTypeKey,
+            quantity: quantity,
+            promoCode: $scope.registration.promoCode
+        }).execute(function (hold) {
+            if (hold.error) {
+                $scope.$apply(function () {
+                    registrationFailed(hold);
+                });
+                return;
+            }
+            if (Number(hold.result.amount) == 0) {
+                // Discounted to nothing.
+                gapi.client.conference.confirmHold({websafeConferenceKey: key}).execute(finish);
+                return;
+            }
+            gapi.client.conference.payForHold({websafeConferenceKey: key}).execute(function (payment) {
+                if (payment.error) {
+                    $scope.$apply(function () {
+                        registrationFailed(payment);
+                    });
+                    return;
+                }
+                if (payment.result.provider != 'fake') {
+                    // Other providers confirm the payment in their own client library.
+                    $scope.$apply(function () {
+                        $scope.loading = false;
+                        $scope.messages = 'Complete the payment with ' + payment.result.provider;
+                        $scope.alertStatus = 'info';
+                    });
+                    return;
+                }
+                gapi.client.conference.confirmPayment({
+                    websafeConferenceKey: key,
+                    paymentMethod: 'fake_card'
+                }).execute(finish);
+            });
+        });
+    };
+
+    /**
+     * Invokes the conference.registerForConference method, or checks out
+     * paid tickets.
      */
     $scope.registerForConference = function () {
         $scope.loading = true;
+        var quantity = $scope.conference.ticketTypes ? $scope.registration.quantity : 1;
+        var ticketType = selectedTicketType();
+        if (ticketType && Number(ticketType.price) > 0) {
+            checkout(quantity);
+            return;
+        }
         gapi.client.conference.registerForConference({
-            websafeConferenceKey: $routeParams.websafeConferenceKey
+            websafeConferenceKey: $routeParams.websafeConferenceKey,
+            websafeTicketTypeKey: $scope.registration.websafeTicketTypeKey,
+            quantity: quantity,
+            promoCode: $scope.registration.promoCode
         }).execute(function (resp) {
             $scope.$apply(function () {
-                $scope.loading = false;
                 if (resp.error) {
                     // The request has failed.
-                    var errorMessage = resp.error.message || '';
-                    $scope.messages = 'Failed to register for the conference : ' + errorMessage;
-                    $scope.alertStatus = 'warning';
-                    $log.error($scope.messages);
-
+                    registrationFailed(resp);
                     if (resp.code && resp.code == HTTP_ERRORS.UNAUTHORIZED) {
                         oauth2Provider.showLoginModal();
                         return;
@@ -626,19 +1125,57 @@ conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $
                 } else {
                     if (resp.result) {
                         // Register succeeded.
-                        $scope.messages = 'Registered for the conference';
-                        $scope.alertStatus = 'success';
-                        $scope.isUserAttending = true;
-                        $scope.conference.seatsAvailable = $scope.conference.seatsAvailable - 1;
+                        registrationDone(quantity);
                     } else {
-                        $scope.messages = 'Failed to register for the conference';
-                        $scope.alertStatus = 'warning';
+                        registrationFailed(resp);
                     }
                 }
             });
         });
     };
 
+    /**
+     * Invokes the conference.getTicket method and shows the QR code.
+     */
+    $scope.showTicket = function () {
+        $scope.loading = true;
+        gapi.client.conference.getTicket({
+            websafeConferenceKey: $routeParams.websafeConferenceKey
+        }).execute(function (resp) {
+            $scope.$apply(function () {
+                $scope.loading = false;
+                if (resp.error) {
+                    $scope.messages = 'Failed to get the ticket : ' + (resp.error.message || '');
+                    $scope.alertStatus = 'warning';
+                    $log.error($scope.messages);
+                    return;
+                }
+                $scope.ticket = resp.result;
+            });
+        });
+    };
+
+    /**
+     * Invokes the conference.getInvoice method and downloads the PDF.
+     */
+    $scope.downloadInvoice = function () {
+        $scope.loading = true;
+        gapi.client.conference.getInvoice({
+            websafeConferenceKey: $routeParams.websafeConferenceKey
+        }).execute(function (resp) {
+            $scope.$apply(function () {
+                $scope.loading = false;
+                if (resp.error) {
+                    $scope.messages = 'Failed to get the invoice : ' + (resp.error.message || '');
+                    $scope.alertStatus = 'warning';
+                    $log.error($scope.messages);
+                    return;
+                }
+                window.location.href = resp.result.pdfUrl;
+            });
+        });
+    };
+
     /**
      * Invokes the conference.unregisterForConference method.
      */
@@ -664,7 +1201,10 @@ conferenceApp.controllers.controller('ConferenceDetailCtrl', function ($scope, $
                         // Unregister succeeded.
                         $scope.messages = 'Unregistered from the conference';
                         $scope.alertStatus = 'success';
-                        $scope.conference.seatsAvailable = $scope.conference.seatsAvailable + 1;
+                        $scope.conference.seatsAvailable = $scope.conference.seatsAvailable + resp.result.quantity;
+                        if (resp.result.refundStatus) {
+                            $scope.messages += '; a refund is on its way';
+                        }
                         $scope.isUserAttending = false;
                         $log.info($scope.messages);
                     } else {
@@ -0,0 +1,273 @@
+package main
+
+/*
+teeshirts.go -- tee-shirt sizes of the attendees of a conference, for
+    ordering shirts: a report, a CSV download, and the final tally mailed
+    to the organizer before the event
+
+A registration counts its holder's size once; the extra seats it takes
+are counted apart as guest seats, since their sizes aren't known.
+
+*/
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/taskqueue"
+)
+
+//How long before a conference starts its organizer gets the final tally.
+const TEE_SHIRT_TALLY_LEAD = 7 * 24 * time.Hour
+
+//How long a signed tee-shirts CSV link stays valid.
+const TEE_SHIRTS_EXPORT_TTL = 10 * time.Minute
+
+func countTeeShirtSizes(appCtx context.Context, confKey *datastore.Key) (*TeeShirtReportForm, error) {
+	//Count the tee-shirt sizes of the attendees of a conference.
+	counts := make([]int, XXXL_W + 1)
+	report := &TeeShirtReportForm{}
+	it := attendeesQuery(confKey).Run(appCtx)
+	for done := false; !done; {
+		//profiles are fetched a page of registrations at a time
+		regs := make([]Registration, 0, MAX_ATTENDEES_LIMIT)
+		regKeys := make([]*datastore.Key, 0, MAX_ATTENDEES_LIMIT)
+		for len(regKeys) < MAX_ATTENDEES_LIMIT {
+			var reg Registration
+			regKey, err := it.Next(&reg)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			regs = append(regs, reg)
+			regKeys = append(regKeys, regKey)
+		}
+		profiles, _, err := getRegisteredProfiles(appCtx, regKeys)
+		if err != nil {
+			return nil, err
+		}
+		for v := range profiles {
+			counts[StringEnumToTeeShirtSize(profiles[v].TeeShirtSize)]++
+			report.GuestSeats += registrationSeats(&regs[v]) - 1
+		}
+		report.Attendees += len(profiles)
+	}
+	report.Items = make([]TeeShirtSizeCount, len(counts))
+	for size, count := range counts {
+		report.Items[size] = TeeShirtSizeCount{Size: TeeShirtSize(size), Count: count}
+	}
+	return report, nil
+}
+
+func (h *ConferenceApi) GetTeeShirtReport(r *http.Request, cr *ConfRequest) (*TeeShirtReportForm, error) {
+	//Return the tee-shirt sizes of the attendees of a conference; organizer
+	//only.
+	_, confKey, _, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	return countTeeShirtSizes(appengine.NewContext(r), confKey)
+}
+
+func (h *ConferenceApi) GetTeeShirtReportCsvUrl(r *http.Request, cr *ConfRequest) (*StringMessage, error) {
+	//Return a short-lived signed link to the tee-shirt report of a
+	//conference as CSV; organizer only.
+	_, key, user, err := getOrganizedConference(r, cr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	userId := getUserId(user, "")
+	conf := key.Encode()
+	expires := strconv.FormatInt(time.Now().Add(TEE_SHIRTS_EXPORT_TTL).Unix(), 10)
+	v := url.Values{
+		"conference": {conf},
+		"user": {userId},
+		"expires": {expires},
+		"sig": {signToken("teeshirts.csv", conf, userId, expires)},
+	}
+	return &StringMessage{
+		Data: "https://" + appengine.DefaultVersionHostname(appCtx) + "/export/teeshirts.csv?" + v.Encode(),
+	}, nil
+}
+
+func TeeShirtsCsvHandler(w http.ResponseWriter, r *http.Request) {
+	//Serve a signed link from getTeeShirtReportCsvUrl.
+	conf := r.FormValue("conference")
+	userId := r.FormValue("user")
+	expires := r.FormValue("expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp ||
+		!verifyToken(r.FormValue("sig"), "teeshirts.csv", conf, userId, expires) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid or expired link"))
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	key, err := datastore.DecodeKey(conf)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var c Conference
+	if err := datastore.Get(appCtx, key, &c); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if c.OrganizerUserId != userId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	//counted up front, unlike the attendees CSV, so a failure is still an error
+	report, err := countTeeShirtSizes(appCtx, key)
+	if err != nil {
+		applog.Errorf(appCtx, "tee-shirts csv %s: %v", conf, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="teeshirts.csv"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"teeShirtSize", "count"})
+	for _, item := range report.Items {
+		cw.Write([]string{TeeShirtSizeToStringEnum(item.Size), strconv.Itoa(item.Count)})
+	}
+	if report.GuestSeats > 0 {
+		cw.Write([]string{"GUEST_SEATS", strconv.Itoa(report.GuestSeats)})
+	}
+	cw.Flush()
+	recordAudit(appCtx, userId, "conference.exportTeeShirts", key, key, nil, nil)
+}
+
+func SendTeeShirtTalliesHandler(w http.ResponseWriter, r *http.Request) {
+	//Queue the final tee-shirt tally of every conference starting within
+	//TEE_SHIRT_TALLY_LEAD whose organizer didn't get it yet.
+	if !checkCronRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	now := time.Now()
+	var confs []Conference
+	confKeys, err := datastore.NewQuery("Conference").
+		Filter("StartDate>", now).
+		Filter("StartDate<=", now.Add(TEE_SHIRT_TALLY_LEAD)).
+		GetAll(appCtx, &confs)
+	if err != nil {
+		applog.Errorf(appCtx, "tee-shirt tallies: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tasks := make([]*taskqueue.Task, 0, len(confs))
+	for v := range confs {
+		if !confs[v].TeeShirtTallySentAt.IsZero() {
+			continue
+		}
+		tasks = append(tasks, taskqueue.NewPOSTTask("/tasks/send_tee_shirt_tally", url.Values{
+			"conferenceKey": {confKeys[v].Encode()},
+		}))
+	}
+	//the task queue accepts at most 100 tasks per call
+	for len(tasks) > 0 {
+		n := len(tasks)
+		if n > 100 {
+			n = 100
+		}
+		if _, err := taskqueue.AddMulti(appCtx, tasks[:n], ""); err != nil {
+			applog.Errorf(appCtx, "tee-shirt tallies: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		tasks = tasks[n:]
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func SendTeeShirtTallyHandler(w http.ResponseWriter, r *http.Request) {
+	//Email the organizer of one conference its final tee-shirt tally, once.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	confKey, err := datastore.DecodeKey(r.PostFormValue("conferenceKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var conf Conference
+	if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+		applog.Warningf(appCtx, "tee-shirt tally %v: %v", confKey, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !conf.TeeShirtTallySentAt.IsZero() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	report, err := countTeeShirtSizes(appCtx, confKey)
+	if err != nil {
+		applog.Errorf(appCtx, "tee-shirt tally %v: %v", confKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var prof Profile
+	err = datastore.Get(appCtx, datastore.NewKey(appCtx, "Profile", conf.OrganizerUserId, 0, nil), &prof)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	email := prof.MainEmail
+	if email == "" {
+		email = conf.OrganizerUserId
+	}
+
+	body := fmt.Sprintf("Hi, here are the tee-shirt sizes of the %d attendees of %s, which starts on %s:\r\n\r\n",
+		report.Attendees, conf.Name, conf.StartDate.In(conferenceLocation(&conf)).Format("2006-01-02"))
+	for _, item := range report.Items {
+		if item.Count > 0 {
+			body += fmt.Sprintf("%-14s %5d\r\n", TeeShirtSizeToStringEnum(item.Size), item.Count)
+		}
+	}
+	if report.GuestSeats > 0 {
+		body += fmt.Sprintf("\r\n%d more seats were booked for guests whose sizes are unknown.\r\n", report.GuestSeats)
+	}
+	body += "\r\nhttps://" + appengine.DefaultVersionHostname(appCtx) + "/#/conference/detail/" + confKey.Encode() + "\r\n"
+	msg := &mail.Message{
+		To: []string{email},
+		Subject: "Tee-shirt sizes for " + conf.Name,
+		Body: body,
+	}
+	if err := sendEmail(appCtx, conf.OrganizerUserId, EMAIL_ORGANIZER_REPORTS, msg); err != nil {
+		applog.Errorf(appCtx, "tee-shirt tally %v: %v", confKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//a retry after this fails sends the tally again, which is harmless
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, &conf); err != nil {
+			return err
+		}
+		conf.TeeShirtTallySentAt = time.Now()
+		_, err := datastore.Put(appCtx, confKey, &conf)
+		return err
+	}, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "tee-shirt tally %v: %v", confKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
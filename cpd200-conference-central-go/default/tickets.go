@@ -0,0 +1,213 @@
+package main
+
+/*
+tickets.go -- ticket types of a conference (early bird, regular,
+    student, VIP...), each with its own price, sale window, per-user
+    limit and pool of seats
+
+A conference without ticket types is registered for as before, one free
+seat per attendee. Once it has ticket types, every registration picks one
+and takes Quantity seats from both the conference and the type; see
+seatshards.go.
+
+*/
+
+import (
+	"net/http"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+//Ticket types per conference; each type's shards, the type and its
+//Conference are created in one cross-group transaction.
+const MAX_TICKET_TYPES = 10
+
+//Tickets one user can take in a single registration, by default and at most.
+const (
+	DEFAULT_TICKETS_PER_USER = 1
+	MAX_TICKETS_PER_USER = 10
+)
+
+//Currency of ticket types created without one.
+const DEFAULT_CURRENCY = "USD"
+
+func maxTicketsPerUser(tt *TicketType) int {
+	//Return how many tickets of a type one user can take.
+	if tt.MaxPerUser <= 0 {
+		return DEFAULT_TICKETS_PER_USER
+	}
+	return tt.MaxPerUser
+}
+
+func ticketTypeOnSale(tt *TicketType, now time.Time) bool {
+	//Return true if tickets of a type can be bought at now.
+	if !tt.SalesStart.IsZero() && now.Before(tt.SalesStart) {
+		return false
+	}
+	return tt.SalesEnd.IsZero() || now.Before(tt.SalesEnd)
+}
+
+func copyTicketTypeToForm(conf *Conference, tt *TicketType, key *datastore.Key, seatsAvailable int, now time.Time) *TicketTypeForm {
+	//Copy relevant fields from TicketType to TicketTypeForm; dates are in
+	//the conference's time zone.
+	return &TicketTypeForm{
+		Name: tt.Name,
+		Description: tt.Description,
+		Price: tt.Price,
+		Currency: tt.Currency,
+		Capacity: tt.Capacity,
+		SeatsAvailable: seatsAvailable,
+		SalesStart: formatConferenceTime(conf, tt.SalesStart),
+		SalesEnd: formatConferenceTime(conf, tt.SalesEnd),
+		MaxPerUser: maxTicketsPerUser(tt),
+		OnSale: ticketTypeOnSale(tt, now),
+		WebsafeKey: key.Encode(),
+	}
+}
+
+func getTicketTypeForms(appCtx context.Context, conf *Conference, confKey *datastore.Key) ([]TicketTypeForm, error) {
+	//Return the ticket types of a conference, cheapest first, with the
+	//free seats of each.
+	var types []TicketType
+	keys, err := datastore.NewQuery("TicketType").Ancestor(confKey).Order("Price").GetAll(appCtx, &types)
+	if err != nil {
+		return nil, err
+	}
+	shardCounts := make([]int, len(types))
+	for v := range types {
+		shardCounts[v] = types[v].SeatShards
+	}
+	free, err := sumSeatsAvailable(appCtx, keys, shardCounts)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	forms := make([]TicketTypeForm, 0, len(types))
+	for v := range types {
+		forms = append(forms, *copyTicketTypeToForm(conf, &types[v], keys[v], free[v], now))
+	}
+	return forms, nil
+}
+
+func getConferenceTicketType(appCtx context.Context, confKey *datastore.Key, websafeTicketTypeKey string) (*TicketType, *datastore.Key, error) {
+	//Return the requested TicketType if it belongs to the conference.
+	key, err := datastore.DecodeKey(websafeTicketTypeKey)
+	if err != nil || key.Kind() != "TicketType" || key.Parent() == nil || !key.Parent().Equal(confKey) {
+		return nil, nil, endpoints.NewBadRequestError("invalid websafeTicketTypeKey")
+	}
+	var tt TicketType
+	err = datastore.Get(appCtx, key, &tt)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, endpoints.NewNotFoundError("No such ticket type")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tt, key, nil
+}
+
+func ticketSeatShardKey(appCtx context.Context, typeKey *datastore.Key, tt *TicketType, userId string) *datastore.Key {
+	//Return the shard of a ticket type's pool userId takes seats from.
+	return seatShardKey(appCtx, typeKey, seatShardIndex(userId, tt.SeatShards))
+}
+
+func forgetTicketSeats(appCtx context.Context, typeKey *datastore.Key) {
+	//Drop the cached free seats of a ticket type once a change is committed.
+	err := memcache.Delete(appCtx, seatsAvailableCacheKey(typeKey.Encode()))
+	if err != nil && err != memcache.ErrCacheMiss {
+		applog.Warningf(appCtx, "ticket seats for %s: %v", typeKey, err)
+	}
+}
+
+func (h *ConferenceApi) CreateTicketType(r *http.Request, tr *TicketTypeRequest) (*TicketTypeForm, error) {
+	//Add a ticket type to a conference; organizer only. Registrations still
+	//need a free conference seat too, so capacities may add up to more
+	//than maxAttendees.
+	conf, confKey, user, err := getOrganizedConference(r, tr.WebsafeConferenceKey)
+	if err != nil {
+		return nil, err
+	}
+	salesStart, salesEnd, err := validateTicketTypeRequest(tr, conferenceLocation(conf))
+	if err != nil {
+		return nil, err
+	}
+	if tr.Currency == "" {
+		tr.Currency = DEFAULT_CURRENCY
+	}
+
+	appCtx := appengine.NewContext(r)
+	_, high, err := datastore.AllocateIDs(appCtx, "TicketType", confKey, 1)
+	if err != nil {
+		return nil, err
+	}
+	typeKey := datastore.NewKey(appCtx, "TicketType", "", high, confKey)
+	tt := &TicketType{
+		Name: tr.Name,
+		Description: tr.Description,
+		Price: tr.Price,
+		Currency: tr.Currency,
+		Capacity: tr.Capacity,
+		SalesStart: salesStart,
+		SalesEnd: salesEnd,
+		MaxPerUser: tr.MaxPerUser,
+		SeatShards: seatShardCount(tr.Capacity),
+		CreatedAt: time.Now(),
+	}
+	err = datastore.RunInTransaction(appCtx, func(appCtx context.Context) error {
+		if err := datastore.Get(appCtx, confKey, conf); err != nil {
+			return err
+		}
+		//ancestor queries run inside the transaction, so names stay unique
+		var types []TicketType
+		if _, err := datastore.NewQuery("TicketType").Ancestor(confKey).GetAll(appCtx, &types); err != nil {
+			return err
+		}
+		if len(types) >= MAX_TICKET_TYPES {
+			return endpoints.NewConflictError("A conference can have at most %d ticket types", MAX_TICKET_TYPES)
+		}
+		for v := range types {
+			if types[v].Name == tt.Name {
+				return endpoints.NewConflictError("There already is a ticket type named %q", tt.Name)
+			}
+		}
+		conf.TicketTypes = len(types) + 1
+		shards := newSeatShards(confKey.Encode(), tt.SeatShards, tt.Capacity)
+		if _, err := datastore.PutMulti(appCtx, seatShardKeys(appCtx, typeKey, tt.SeatShards), shards); err != nil {
+			return err
+		}
+		_, err := datastore.PutMulti(appCtx, []*datastore.Key{typeKey, confKey}, []interface{}{tt, conf})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, getUserId(user, ""), "ticketType.create", typeKey, confKey, nil, auditSnapshot(tt))
+	return copyTicketTypeToForm(conf, tt, typeKey, tt.Capacity, time.Now()), nil
+}
+
+func (h *ConferenceApi) GetTicketTypes(r *http.Request, cr *ConfRequest) (*TicketTypeForms, error) {
+	//Return the ticket types of a conference, cheapest first.
+	confKey, err := datastore.DecodeKey(cr.WebsafeConferenceKey)
+	if err != nil || confKey.Kind() != "Conference" {
+		return nil, endpoints.BadRequestError
+	}
+	appCtx := appengine.NewContext(r)
+	var conf Conference
+	err = datastore.Get(appCtx, confKey, &conf)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	items, err := getTicketTypeForms(appCtx, &conf, confKey)
+	if err != nil {
+		return nil, err
+	}
+	return &TicketTypeForms{Items: items}, nil
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strings"
+	"google.golang.org/appengine"
 	appuser "google.golang.org/appengine/user"
 )
 
@@ -19,3 +26,46 @@ func getUserId(user *appuser.User, idType string) string {
 	
 	return ""
 }
+
+func newSecret() (string, error) {
+	//Return a random url-safe string, for secrets and unguessable tokens.
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func signingSecret() string {
+	//Return the SIGNING_SECRET set in app.yaml, or "" if it is unset or
+	//still the public placeholder outside the development server.
+	secret := os.Getenv("SIGNING_SECRET")
+	if secret == "" || secret == SIGNING_SECRET_PLACEHOLDER {
+		if !appengine.IsDevAppServer() {
+			return ""
+		}
+		return SIGNING_SECRET_PLACEHOLDER
+	}
+	return secret
+}
+
+func signToken(parts ...string) string {
+	//Return an url-safe HMAC-SHA256 signature of parts, keyed with the
+	//signing secret. Panics without one, rather than sign forgeable links.
+	secret := signingSecret()
+	if secret == "" {
+		panic("SIGNING_SECRET is not set in app.yaml")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyToken(sig string, parts ...string) bool {
+	//Check sig was produced by signToken for the same parts; nothing is
+	//trusted without a signing secret.
+	if signingSecret() == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(signToken(parts...)))
+}
@@ -0,0 +1,358 @@
+package main
+
+/*
+validation.go -- checks on inbound form messages, reported as a 400
+    listing every invalid field and why
+
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	netmail "net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+)
+
+//Indexed datastore strings are limited to 1500 bytes.
+const MAX_INDEXED_STRING_BYTES = 1500
+
+//Longest name accepted for conferences, cities, topics and display names.
+const MAX_NAME_LENGTH = 200
+
+//Longest profile bio, and most links on a profile and longest of them.
+const (
+	MAX_BIO_LENGTH = 2000
+	MAX_PROFILE_LINKS = 10
+	MAX_LINK_LENGTH = 500
+)
+
+type FieldError struct {
+	//FieldError -- one invalid inbound field, by its JSON name
+	Field string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type ValidationError struct {
+	//ValidationError -- every FieldError found in one request; sent to
+	//the client as the JSON message of a 400
+	Message string `json:"message"`
+	FieldErrors []FieldError `json:"fieldErrors"`
+}
+
+func (v *ValidationError) Add(field string, format string, args ...interface{}) {
+	//Record that field is invalid.
+	v.FieldErrors = append(v.FieldErrors, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+func (v *ValidationError) Err() error {
+	//Return a 400 APIError listing the field errors, or nil if there are none.
+	if len(v.FieldErrors) == 0 {
+		return nil
+	}
+	v.Message = "Invalid request"
+	js, _ := json.Marshal(v)
+	return endpoints.NewAPIError(endpoints.BadRequestError.Name, string(js), endpoints.BadRequestError.Code)
+}
+
+func checkName(v *ValidationError, field string, value string, required bool) {
+	//Check a short, indexed, human readable string.
+	if strings.TrimSpace(value) == "" {
+		if required {
+			v.Add(field, "is required")
+		}
+		return
+	}
+	if !utf8.ValidString(value) {
+		v.Add(field, "must be valid UTF-8")
+	} else if utf8.RuneCountInString(value) > MAX_NAME_LENGTH {
+		v.Add(field, "must be at most %d characters", MAX_NAME_LENGTH)
+	}
+}
+
+//Accepted date layouts; all but RFC3339 are read in the conference's time zone.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseDate(v *ValidationError, field string, value string, loc *time.Location) time.Time {
+	//Parse a date, recording an error if it isn't one; the result is in loc.
+	if value == "" {
+		return time.Time{}
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.In(loc)
+		}
+	}
+	v.Add(field, "must be an RFC3339 date, e.g. 2016-05-30T09:00:00+02:00, or a local date like 2016-05-30")
+	return time.Time{}
+}
+
+func validateConferenceForm(cf *ConferenceForm) (time.Time, time.Time, error) {
+	//Check a createConference request; returns the parsed start and end dates,
+	//in the conference's time zone.
+	v := &ValidationError{}
+	checkName(v, "name", cf.Name, true)
+	checkName(v, "city", cf.City, false)
+	if len(cf.Description) > MAX_INDEXED_STRING_BYTES {
+		v.Add("description", "must be at most %d bytes", MAX_INDEXED_STRING_BYTES)
+	}
+	for i, topic := range cf.Topics {
+		checkName(v, fmt.Sprintf("topics[%d]", i), topic, true)
+	}
+	if cf.MaxAttendees < 0 {
+		v.Add("maxAttendees", "must not be negative")
+	}
+
+	loc := time.UTC
+	if cf.TimeZone != "" {
+		var err error
+		loc, err = time.LoadLocation(cf.TimeZone)
+		if err != nil || cf.TimeZone == "Local" {
+			v.Add("timeZone", "must be an IANA time zone name, e.g. Europe/Paris")
+			loc = time.UTC
+		}
+	}
+	startDate := parseDate(v, "startDate", cf.StartDate, loc)
+	endDate := parseDate(v, "endDate", cf.EndDate, loc)
+	if cf.EndDate != "" && cf.StartDate == "" {
+		v.Add("startDate", "is required when endDate is set")
+	}
+	if !startDate.IsZero() && !endDate.IsZero() && endDate.Before(startDate) {
+		v.Add("endDate", "must not be before startDate")
+	}
+	return startDate, endDate, v.Err()
+}
+
+func validateTicketTypeRequest(tr *TicketTypeRequest, loc *time.Location) (time.Time, time.Time, error) {
+	//Check a createTicketType request; returns the parsed sale window, read
+	//in the conference's time zone loc.
+	v := &ValidationError{}
+	checkName(v, "name", tr.Name, true)
+	if len(tr.Description) > MAX_INDEXED_STRING_BYTES {
+		v.Add("description", "must be at most %d bytes", MAX_INDEXED_STRING_BYTES)
+	}
+	if tr.Price < 0 {
+		v.Add("price", "must not be negative")
+	}
+	if tr.Currency != "" && (len(tr.Currency) != 3 ||
+		strings.IndexFunc(tr.Currency, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0) {
+		v.Add("currency", "must be an ISO 4217 currency code, e.g. USD")
+	}
+	if tr.Capacity <= 0 {
+		v.Add("capacity", "must be positive")
+	}
+	if tr.MaxPerUser < 0 || tr.MaxPerUser > MAX_TICKETS_PER_USER {
+		v.Add("maxPerUser", "must be between 0 and %d", MAX_TICKETS_PER_USER)
+	}
+	salesStart := parseDate(v, "salesStart", tr.SalesStart, loc)
+	salesEnd := parseDate(v, "salesEnd", tr.SalesEnd, loc)
+	if !salesStart.IsZero() && !salesEnd.IsZero() && !salesEnd.After(salesStart) {
+		v.Add("salesEnd", "must be after salesStart")
+	}
+	return salesStart, salesEnd, v.Err()
+}
+
+func validatePromoCodeRequest(pr *PromoCodeRequest, loc *time.Location) (time.Time, error) {
+	//Check a createPromoCode request with a normalized Code; returns the
+	//parsed expiry, read in the conference's time zone loc.
+	v := &ValidationError{}
+	if len(pr.Code) < MIN_PROMO_CODE_LENGTH || len(pr.Code) > MAX_PROMO_CODE_LENGTH ||
+		strings.IndexFunc(pr.Code, func(r rune) bool {
+			return (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_'
+		}) >= 0 {
+		v.Add("code", "must be %d to %d letters, digits, '-' or '_'", MIN_PROMO_CODE_LENGTH, MAX_PROMO_CODE_LENGTH)
+	}
+	if (pr.PercentOff == 0) == (pr.AmountOff == 0) {
+		v.Add("percentOff", "exactly one of percentOff and amountOff must be set")
+	}
+	if pr.PercentOff < 0 || pr.PercentOff > 100 {
+		v.Add("percentOff", "must be between 1 and 100")
+	}
+	if pr.AmountOff < 0 {
+		v.Add("amountOff", "must not be negative")
+	}
+	if pr.MaxUses < 0 {
+		v.Add("maxUses", "must not be negative")
+	}
+	expiresAt := parseDate(v, "expiresAt", pr.ExpiresAt, loc)
+	return expiresAt, v.Err()
+}
+
+func validateCancellationPolicyRequest(cpr *CancellationPolicyRequest, loc *time.Location) (time.Time, time.Time, error) {
+	//Check a setCancellationPolicy request; returns the parsed dates, read
+	//in the conference's time zone loc.
+	v := &ValidationError{}
+	fullRefundUntil := parseDate(v, "fullRefundUntil", cpr.FullRefundUntil, loc)
+	partialRefundUntil := parseDate(v, "partialRefundUntil", cpr.PartialRefundUntil, loc)
+	if !partialRefundUntil.IsZero() {
+		if cpr.PartialRefundPercent < 1 || cpr.PartialRefundPercent > 99 {
+			v.Add("partialRefundPercent", "must be between 1 and 99")
+		}
+		if partialRefundUntil.Before(fullRefundUntil) {
+			v.Add("partialRefundUntil", "must not be before fullRefundUntil")
+		}
+	}
+	return fullRefundUntil, partialRefundUntil, v.Err()
+}
+
+func checkBillingText(v *ValidationError, field string, value string, maxLength int) {
+	//Check a free-form, unindexed billing field such as an address.
+	if !utf8.ValidString(value) {
+		v.Add(field, "must be valid UTF-8")
+	} else if utf8.RuneCountInString(value) > maxLength {
+		v.Add(field, "must be at most %d characters", maxLength)
+	}
+}
+
+func validateBillingDetailsRequest(br *BillingDetailsRequest) error {
+	//Check a setBillingDetails request.
+	v := &ValidationError{}
+	checkName(v, "name", br.Name, true)
+	checkBillingText(v, "address", br.Address, MAX_BILLING_ADDRESS_LENGTH)
+	checkBillingText(v, "vatId", br.VatId, MAX_VAT_ID_LENGTH)
+	if br.Email != "" {
+		if _, err := netmail.ParseAddress(br.Email); err != nil {
+			v.Add("email", "must be an email address")
+		}
+	}
+	if br.VatPercent < 0 || br.VatPercent > 100 {
+		v.Add("vatPercent", "must be between 0 and 100")
+	}
+	if len(br.InvoicePrefix) > MAX_INVOICE_PREFIX_LENGTH ||
+		strings.IndexFunc(br.InvoicePrefix, func(r rune) bool {
+			return (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-'
+		}) >= 0 {
+		v.Add("invoicePrefix", "must be at most %d upper-case letters, digits or '-'", MAX_INVOICE_PREFIX_LENGTH)
+	}
+	return v.Err()
+}
+
+func validateInvoiceRequest(ir *InvoiceRequest) error {
+	//Check the buyer details of a getInvoice request.
+	v := &ValidationError{}
+	checkName(v, "company", ir.Company, false)
+	checkBillingText(v, "address", ir.Address, MAX_BILLING_ADDRESS_LENGTH)
+	checkBillingText(v, "vatId", ir.VatId, MAX_VAT_ID_LENGTH)
+	return v.Err()
+}
+
+func validateCheckInStaffRequest(sr *CheckInStaffRequest) error {
+	//Check a setCheckInStaff request, trimming the emails in place.
+	v := &ValidationError{}
+	if len(sr.Emails) > MAX_CHECK_IN_STAFF {
+		v.Add("emails", "must list at most %d people", MAX_CHECK_IN_STAFF)
+	}
+	for i, email := range sr.Emails {
+		sr.Emails[i] = strings.TrimSpace(email)
+		if _, err := netmail.ParseAddress(sr.Emails[i]); err != nil || strings.Contains(sr.Emails[i], "<") {
+			v.Add(fmt.Sprintf("emails[%d]", i), "must be an email address")
+		}
+	}
+	return v.Err()
+}
+
+func validateDeleteAccountRequest(dr *DeleteAccountRequest, prof *Profile, userId string) error {
+	//Check a deleteMyAccount request from userId, trimming the emails in place.
+	v := &ValidationError{}
+	dr.ConfirmEmail = strings.TrimSpace(dr.ConfirmEmail)
+	dr.TransferConferencesTo = strings.TrimSpace(dr.TransferConferencesTo)
+	if dr.ConfirmEmail == "" {
+		v.Add("confirmEmail", "is required")
+	} else if !strings.EqualFold(dr.ConfirmEmail, userId) && !strings.EqualFold(dr.ConfirmEmail, prof.MainEmail) {
+		v.Add("confirmEmail", "must be your email address")
+	}
+	if dr.TransferConferencesTo != "" {
+		if _, err := netmail.ParseAddress(dr.TransferConferencesTo); err != nil || strings.Contains(dr.TransferConferencesTo, "<") {
+			v.Add("transferConferencesTo", "must be an email address")
+		} else if strings.EqualFold(dr.TransferConferencesTo, userId) {
+			v.Add("transferConferencesTo", "must be someone else")
+		}
+	}
+	return v.Err()
+}
+
+func validateBadgeLayout(l *badgeLayout) error {
+	//Check the layout of a getBadgesPdfUrl request, defaults filled in.
+	v := &ValidationError{}
+	if _, ok := badgePageSizes[l.pageSize]; !ok {
+		v.Add("pageSize", "must be A4 or LETTER")
+	}
+	if l.columns < 1 || l.columns > MAX_BADGE_COLUMNS {
+		v.Add("columns", "must be between 1 and %d", MAX_BADGE_COLUMNS)
+	}
+	if l.rows < 1 || l.rows > MAX_BADGE_ROWS {
+		v.Add("rows", "must be between 1 and %d", MAX_BADGE_ROWS)
+	}
+	return v.Err()
+}
+
+func validateProfileMiniForm(pf *ProfileMiniForm) error {
+	//Check a saveProfile request.
+	v := &ValidationError{}
+	checkName(v, "displayName", pf.DisplayName, false)
+	if pf.Affiliation != nil {
+		checkName(v, "affiliation", *pf.Affiliation, false)
+	}
+	if pf.JobTitle != nil {
+		checkName(v, "jobTitle", *pf.JobTitle, false)
+	}
+	if pf.Location != nil {
+		checkName(v, "location", *pf.Location, false)
+	}
+	if pf.Bio != nil {
+		if !utf8.ValidString(*pf.Bio) {
+			v.Add("bio", "must be valid UTF-8")
+		} else if utf8.RuneCountInString(*pf.Bio) > MAX_BIO_LENGTH {
+			v.Add("bio", "must be at most %d characters", MAX_BIO_LENGTH)
+		}
+	}
+	if len(pf.Links) > MAX_PROFILE_LINKS {
+		v.Add("links", "must be at most %d links", MAX_PROFILE_LINKS)
+	}
+	for i, link := range pf.Links {
+		u, err := url.Parse(strings.TrimSpace(link))
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			v.Add(fmt.Sprintf("links[%d]", i), "must be an http or https URL")
+		} else if len(link) > MAX_LINK_LENGTH {
+			v.Add(fmt.Sprintf("links[%d]", i), "must be at most %d bytes", MAX_LINK_LENGTH)
+		}
+	}
+	if pf.TeeShirtSize == TEE_SHIRT_SIZE_INVALID {
+		v.Add("teeShirtSize", "must be one of NOT_SPECIFIED, XS_M, XS_W, ... XXXL_W")
+	}
+	return v.Err()
+}
+
+func validateQueryFilter(v *ValidationError, i int, filtr *ConferenceQueryForm) {
+	//Check one unformatted ConferenceQueryForm; see formatFilters.
+	prefix := fmt.Sprintf("filters[%d].", i)
+	if _, ok := FIELDS[filtr.Field]; !ok {
+		v.Add(prefix + "field", "must be one of CITY, TOPIC, MONTH, MAX_ATTENDEES")
+	}
+	if _, ok := OPERATORS[filtr.Operator]; !ok {
+		v.Add(prefix + "operator", "must be one of EQ, GT, GTEQ, LT, LTEQ, NE")
+	}
+	switch filtr.Field {
+	case "MONTH":
+		if n, err := strconv.Atoi(filtr.Value); err != nil || n < 1 || n > 12 {
+			v.Add(prefix + "value", "must be a month number, 1 to 12")
+		}
+	case "MAX_ATTENDEES":
+		if n, err := strconv.Atoi(filtr.Value); err != nil || n < 0 {
+			v.Add(prefix + "value", "must be a non-negative integer")
+		}
+	default:
+		if len(filtr.Value) > MAX_INDEXED_STRING_BYTES {
+			v.Add(prefix + "value", "must be at most %d bytes", MAX_INDEXED_STRING_BYTES)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+/*
+webhooks.go -- organizer webhook subscriptions to conference lifecycle
+    events, delivered through the task queue with HMAC-SHA256 signatures
+
+*/
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"github.com/GoogleCloudPlatform/go-endpoints/endpoints"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	applog "google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+)
+
+//Webhook event types.
+const (
+	EVENT_CONFERENCE_CREATED = "conference.created"
+	EVENT_CONFERENCE_UPDATED = "conference.updated"
+	EVENT_CONFERENCE_CANCELLED = "conference.cancelled"
+	EVENT_REGISTRATION_CREATED = "registration.created"
+	EVENT_REGISTRATION_CANCELLED = "registration.cancelled"
+)
+
+var webhookEvents = map[string]bool{
+	EVENT_CONFERENCE_CREATED: true,
+	EVENT_CONFERENCE_UPDATED: true,
+	EVENT_CONFERENCE_CANCELLED: true,
+	EVENT_REGISTRATION_CREATED: true,
+	EVENT_REGISTRATION_CANCELLED: true,
+}
+
+//WebhookDelivery statuses.
+const (
+	DELIVERY_PENDING = "PENDING"
+	DELIVERY_DELIVERED = "DELIVERED"
+	DELIVERY_FAILED = "FAILED"
+)
+
+//A delivery is given up after this many attempts.
+const WEBHOOK_MAX_ATTEMPTS = 8
+
+//An organizer can have at most this many webhooks.
+const MAX_WEBHOOKS = 10
+
+//How many deliveries getWebhookDeliveries returns.
+const WEBHOOK_DELIVERIES_LIMIT = 50
+
+var webhookRetryOptions = &taskqueue.RetryOptions{
+	RetryLimit: WEBHOOK_MAX_ATTEMPTS,
+	MinBackoff: 10 * time.Second,
+	MaxBackoff: time.Hour,
+}
+
+type webhookPayload struct {
+	Id string `json:"id"`
+	Event string `json:"event"`
+	CreatedAt string `json:"createdAt"`
+	Data interface{} `json:"data"`
+}
+
+type registrationEventData struct {
+	Conference *ConferenceForm `json:"conference"`
+	AttendeeUserId string `json:"attendeeUserId"`
+}
+
+func copyWebhookToForm(hook *Webhook, keyStr string) *WebhookForm {
+	//Copy relevant fields from Webhook to WebhookForm, leaving out the secret.
+	return &WebhookForm{
+		URL: hook.URL,
+		Events: hook.Events,
+		CreatedAt: hook.CreatedAt.Format(time.RFC3339),
+		WebsafeKey: keyStr,
+	}
+}
+
+func copyWebhookDeliveryToForm(d *WebhookDelivery, keyStr string) *WebhookDeliveryForm {
+	//Copy relevant fields from WebhookDelivery to WebhookDeliveryForm.
+	wdf := &WebhookDeliveryForm{
+		Event: d.Event,
+		Payload: string(d.Payload),
+		Status: d.Status,
+		Attempts: d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError: d.LastError,
+		CreatedAt: d.CreatedAt.Format(time.RFC3339),
+		WebsafeKey: keyStr,
+	}
+	if !d.DeliveredAt.IsZero() {
+		wdf.DeliveredAt = d.DeliveredAt.Format(time.RFC3339)
+	}
+	return wdf
+}
+
+func getOwnWebhook(r *http.Request, websafeWebhookKey string) (*Webhook, *datastore.Key, error) {
+	//Return the requested Webhook if it belongs to the current user.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := datastore.DecodeKey(websafeWebhookKey)
+	if err != nil || key.Kind() != "Webhook" {
+		return nil, nil, endpoints.BadRequestError
+	}
+	if !key.Parent().Equal(profKey) {
+		return nil, nil, endpoints.NotFoundError
+	}
+	var hook Webhook
+	appCtx := appengine.NewContext(r)
+	err = datastore.Get(appCtx, key, &hook)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, endpoints.NotFoundError
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &hook, key, nil
+}
+
+func (h *ConferenceApi) CreateWebhook(r *http.Request, wf *WebhookForm) (*WebhookForm, error) {
+	//Subscribe a URL to events of the conferences the user organizes.
+	//If no secret is given one is generated; it is only returned here.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(wf.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && appengine.IsDevAppServer())) {
+		return nil, endpoints.NewBadRequestError("url must be an absolute https URL")
+	}
+	if len(wf.Events) == 0 {
+		return nil, endpoints.NewBadRequestError("at least one event is required")
+	}
+	for _, e := range wf.Events {
+		if !webhookEvents[e] {
+			return nil, endpoints.NewBadRequestError("unknown event %q", e)
+		}
+	}
+	if wf.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			return nil, err
+		}
+		wf.Secret = secret
+	}
+
+	appCtx := appengine.NewContext(r)
+	count, err := datastore.NewQuery("Webhook").Ancestor(profKey).KeysOnly().Count(appCtx)
+	if err != nil {
+		return nil, err
+	}
+	if count >= MAX_WEBHOOKS {
+		return nil, endpoints.NewConflictError("You can have at most %d webhooks", MAX_WEBHOOKS)
+	}
+	hook := &Webhook{
+		URL: u.String(),
+		Secret: wf.Secret,
+		Events: wf.Events,
+		CreatedAt: time.Now(),
+	}
+	key, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "Webhook", profKey), hook)
+	if err != nil {
+		return nil, err
+	}
+	out := copyWebhookToForm(hook, key.Encode())
+	recordAudit(appCtx, profKey.StringID(), "webhook.create", key, nil, nil, auditSnapshot(out))
+	out.Secret = hook.Secret
+	return out, nil
+}
+
+func (h *ConferenceApi) GetWebhooks(r *http.Request) (*WebhookForms, error) {
+	//Return the user's webhooks.
+	profKey, err := getUserProfileKey(r)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var hooks []Webhook
+	keys, err := datastore.NewQuery("Webhook").Ancestor(profKey).GetAll(appCtx, &hooks)
+	if err != nil {
+		return nil, err
+	}
+	forms := &WebhookForms{
+		Items: make([]WebhookForm, 0, len(hooks)),
+	}
+	for v := range hooks {
+		forms.Items = append(forms.Items, *copyWebhookToForm(&hooks[v], keys[v].Encode()))
+	}
+	return forms, nil
+}
+
+func (h *ConferenceApi) DeleteWebhook(r *http.Request, req *WebhookRequest) (*BooleanMessage, error) {
+	//Delete one of the user's webhooks with its delivery log;
+	//pending deliveries are dropped.
+	hook, key, err := getOwnWebhook(r, req.WebsafeWebhookKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	keys, err := datastore.NewQuery("WebhookDelivery").Ancestor(key).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := datastore.DeleteMulti(appCtx, append(keys, key)); err != nil {
+		return nil, err
+	}
+	recordAudit(appCtx, key.Parent().StringID(), "webhook.delete", key, nil,
+		auditSnapshot(copyWebhookToForm(hook, key.Encode())), nil)
+	return &BooleanMessage{Data: true}, nil
+}
+
+func (h *ConferenceApi) GetWebhookDeliveries(r *http.Request, req *WebhookRequest) (*WebhookDeliveryForms, error) {
+	//Return the latest deliveries of one of the user's webhooks.
+	_, key, err := getOwnWebhook(r, req.WebsafeWebhookKey)
+	if err != nil {
+		return nil, err
+	}
+	appCtx := appengine.NewContext(r)
+	var deliveries []WebhookDelivery
+	keys, err := datastore.NewQuery("WebhookDelivery").Ancestor(key).
+		Order("-CreatedAt").Limit(WEBHOOK_DELIVERIES_LIMIT).GetAll(appCtx, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	forms := &WebhookDeliveryForms{
+		Items: make([]WebhookDeliveryForm, 0, len(deliveries)),
+	}
+	for v := range deliveries {
+		forms.Items = append(forms.Items, *copyWebhookDeliveryToForm(&deliveries[v], keys[v].Encode()))
+	}
+	return forms, nil
+}
+
+func fireWebhookEvent(appCtx context.Context, organizerUserId string, event string, data interface{}) {
+	//Queue a delivery of event to each of the organizer's webhooks subscribed
+	//to it. Failures are logged; they never fail the triggering request.
+	profKey := datastore.NewKey(appCtx, "Profile", organizerUserId, 0, nil)
+	keys, err := datastore.NewQuery("Webhook").Ancestor(profKey).Filter("Events=", event).KeysOnly().GetAll(appCtx, nil)
+	if err != nil {
+		applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+		return
+	}
+	for _, hookKey := range keys {
+		//allocate the delivery ID first, the payload carries it
+		_, high, err := datastore.AllocateIDs(appCtx, "WebhookDelivery", hookKey, 1)
+		if err != nil {
+			applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+			continue
+		}
+		deliveryKey := datastore.NewKey(appCtx, "WebhookDelivery", "", high, hookKey)
+		payload, err := json.Marshal(&webhookPayload{
+			Id: deliveryKey.Encode(),
+			Event: event,
+			CreatedAt: time.Now().Format(time.RFC3339),
+			Data: data,
+		})
+		if err != nil {
+			applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+			continue
+		}
+		_, err = datastore.Put(appCtx, deliveryKey, &WebhookDelivery{
+			Event: event,
+			Payload: payload,
+			Status: DELIVERY_PENDING,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+			continue
+		}
+		task := taskqueue.NewPOSTTask("/tasks/deliver_webhook", url.Values{
+			"deliveryKey": {deliveryKey.Encode()},
+		})
+		task.RetryOptions = webhookRetryOptions
+		if _, err := taskqueue.Add(appCtx, task, ""); err != nil {
+			applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+		}
+	}
+}
+
+func fireConferenceEvent(appCtx context.Context, event string, conf *Conference, confKey *datastore.Key) {
+	//Fire a conference event to its organizer's webhooks, with the
+	//conference as data.
+	cf, err := copyConferenceToForm(conf, confKey.Encode(), "")
+	if err != nil {
+		applog.Errorf(appCtx, "webhooks for %s: %v", event, err)
+		return
+	}
+	fireWebhookEvent(appCtx, conf.OrganizerUserId, event, cf)
+}
+
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	//Return the X-Conference-Signature value: hex HMAC-SHA256 over "timestamp.payload".
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(client *http.Client, hook *Webhook, deliveryId string, d *WebhookDelivery) (int, error) {
+	//POST a delivery to its webhook URL; any 2xx reply counts as delivered.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ConferenceCentral-Webhook/1")
+	req.Header.Set("X-Conference-Event", d.Event)
+	req.Header.Set("X-Conference-Delivery", deliveryId)
+	req.Header.Set("X-Conference-Timestamp", timestamp)
+	req.Header.Set("X-Conference-Signature", signWebhookPayload(hook.Secret, timestamp, d.Payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func deliverWebhook(appCtx context.Context, client *http.Client, deliveryKey *datastore.Key) (*WebhookDelivery, error) {
+	//Attempt one webhook delivery and log the outcome on the WebhookDelivery,
+	//which is returned; nil if it or its webhook is gone. A delivery still
+	//PENDING afterwards is due another attempt.
+	var hook Webhook
+	var d WebhookDelivery
+	err := datastore.Get(appCtx, deliveryKey.Parent(), &hook)
+	if err == nil {
+		err = datastore.Get(appCtx, deliveryKey, &d)
+	}
+	if err == datastore.ErrNoSuchEntity {
+		//webhook was deleted meanwhile
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.Status != DELIVERY_PENDING {
+		return &d, nil
+	}
+
+	code, postErr := postWebhook(client, &hook, deliveryKey.Encode(), &d)
+	d.Attempts++
+	d.LastStatusCode = code
+	d.LastError = ""
+	if postErr == nil {
+		d.Status = DELIVERY_DELIVERED
+		d.DeliveredAt = time.Now()
+	} else {
+		d.LastError = postErr.Error()
+		if d.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+			d.Status = DELIVERY_FAILED
+		}
+	}
+	if _, err := datastore.Put(appCtx, deliveryKey, &d); err != nil {
+		applog.Errorf(appCtx, "deliver webhook: %v", err)
+	}
+	if d.Status == DELIVERY_PENDING {
+		applog.Warningf(appCtx, "deliver webhook %s to %s: %v", d.Event, hook.URL, postErr)
+	}
+	return &d, nil
+}
+
+func DeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	//Attempt one webhook delivery. Failing with 500 makes the task queue
+	//retry with backoff, up to WEBHOOK_MAX_ATTEMPTS after which the delivery
+	//is marked FAILED.
+	if !checkTaskRequest(w, r) {
+		return
+	}
+	appCtx := appengine.NewContext(r)
+	deliveryKey, err := datastore.DecodeKey(r.PostFormValue("deliveryKey"))
+	if err != nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	client := urlfetch.Client(appCtx)
+	client.Timeout = 10 * time.Second
+	d, err := deliverWebhook(appCtx, client, deliveryKey)
+	if err != nil || d != nil && d.Status == DELIVERY_PENDING {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
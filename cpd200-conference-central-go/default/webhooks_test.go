@@ -0,0 +1,200 @@
+package main
+
+/*
+webhooks_test.go -- webhook signatures and deliveries, against an httptest
+    receiver; the delivery tests need the App Engine SDK's aetest
+
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+const testWebhookSecret = "test-secret"
+
+type webhookReceiver struct {
+	//webhookReceiver -- an httptest webhook endpoint that rejects bad
+	//signatures with 401 and otherwise answers with the next of its status
+	//codes, then 200
+	t *testing.T
+	mu sync.Mutex
+	codes []int
+	calls int
+	rejected int
+	server *httptest.Server
+}
+
+func newWebhookReceiver(t *testing.T, codes ...int) *webhookReceiver {
+	//Start a receiver; the caller closes its server.
+	wr := &webhookReceiver{t: t, codes: codes}
+	wr.server = httptest.NewServer(http.HandlerFunc(wr.serve))
+	return wr
+}
+
+func (wr *webhookReceiver) serve(w http.ResponseWriter, r *http.Request) {
+	//Check the request the way a subscriber would, then reply.
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.calls++
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		wr.t.Errorf("read body: %v", err)
+	}
+	timestamp := r.Header.Get("X-Conference-Timestamp")
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		wr.t.Errorf("X-Conference-Timestamp = %q, want unix seconds", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get("X-Conference-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		wr.rejected++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Conference-Event") == "" || r.Header.Get("X-Conference-Delivery") == "" {
+		wr.t.Errorf("missing event or delivery header: %v", r.Header)
+	}
+	if len(wr.codes) > 0 {
+		code := wr.codes[0]
+		wr.codes = wr.codes[1:]
+		w.WriteHeader(code)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (wr *webhookReceiver) counts() (int, int) {
+	//Return the requests received and how many of them were rejected.
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return wr.calls, wr.rejected
+}
+
+func TestPostWebhookSignature(t *testing.T) {
+	wr := newWebhookReceiver(t)
+	defer wr.server.Close()
+	hook := &Webhook{URL: wr.server.URL, Secret: testWebhookSecret}
+	d := &WebhookDelivery{Event: EVENT_CONFERENCE_CREATED, Payload: []byte(`{"event":"conference.created"}`)}
+	code, err := postWebhook(wr.server.Client(), hook, "delivery-1", d)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("postWebhook = %d, %v; want 200, nil", code, err)
+	}
+
+	if _, rejected := wr.counts(); rejected != 0 {
+		t.Fatalf("receiver rejected %d signatures, want 0", rejected)
+	}
+
+	//a subscriber with another secret rejects it
+	hook.Secret = "other-secret"
+	code, err = postWebhook(wr.server.Client(), hook, "delivery-2", d)
+	if err == nil || code != http.StatusUnauthorized {
+		t.Fatalf("postWebhook with a wrong secret = %d, %v; want 401 and an error", code, err)
+	}
+	if _, rejected := wr.counts(); rejected != 1 {
+		t.Fatalf("receiver rejected %d signatures, want 1", rejected)
+	}
+}
+
+func putTestDelivery(t *testing.T, appCtx context.Context, url string) *datastore.Key {
+	//Store a Webhook pointing at url and a pending delivery to it.
+	profKey := datastore.NewKey(appCtx, "Profile", "organizer@example.com", 0, nil)
+	hookKey, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "Webhook", profKey), &Webhook{
+		URL: url,
+		Secret: testWebhookSecret,
+		Events: []string{EVENT_CONFERENCE_CREATED},
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveryKey, err := datastore.Put(appCtx, datastore.NewIncompleteKey(appCtx, "WebhookDelivery", hookKey), &WebhookDelivery{
+		Event: EVENT_CONFERENCE_CREATED,
+		Payload: []byte(`{"event":"conference.created"}`),
+		Status: DELIVERY_PENDING,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveryKey
+}
+
+func TestDeliverWebhookRetriesThenRecordsDelivery(t *testing.T) {
+	appCtx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	wr := newWebhookReceiver(t, http.StatusServiceUnavailable)
+	defer wr.server.Close()
+	deliveryKey := putTestDelivery(t, appCtx, wr.server.URL)
+
+	d, err := deliverWebhook(appCtx, wr.server.Client(), deliveryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != DELIVERY_PENDING || d.Attempts != 1 || d.LastStatusCode != http.StatusServiceUnavailable || d.LastError == "" {
+		t.Fatalf("after a failed attempt got %+v, want PENDING after 1 attempt with the 503 recorded", d)
+	}
+
+	if _, err := deliverWebhook(appCtx, wr.server.Client(), deliveryKey); err != nil {
+		t.Fatal(err)
+	}
+	var stored WebhookDelivery
+	if err := datastore.Get(appCtx, deliveryKey, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != DELIVERY_DELIVERED || stored.Attempts != 2 || stored.LastStatusCode != http.StatusOK ||
+		stored.LastError != "" || stored.DeliveredAt.IsZero() {
+		t.Fatalf("after the retry stored %+v, want DELIVERED after 2 attempts", stored)
+	}
+
+	//a delivered event isn't sent again
+	if _, err := deliverWebhook(appCtx, wr.server.Client(), deliveryKey); err != nil {
+		t.Fatal(err)
+	}
+	if calls, rejected := wr.counts(); calls != 2 || rejected != 0 {
+		t.Fatalf("receiver got %d requests, %d rejected; want 2, 0", calls, rejected)
+	}
+}
+
+func TestDeliverWebhookGivesUp(t *testing.T) {
+	appCtx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	codes := make([]int, WEBHOOK_MAX_ATTEMPTS + 1)
+	for v := range codes {
+		codes[v] = http.StatusInternalServerError
+	}
+	wr := newWebhookReceiver(t, codes...)
+	defer wr.server.Close()
+	deliveryKey := putTestDelivery(t, appCtx, wr.server.URL)
+
+	var d *WebhookDelivery
+	for v := 0; v < WEBHOOK_MAX_ATTEMPTS + 1; v++ {
+		if d, err = deliverWebhook(appCtx, wr.server.Client(), deliveryKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.Status != DELIVERY_FAILED || d.Attempts != WEBHOOK_MAX_ATTEMPTS {
+		t.Fatalf("got %+v, want FAILED after %d attempts", d, WEBHOOK_MAX_ATTEMPTS)
+	}
+	if calls, rejected := wr.counts(); calls != WEBHOOK_MAX_ATTEMPTS || rejected != 0 {
+		t.Fatalf("receiver got %d requests, %d rejected; want %d, 0", calls, rejected, WEBHOOK_MAX_ATTEMPTS)
+	}
+}